@@ -0,0 +1,83 @@
+package backoff
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultAdaptiveThreshold is the fraction of the quota under which the requests are slowed down.
+const DefaultAdaptiveThreshold = 0.1
+
+// AdaptiveLimiter slows down the requests when the quota of the server is running out
+// (X-RateLimit-Remaining close to 0) instead of waiting for a 429, it is safe for concurrent use.
+type AdaptiveLimiter struct {
+	Threshold float64
+	notBefore time.Time // no request before this date
+	mu        sync.Mutex
+}
+
+func NewAdaptiveLimiter(threshold float64) *AdaptiveLimiter {
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultAdaptiveThreshold
+	}
+	return &AdaptiveLimiter{Threshold: threshold}
+}
+
+// Update takes into account the rate limit headers of a response (nil is ignored).
+func (l *AdaptiveLimiter) Update(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	now := time.Now()
+	l.update(rateLimitFromHeader(resp.Header, now), now)
+}
+
+func (l *AdaptiveLimiter) update(rateLimit *RateLimit, now time.Time) {
+	var delay time.Duration
+	switch {
+	case rateLimit.RetryAfterDuration > 0:
+		delay = rateLimit.RetryAfterDuration
+	case rateLimit.HasRemaining && rateLimit.Limit > 0 && float64(rateLimit.Remaining) <= l.Threshold*float64(rateLimit.Limit):
+		if rateLimit.Remaining <= 0 {
+			// quota exhausted, wait for the reset
+			delay = rateLimit.Reset
+		} else {
+			// spread the remaining requests until the reset
+			delay = rateLimit.Reset / time.Duration(rateLimit.Remaining+1)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notBefore = now.Add(delay)
+}
+
+// Delay returns the time to wait before the next request.
+func (l *AdaptiveLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if delay := time.Until(l.notBefore); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Wait blocks until the next request is allowed or the context is done.
+func (l *AdaptiveLimiter) Wait(ctx context.Context) error {
+	delay := l.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,68 +1,166 @@
 package backoff
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"time"
 )
 
-type ExpBackoff struct {
-	duration time.Duration
-	cancel   <-chan struct{}
+// ErrBackoffStopped is returned by Wait once the backoff has been stopped.
+var ErrBackoffStopped = errors.New("backoff stopped")
 
-	init   time.Duration
-	max    time.Duration
-	factor int64
-	last   time.Time
+// Backoff waits between the retries, the delays are computed by a Strategy.
+// Wait and Start must be called by a single goroutine, Stop can be called from any goroutine.
+type Backoff struct {
+	strategy  Strategy
+	attempt   int
+	previous  time.Duration
+	next      time.Duration // delay imposed by SetDuration (e.g. Retry-After)
+	hasNext   bool
+	startedAt time.Time   // first wait since the last reset
+	timer     *time.Timer // reused by all the waits
+	stopped   chan struct{}
+	cancel    <-chan struct{} // set by the deprecated NewExpBackoff, nil otherwise
+	stopOnce  sync.Once
 }
 
+// ExpBackoff is the historical name of the backoff.
+type ExpBackoff = Backoff
+
 // Reset resets the duration of the backoff.
-func (b *ExpBackoff) Reset() {
-	b.duration = b.init
+func (b *Backoff) Reset() {
+	b.attempt = 0
+	b.previous = 0
+	b.hasNext = false
+	b.startedAt = time.Time{}
+}
+
+// SetDuration sets the duration of the next wait, the following ones are computed by the strategy.
+func (b *Backoff) SetDuration(d time.Duration) {
+	b.next = d
+	b.hasNext = true
+}
+
+func (b *Backoff) SetStrategy(strategy Strategy) {
+	b.strategy = strategy
+}
+
+func (b *Backoff) GetStrategy() Strategy {
+	return b.strategy
 }
 
-func (b *ExpBackoff) SetDuration(d time.Duration) {
-	b.duration = d
+// Attempts returns the number of waits since the last reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
 }
 
-// Wait block until either the timer is completed or canceled.
-func (b *ExpBackoff) Wait() bool {
-	backoff := b.duration
-	b.duration *= time.Duration(b.factor)
-	if b.duration > b.max {
-		b.duration = b.max
+// Elapsed returns the time spent retrying since the first wait after the last reset.
+func (b *Backoff) Elapsed() time.Duration {
+	if b.startedAt.IsZero() {
+		return 0
 	}
+	return time.Since(b.startedAt)
+}
 
-	select {
-	case <-b.cancel:
-		return false
-	case <-time.After(backoff):
-		b.last = time.Now()
-		return true
+// nextDelay returns the duration of the next wait and moves to the next attempt.
+func (b *Backoff) nextDelay() time.Duration {
+	var delay time.Duration
+	if b.hasNext {
+		delay = b.next
+		b.hasNext = false
+	} else {
+		delay = b.strategy.NextDelay(b.attempt, b.previous)
+	}
+	if b.attempt == 0 {
+		b.startedAt = time.Now()
 	}
+	b.attempt++
+	b.previous = delay
+	return delay
 }
 
-func (b *ExpBackoff) WaitAndNotify(done chan<- bool) {
-	backoff := b.duration
-	b.duration *= time.Duration(b.factor)
-	if b.duration > b.max {
-		b.duration = b.max
+// Start arms the timer with the next delay and returns its channel, for the callers
+// which wait in their own select loop (the timer is disarmed by the next Start, Wait or Stop).
+func (b *Backoff) Start() <-chan time.Time {
+	b.stopTimer()
+	b.timer.Reset(b.nextDelay())
+	return b.timer.C
+}
+
+// Wait blocks until the next delay is elapsed,
+// it returns the error of the context if it is done or ErrBackoffStopped.
+func (b *Backoff) Wait(ctx context.Context) error {
+	select {
+	case <-b.stopped:
+		return ErrBackoffStopped
+	case <-b.cancel:
+		return context.Canceled
+	default:
 	}
 
+	timer := b.Start()
 	select {
+	case <-timer:
+		return nil
+	case <-ctx.Done():
+		b.stopTimer()
+		return ctx.Err()
+	case <-b.stopped:
+		b.stopTimer()
+		return ErrBackoffStopped
 	case <-b.cancel:
-		done <- false
-	case <-time.After(backoff):
-		b.last = time.Now()
-		done <- true
+		b.stopTimer()
+		return context.Canceled
 	}
 }
 
-// NewExpBackoff returns a new exponential backoff.
-func NewExpBackoff(cancel <-chan struct{}, init, max time.Duration) *ExpBackoff {
-	return &ExpBackoff{
-		duration: init,
-		cancel:   cancel,
-		init:     init,
-		max:      max,
-		factor:   2,
+// WaitAndNotify waits like Wait and sends true on done if the delay is elapsed, false otherwise.
+//
+// Deprecated: use Wait with a context.
+func (b *Backoff) WaitAndNotify(done chan<- bool) {
+	done <- b.Wait(context.Background()) == nil
+}
+
+// Stop interrupts the current wait, the next waits return ErrBackoffStopped.
+func (b *Backoff) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopped)
+		b.timer.Stop()
+	})
+}
+
+// stopTimer stops the timer and drains its channel so that it can be reset.
+func (b *Backoff) stopTimer() {
+	if !b.timer.Stop() {
+		select {
+		case <-b.timer.C:
+		default:
+		}
+	}
+}
+
+// NewBackoff returns a new backoff using the strategy.
+func NewBackoff(strategy Strategy) *Backoff {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &Backoff{
+		strategy: strategy,
+		timer:    timer,
+		stopped:  make(chan struct{}),
 	}
 }
+
+// NewExponentialBackoff returns a new exponential backoff, the waits are canceled by their context.
+func NewExponentialBackoff(init, max time.Duration) *Backoff {
+	return NewBackoff(NewExponentialStrategy(init, max, DefaultFactor))
+}
+
+// NewExpBackoff returns a new exponential backoff, the waits are canceled once cancel is closed.
+//
+// Deprecated: use NewExponentialBackoff and give the context to Wait.
+func NewExpBackoff(cancel <-chan struct{}, init, max time.Duration) *ExpBackoff {
+	b := NewExponentialBackoff(init, max)
+	b.cancel = cancel
+	return b
+}
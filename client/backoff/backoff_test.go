@@ -0,0 +1,108 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		setup    func(b *Backoff, cancel context.CancelFunc)
+		expected error
+	}{
+		{name: "elapsed", delay: time.Millisecond, setup: func(b *Backoff, cancel context.CancelFunc) {}},
+		{name: "context canceled", delay: time.Hour, setup: func(b *Backoff, cancel context.CancelFunc) {
+			time.AfterFunc(10*time.Millisecond, cancel)
+		}, expected: context.Canceled},
+		{name: "stopped", delay: time.Hour, setup: func(b *Backoff, cancel context.CancelFunc) {
+			time.AfterFunc(10*time.Millisecond, b.Stop)
+		}, expected: ErrBackoffStopped},
+		{name: "already stopped", delay: time.Millisecond, setup: func(b *Backoff, cancel context.CancelFunc) {
+			b.Stop()
+		}, expected: ErrBackoffStopped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			b := NewBackoff(NewConstantStrategy(tt.delay))
+			tt.setup(b, cancel)
+			if err := b.Wait(ctx); !errors.Is(err, tt.expected) {
+				t.Errorf("Wait() = %v, want %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpBackoffWaitAndNotify(t *testing.T) {
+	// the deprecated api: the waits are canceled by the channel given to the constructor
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		canceled bool
+		expected bool
+	}{
+		{name: "elapsed", delay: time.Millisecond, expected: true},
+		{name: "canceled", delay: time.Hour, canceled: true, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancel := make(chan struct{})
+			if tt.canceled {
+				close(cancel)
+			}
+			b := NewExpBackoff(cancel, tt.delay, tt.delay)
+			done := make(chan bool, 1)
+			b.WaitAndNotify(done)
+			if result := <-done; result != tt.expected {
+				t.Errorf("WaitAndNotify() = %v, want %v", result, tt.expected)
+			}
+			if err := b.Wait(context.Background()); tt.canceled && !errors.Is(err, context.Canceled) {
+				t.Errorf("Wait() = %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestBackoffAttempts(t *testing.T) {
+	ctx := context.Background()
+	b := NewExponentialBackoff(time.Millisecond, 2*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := b.Wait(ctx); err != nil {
+			t.Fatalf("Wait() = %v", err)
+		}
+	}
+	if b.Attempts() != 3 || b.Elapsed() < 5*time.Millisecond {
+		t.Errorf("Attempts() = %d, Elapsed() = %v, want 3 and at least 5ms", b.Attempts(), b.Elapsed())
+	}
+
+	// the timer is reused after a canceled wait
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Wait(canceledCtx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait() = %v, want %v", err, context.Canceled)
+	}
+	b.Reset()
+	if b.Attempts() != 0 || b.Elapsed() != 0 {
+		t.Errorf("after Reset: Attempts() = %d, Elapsed() = %v, want 0", b.Attempts(), b.Elapsed())
+	}
+	if err := b.Wait(ctx); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+}
+
+func TestBackoffWaitAllocations(t *testing.T) {
+	ctx := context.Background()
+	b := NewBackoff(NewConstantStrategy(0))
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = b.Wait(ctx)
+	})
+	if allocs > 0 {
+		t.Errorf("Wait() allocations = %v, want 0", allocs)
+	}
+}
@@ -3,6 +3,8 @@ package backoff
 import (
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -13,28 +15,77 @@ const (
 	HeaderRetryAfter    = "Retry-After"
 )
 
+// minEpochResetValue distinguishes the X-RateLimit-Reset values which are unix timestamps
+// from the ones which are a number of seconds (2001-09-09 is far beyond any reset delay).
+const minEpochResetValue = 1000000000
+
 type RateLimit struct {
-	Limit      int
-	Remaining  int
-	ResetInSec uint64
-	RetryAfter uint64
+	Limit              int
+	Remaining          int
+	HasRemaining       bool   // the X-RateLimit-Limit and X-RateLimit-Remaining headers are present
+	ResetInSec         uint64 // seconds until the quota is reset (rounded up)
+	RetryAfter         uint64 // seconds to wait before the next request (rounded up)
+	Reset              time.Duration
+	RetryAfterDuration time.Duration
 }
 
 func RateLimitFromHttpResponse(resp *http.Response) *RateLimit {
-	limit := resp.Header.Get(xRateLimitLimit)
-	remaining := resp.Header.Get(xRateLimitRemaining)
-	reset := resp.Header.Get(xRateLimitReset)
-	retryAfter := resp.Header.Get(HeaderRetryAfter)
+	return rateLimitFromHeader(resp.Header, time.Now())
+}
 
-	iLimit, _ := strconv.Atoi(limit)
-	iRemaining, _ := strconv.Atoi(remaining)
-	iResetInSec, _ := strconv.ParseUint(reset, 10, 0)
-	iRetryAfter, _ := strconv.ParseUint(retryAfter, 10, 0)
+func rateLimitFromHeader(header http.Header, now time.Time) *RateLimit {
+	limit, errLimit := strconv.Atoi(strings.TrimSpace(header.Get(xRateLimitLimit)))
+	remaining, errRemaining := strconv.Atoi(strings.TrimSpace(header.Get(xRateLimitRemaining)))
+	reset := ParseRateLimitReset(header.Get(xRateLimitReset), now)
+	retryAfter := ParseRetryAfter(header.Get(HeaderRetryAfter), now)
 
 	return &RateLimit{
-		Limit:      iLimit,
-		Remaining:  iRemaining,
-		ResetInSec: iResetInSec,
-		RetryAfter: iRetryAfter,
+		Limit:              limit,
+		Remaining:          remaining,
+		HasRemaining:       errLimit == nil && errRemaining == nil,
+		ResetInSec:         ceilSeconds(reset),
+		RetryAfter:         ceilSeconds(retryAfter),
+		Reset:              reset,
+		RetryAfterDuration: retryAfter,
+	}
+}
+
+// ParseRetryAfter parses a Retry-After header value, it is either a number of seconds
+// or an HTTP-date (RFC 7231), it returns 0 if the value is missing, invalid or in the past.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
 	}
+	return 0
+}
+
+// ParseRateLimitReset parses a X-RateLimit-Reset header value, it is either a number of seconds
+// or a unix timestamp, it returns 0 if the value is missing, invalid or in the past.
+func ParseRateLimitReset(value string, now time.Time) time.Duration {
+	seconds, err := strconv.ParseUint(strings.TrimSpace(value), 10, 63)
+	if err != nil {
+		return 0
+	}
+
+	if seconds < minEpochResetValue {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date := time.Unix(int64(seconds), 0); date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func ceilSeconds(d time.Duration) uint64 {
+	return uint64((d + time.Second - 1) / time.Second)
 }
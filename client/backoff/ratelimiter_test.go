@@ -0,0 +1,109 @@
+package backoff
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newHeader builds a header from key/value pairs (the keys are canonicalized as in a response).
+func newHeader(keyValues ...string) http.Header {
+	header := http.Header{}
+	for idx := 0; idx < len(keyValues); idx += 2 {
+		header.Set(keyValues[idx], keyValues[idx+1])
+	}
+	return header
+}
+
+func TestRateLimitFromHeader(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		header     http.Header
+		expected   RateLimit
+		retryAfter time.Duration
+	}{
+		{
+			name:     "no headers",
+			header:   newHeader(),
+			expected: RateLimit{},
+		},
+		{
+			name:     "retry after seconds",
+			header:   newHeader(HeaderRetryAfter, "120"),
+			expected: RateLimit{RetryAfter: 120, RetryAfterDuration: 2 * time.Minute},
+		},
+		{
+			name:     "retry after http date",
+			header:   newHeader(HeaderRetryAfter, now.Add(90*time.Second).Format(http.TimeFormat)),
+			expected: RateLimit{RetryAfter: 90, RetryAfterDuration: 90 * time.Second},
+		},
+		{
+			name:     "retry after past http date",
+			header:   newHeader(HeaderRetryAfter, now.Add(-time.Minute).Format(http.TimeFormat)),
+			expected: RateLimit{},
+		},
+		{
+			name:     "retry after invalid",
+			header:   newHeader(HeaderRetryAfter, "soon"),
+			expected: RateLimit{},
+		},
+		{
+			name:     "quota with reset in seconds",
+			header:   newHeader(xRateLimitLimit, "100", xRateLimitRemaining, "5", xRateLimitReset, "30"),
+			expected: RateLimit{Limit: 100, Remaining: 5, HasRemaining: true, ResetInSec: 30, Reset: 30 * time.Second},
+		},
+		{
+			name:     "quota with reset as unix timestamp",
+			header:   newHeader(xRateLimitLimit, "100", xRateLimitRemaining, "0", xRateLimitReset, strconv.FormatInt(now.Add(45*time.Second).Unix(), 10)),
+			expected: RateLimit{Limit: 100, Remaining: 0, HasRemaining: true, ResetInSec: 45, Reset: 45 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rateLimit := rateLimitFromHeader(tt.header, now); *rateLimit != tt.expected {
+				t.Errorf("rateLimitFromHeader() = %+v, want %+v", *rateLimit, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit RateLimit
+		expected  time.Duration
+	}{
+		{name: "no rate limit", rateLimit: RateLimit{}, expected: 0},
+		{name: "retry after", rateLimit: RateLimit{RetryAfterDuration: time.Minute}, expected: time.Minute},
+		{name: "quota available", rateLimit: RateLimit{Limit: 100, Remaining: 50, HasRemaining: true, Reset: time.Minute}, expected: 0},
+		{name: "quota running out", rateLimit: RateLimit{Limit: 100, Remaining: 5, HasRemaining: true, Reset: time.Minute}, expected: 10 * time.Second},
+		{name: "quota exhausted", rateLimit: RateLimit{Limit: 100, Remaining: 0, HasRemaining: true, Reset: time.Minute}, expected: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewAdaptiveLimiter(0)
+			now := time.Now()
+			limiter.update(&tt.rateLimit, now)
+			if delay := limiter.notBefore.Sub(now); delay != tt.expected {
+				t.Errorf("delay = %v, want %v", delay, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterWait(t *testing.T) {
+	limiter := NewAdaptiveLimiter(DefaultAdaptiveThreshold)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v, want %v", err, nil)
+	}
+
+	limiter.update(&RateLimit{RetryAfterDuration: time.Hour}, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,140 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// DefaultFactor is the growth factor of the exponential strategies.
+const DefaultFactor = 2.0
+
+// DefaultDecorrelatedFactor is the growth factor of the decorrelated jitter strategy.
+const DefaultDecorrelatedFactor = 3.0
+
+// Strategy computes the delays of a backoff.
+type Strategy interface {
+	// NextDelay returns the delay before the retry, attempt starts at 0
+	// and previous is the last delay waited (0 on the first attempt).
+	NextDelay(attempt int, previous time.Duration) time.Duration
+}
+
+// ConstantStrategy always waits the same delay.
+type ConstantStrategy struct {
+	Delay time.Duration
+}
+
+func (s ConstantStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	return s.Delay
+}
+
+// LinearStrategy adds Increment to the delay on each attempt.
+type LinearStrategy struct {
+	Init      time.Duration
+	Increment time.Duration
+	Max       time.Duration
+}
+
+func (s LinearStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	return capDelay(float64(s.Init)+float64(attempt)*float64(s.Increment), s.Max)
+}
+
+// ExponentialStrategy multiplies the delay by Factor on each attempt (no jitter).
+type ExponentialStrategy struct {
+	Init   time.Duration
+	Max    time.Duration
+	Factor float64
+}
+
+func (s ExponentialStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	factor := s.Factor
+	if factor < 1 {
+		factor = DefaultFactor
+	}
+	return capDelay(float64(s.Init)*math.Pow(factor, float64(attempt)), s.Max)
+}
+
+// FullJitterStrategy waits a random delay between 0 and the exponential delay.
+type FullJitterStrategy struct {
+	ExponentialStrategy
+}
+
+func (s FullJitterStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	delay := s.ExponentialStrategy.NextDelay(attempt, previous)
+	return randomDelay(0, delay)
+}
+
+// EqualJitterStrategy waits half of the exponential delay plus a random delay up to the other half.
+type EqualJitterStrategy struct {
+	ExponentialStrategy
+}
+
+func (s EqualJitterStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	delay := s.ExponentialStrategy.NextDelay(attempt, previous)
+	return randomDelay(delay/2, delay)
+}
+
+// DecorrelatedJitterStrategy waits a random delay between Init and Factor times the previous delay.
+type DecorrelatedJitterStrategy struct {
+	Init   time.Duration
+	Max    time.Duration
+	Factor float64
+}
+
+func (s DecorrelatedJitterStrategy) NextDelay(attempt int, previous time.Duration) time.Duration {
+	factor := s.Factor
+	if factor < 1 {
+		factor = DefaultDecorrelatedFactor
+	}
+	if previous < s.Init {
+		previous = s.Init
+	}
+	upper := capDelay(float64(previous)*factor, s.Max)
+	if upper < s.Init {
+		return upper
+	}
+	return randomDelay(s.Init, upper)
+}
+
+func NewConstantStrategy(delay time.Duration) ConstantStrategy {
+	return ConstantStrategy{Delay: delay}
+}
+
+func NewLinearStrategy(init, increment, max time.Duration) LinearStrategy {
+	return LinearStrategy{Init: init, Increment: increment, Max: max}
+}
+
+func NewExponentialStrategy(init, max time.Duration, factor float64) ExponentialStrategy {
+	return ExponentialStrategy{Init: init, Max: max, Factor: factor}
+}
+
+func NewFullJitterStrategy(init, max time.Duration, factor float64) FullJitterStrategy {
+	return FullJitterStrategy{ExponentialStrategy: NewExponentialStrategy(init, max, factor)}
+}
+
+func NewEqualJitterStrategy(init, max time.Duration, factor float64) EqualJitterStrategy {
+	return EqualJitterStrategy{ExponentialStrategy: NewExponentialStrategy(init, max, factor)}
+}
+
+func NewDecorrelatedJitterStrategy(init, max time.Duration, factor float64) DecorrelatedJitterStrategy {
+	return DecorrelatedJitterStrategy{Init: init, Max: max, Factor: factor}
+}
+
+// capDelay converts the delay, it is bounded by max (if not 0).
+func capDelay(delay float64, max time.Duration) time.Duration {
+	if max > 0 && delay > float64(max) {
+		return max
+	}
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// randomDelay returns a random delay in [min, max).
+func randomDelay(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
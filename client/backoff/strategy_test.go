@@ -0,0 +1,107 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		// bounds of the delays of the successive attempts
+		min []time.Duration
+		max []time.Duration
+	}{
+		{
+			name:     "constant",
+			strategy: NewConstantStrategy(time.Second),
+			min:      []time.Duration{time.Second, time.Second, time.Second},
+			max:      []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:     "linear",
+			strategy: NewLinearStrategy(time.Second, 2*time.Second, 4*time.Second),
+			min:      []time.Duration{time.Second, 3 * time.Second, 4 * time.Second},
+			max:      []time.Duration{time.Second, 3 * time.Second, 4 * time.Second},
+		},
+		{
+			name:     "exponential",
+			strategy: NewExponentialStrategy(time.Second, 10*time.Second, 3),
+			min:      []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second},
+			max:      []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "exponential default factor",
+			strategy: ExponentialStrategy{Init: time.Second, Max: 10 * time.Second},
+			min:      []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second},
+			max:      []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "full jitter",
+			strategy: NewFullJitterStrategy(time.Second, 10*time.Second, 2),
+			min:      []time.Duration{0, 0, 0, 0, 0},
+			max:      []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "equal jitter",
+			strategy: NewEqualJitterStrategy(time.Second, 10*time.Second, 2),
+			min:      []time.Duration{time.Second / 2, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second},
+			max:      []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the jitter is random, check the bounds several times
+			for i := 0; i < 100; i++ {
+				previous := time.Duration(0)
+				for attempt := range tt.min {
+					delay := tt.strategy.NextDelay(attempt, previous)
+					if delay < tt.min[attempt] || delay > tt.max[attempt] {
+						t.Fatalf("NextDelay(%d) = %v, want between %v and %v", attempt, delay, tt.min[attempt], tt.max[attempt])
+					}
+					previous = delay
+				}
+			}
+		})
+	}
+}
+
+func TestDecorrelatedJitterStrategy(t *testing.T) {
+	strategy := NewDecorrelatedJitterStrategy(time.Second, 10*time.Second, 0)
+	for i := 0; i < 100; i++ {
+		previous := time.Duration(0)
+		for attempt := 0; attempt < 10; attempt++ {
+			delay := strategy.NextDelay(attempt, previous)
+			upper := 3 * previous
+			if upper < 3*time.Second {
+				upper = 3 * time.Second
+			}
+			if upper > 10*time.Second {
+				upper = 10 * time.Second
+			}
+			if delay < time.Second || delay > upper {
+				t.Fatalf("NextDelay(%d, %v) = %v, want between %v and %v", attempt, previous, delay, time.Second, upper)
+			}
+			previous = delay
+		}
+	}
+}
+
+func TestBackoffSetDuration(t *testing.T) {
+	b := NewBackoff(NewExponentialStrategy(time.Second, time.Minute, 2))
+	b.SetDuration(5 * time.Second)
+
+	// the imposed duration is used once, then the strategy goes on
+	expected := []time.Duration{5 * time.Second, 2 * time.Second, 4 * time.Second}
+	for idx, want := range expected {
+		if delay := b.nextDelay(); delay != want {
+			t.Errorf("delay %d = %v, want %v", idx, delay, want)
+		}
+	}
+
+	b.Reset()
+	if delay := b.nextDelay(); delay != time.Second {
+		t.Errorf("delay after Reset = %v, want %v", delay, time.Second)
+	}
+}
@@ -0,0 +1,132 @@
+package backoff
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate tokens per second with bursts up to burst tokens, it is safe for concurrent use.
+// The tokens are reserved in order: a caller which takes more tokens than available
+// leaves a debt which makes the next callers wait.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// NewTokenBucket returns a token bucket, a rate <= 0 doesn't limit anything (the callers never wait).
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call, b.mu must be locked.
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n tokens and returns the time to wait until they are available.
+func (b *TokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		// unlimited
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Take takes n tokens without waiting.
+func (b *TokenBucket) Take(n int) {
+	b.reserve(n, time.Now())
+}
+
+// Wait blocks until a token is available or the context is done.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	return b.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available or the context is done (the tokens are given back),
+// with n = 0 it waits until the debt of the previous callers is paid.
+func (b *TokenBucket) WaitN(ctx context.Context, n int) error {
+	delay := b.reserve(n, time.Now())
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += float64(n)
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// RateLimiter caps the rate of the requests and of the records sent or received.
+type RateLimiter struct {
+	Requests *TokenBucket // nil if the requests are not limited
+	Records  *TokenBucket // nil if the records are not limited
+}
+
+// NewRateLimiter returns a rate limiter, a rate of 0 disables the limit.
+func NewRateLimiter(requestsPerSecond float64, requestsBurst int, recordsPerSecond float64, recordsBurst int) *RateLimiter {
+	l := RateLimiter{}
+	if requestsPerSecond > 0 {
+		l.Requests = NewTokenBucket(requestsPerSecond, requestsBurst)
+	}
+	if recordsPerSecond > 0 {
+		l.Records = NewTokenBucket(recordsPerSecond, recordsBurst)
+	}
+	return &l
+}
+
+// WaitRequest blocks until a request is allowed (the records received previously are taken into account).
+func (l *RateLimiter) WaitRequest(ctx context.Context) error {
+	if l.Records != nil {
+		if err := l.Records.WaitN(ctx, 0); err != nil {
+			return err
+		}
+	}
+	if l.Requests != nil {
+		return l.Requests.Wait(ctx)
+	}
+	return nil
+}
+
+// WaitRecords blocks until n records can be sent.
+func (l *RateLimiter) WaitRecords(ctx context.Context, n int) error {
+	if l.Records == nil || n <= 0 {
+		return nil
+	}
+	return l.Records.WaitN(ctx, n)
+}
+
+// AddRecords counts n records received, the next request waits if the records rate is exceeded.
+func (l *RateLimiter) AddRecords(n int) {
+	if l.Records != nil && n > 0 {
+		l.Records.Take(n)
+	}
+}
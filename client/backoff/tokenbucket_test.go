@@ -0,0 +1,88 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		takes    []int
+		minDelay time.Duration
+		maxDelay time.Duration
+	}{
+		{name: "within burst", rate: 10, burst: 5, takes: []int{1, 1, 1, 1, 1}, maxDelay: 50 * time.Millisecond},
+		{name: "over burst", rate: 100, burst: 2, takes: []int{1, 1, 1, 1, 1, 1}, minDelay: 30 * time.Millisecond, maxDelay: time.Second},
+		{name: "more tokens than the burst", rate: 100, burst: 1, takes: []int{6}, minDelay: 40 * time.Millisecond, maxDelay: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := NewTokenBucket(tt.rate, tt.burst)
+			startTime := time.Now()
+			for _, n := range tt.takes {
+				if err := bucket.WaitN(context.Background(), n); err != nil {
+					t.Fatalf("WaitN(%d) = %v", n, err)
+				}
+			}
+			if elapsed := time.Since(startTime); elapsed < tt.minDelay || elapsed > tt.maxDelay {
+				t.Errorf("elapsed = %v, want between %v and %v", elapsed, tt.minDelay, tt.maxDelay)
+			}
+		})
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	// a rate <= 0 doesn't limit anything
+	for _, rate := range []float64{0, -1} {
+		bucket := NewTokenBucket(rate, 1)
+		now := time.Now()
+		for _, n := range []int{1, 5, 10} {
+			now = now.Add(time.Second)
+			if delay := bucket.reserve(n, now); delay != 0 {
+				t.Errorf("rate %v: reserve(%d) = %v, want %v", rate, n, delay, time.Duration(0))
+			}
+		}
+	}
+}
+
+func TestTokenBucketWaitCanceled(t *testing.T) {
+	bucket := NewTokenBucket(1, 1)
+	if err := bucket.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := bucket.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the token of the canceled wait is given back
+	bucket.mu.Lock()
+	tokens := bucket.tokens
+	bucket.mu.Unlock()
+	if tokens < 0 || tokens > 1 {
+		t.Errorf("tokens = %v, want between 0 and 1", tokens)
+	}
+}
+
+func TestRateLimiterRecords(t *testing.T) {
+	limiter := NewRateLimiter(0, 0, 100, 10)
+	if limiter.Requests != nil {
+		t.Fatalf("Requests = %v, want no limit", limiter.Requests)
+	}
+
+	// the records received leave a debt which delays the next request
+	limiter.AddRecords(15)
+	startTime := time.Now()
+	if err := limiter.WaitRequest(context.Background()); err != nil {
+		t.Fatalf("WaitRequest() = %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed < 40*time.Millisecond {
+		t.Errorf("elapsed = %v, want at least %v", elapsed, 40*time.Millisecond)
+	}
+}
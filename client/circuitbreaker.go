@@ -0,0 +1,292 @@
+package ministreamclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+type CircuitBreakerSettings struct {
+	WindowSize           int           // number of the last calls of an endpoint used to compute the failure rate
+	MinCalls             int           // the circuit can't open before this number of calls in the window
+	FailureRateThreshold float64       // failure rate which opens the circuit (0 to 1)
+	OpenTimeout          time.Duration // duration of the open state before the circuit is probed
+	HalfOpenMaxCalls     int           // number of concurrent probe calls in the half-open state
+}
+
+func DefaultCircuitBreakerSettings() CircuitBreakerSettings {
+	return CircuitBreakerSettings{
+		WindowSize:           20,
+		MinCalls:             5,
+		FailureRateThreshold: 0.5,
+		OpenTimeout:          30 * time.Second,
+		HalfOpenMaxCalls:     1,
+	}
+}
+
+// CircuitBreaker fails fast the calls of an endpoint while the server is failing, it is safe for concurrent use.
+// The client uses a circuit per endpoint (the url of a server) shared by all the apis of the server.
+// The circuit of an endpoint opens when the failure rate of its last calls exceeds the threshold,
+// after OpenTimeout a few probe calls are allowed (half-open), the circuit closes if they succeed.
+type CircuitBreaker struct {
+	settings   CircuitBreakerSettings
+	endpoints  map[string]*endpointCircuit
+	listeners  map[int]func(change CircuitBreakerStateChange)
+	listenerId int
+	mu         sync.Mutex
+}
+
+// endpointCircuit is the circuit of an endpoint, the mutex of the breaker must be locked.
+type endpointCircuit struct {
+	state         CircuitBreakerState
+	results       []bool // ring buffer of the last calls (true on failure)
+	next          int
+	cptCalls      int
+	cptFailures   int
+	openedAt      time.Time
+	halfOpenCalls int
+}
+
+func NewCircuitBreaker(settings CircuitBreakerSettings) *CircuitBreaker {
+	defaults := DefaultCircuitBreakerSettings()
+	if settings.WindowSize < 1 {
+		settings.WindowSize = defaults.WindowSize
+	}
+	if settings.MinCalls < 1 || settings.MinCalls > settings.WindowSize {
+		settings.MinCalls = settings.WindowSize
+	}
+	if settings.FailureRateThreshold <= 0 || settings.FailureRateThreshold > 1 {
+		settings.FailureRateThreshold = defaults.FailureRateThreshold
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = defaults.OpenTimeout
+	}
+	if settings.HalfOpenMaxCalls < 1 {
+		settings.HalfOpenMaxCalls = defaults.HalfOpenMaxCalls
+	}
+	return &CircuitBreaker{
+		settings:  settings,
+		endpoints: make(map[string]*endpointCircuit),
+		listeners: make(map[int]func(change CircuitBreakerStateChange)),
+	}
+}
+
+// Subscribe adds a listener of the state changes, it is called by the goroutine making the call
+// which changes the state, until the returned function is called.
+func (b *CircuitBreaker) Subscribe(listener func(change CircuitBreakerStateChange)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listenerId++
+	id := b.listenerId
+	b.listeners[id] = listener
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.listeners, id)
+	}
+}
+
+// State returns the state of the circuit of the endpoint.
+func (b *CircuitBreaker) State(endpoint string) CircuitBreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if circuit, found := b.endpoints[endpoint]; found {
+		if circuit.state == CircuitBreakerStateOpen && time.Since(circuit.openedAt) >= b.settings.OpenTimeout {
+			return CircuitBreakerStateHalfOpen
+		}
+		return circuit.state
+	}
+	return CircuitBreakerStateClosed
+}
+
+// Allow returns an error with the code ErrorCircuitBreakerOpen if the call must fail fast,
+// otherwise the result of the call must be given to Done.
+func (b *CircuitBreaker) Allow(endpoint string) *APIError {
+	b.mu.Lock()
+	circuit := b.getCircuit(endpoint)
+	var change *CircuitBreakerStateChange
+	if circuit.state == CircuitBreakerStateOpen && time.Since(circuit.openedAt) >= b.settings.OpenTimeout {
+		change = b.setState(endpoint, circuit, CircuitBreakerStateHalfOpen)
+	}
+
+	var apiError *APIError
+	switch circuit.state {
+	case CircuitBreakerStateOpen:
+		apiError = &APIError{Message: "circuit breaker open", Details: endpoint, Code: ErrorCircuitBreakerOpen}
+	case CircuitBreakerStateHalfOpen:
+		if circuit.halfOpenCalls >= b.settings.HalfOpenMaxCalls {
+			apiError = &APIError{Message: "circuit breaker half-open", Details: endpoint, Code: ErrorCircuitBreakerOpen}
+		} else {
+			circuit.halfOpenCalls++
+		}
+	}
+	listeners := b.getListeners(change)
+	b.mu.Unlock()
+
+	notify(listeners, change)
+	return apiError
+}
+
+// Done records the result of a call allowed by Allow.
+func (b *CircuitBreaker) Done(endpoint string, failed bool) {
+	b.mu.Lock()
+	circuit := b.getCircuit(endpoint)
+	var change *CircuitBreakerStateChange
+	switch circuit.state {
+	case CircuitBreakerStateHalfOpen:
+		if circuit.halfOpenCalls > 0 {
+			circuit.halfOpenCalls--
+		}
+		if failed {
+			change = b.setState(endpoint, circuit, CircuitBreakerStateOpen)
+		} else {
+			change = b.setState(endpoint, circuit, CircuitBreakerStateClosed)
+		}
+	case CircuitBreakerStateClosed:
+		circuit.add(failed)
+		if circuit.cptCalls >= b.settings.MinCalls && circuit.failureRate() >= b.settings.FailureRateThreshold {
+			change = b.setState(endpoint, circuit, CircuitBreakerStateOpen)
+		}
+	}
+	listeners := b.getListeners(change)
+	b.mu.Unlock()
+
+	notify(listeners, change)
+}
+
+func (b *CircuitBreaker) getCircuit(endpoint string) *endpointCircuit {
+	circuit, found := b.endpoints[endpoint]
+	if !found {
+		circuit = &endpointCircuit{state: CircuitBreakerStateClosed, results: make([]bool, b.settings.WindowSize)}
+		b.endpoints[endpoint] = circuit
+	}
+	return circuit
+}
+
+func (b *CircuitBreaker) setState(endpoint string, circuit *endpointCircuit, state CircuitBreakerState) *CircuitBreakerStateChange {
+	change := CircuitBreakerStateChange{Endpoint: endpoint, From: circuit.state, To: state, FailureRate: circuit.failureRate(), Date: time.Now()}
+	circuit.state = state
+	switch state {
+	case CircuitBreakerStateOpen:
+		circuit.openedAt = change.Date
+	case CircuitBreakerStateClosed:
+		circuit.reset()
+	}
+	return &change
+}
+
+func (b *CircuitBreaker) getListeners(change *CircuitBreakerStateChange) []func(change CircuitBreakerStateChange) {
+	if change == nil {
+		return nil
+	}
+	listeners := make([]func(change CircuitBreakerStateChange), 0, len(b.listeners))
+	for _, listener := range b.listeners {
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+func notify(listeners []func(change CircuitBreakerStateChange), change *CircuitBreakerStateChange) {
+	for _, listener := range listeners {
+		listener(*change)
+	}
+}
+
+func (c *endpointCircuit) add(failed bool) {
+	if c.cptCalls == len(c.results) {
+		// the oldest result leaves the window
+		if c.results[c.next] {
+			c.cptFailures--
+		}
+	} else {
+		c.cptCalls++
+	}
+	c.results[c.next] = failed
+	if failed {
+		c.cptFailures++
+	}
+	c.next = (c.next + 1) % len(c.results)
+}
+
+func (c *endpointCircuit) failureRate() float64 {
+	if c.cptCalls == 0 {
+		return 0
+	}
+	return float64(c.cptFailures) / float64(c.cptCalls)
+}
+
+func (c *endpointCircuit) reset() {
+	c.next = 0
+	c.cptCalls = 0
+	c.cptFailures = 0
+	c.halfOpenCalls = 0
+}
+
+// isServerFailure returns true if the call has failed because of the server (transport error or 5xx),
+// the client errors (4xx) and the canceled calls don't count.
+func isServerFailure(ctx context.Context, resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if ctx.Err() != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	if resp != nil {
+		return resp.StatusCode >= 500
+	}
+	return true
+}
+
+// SetCircuitBreaker fails fast the calls of the failing endpoints (nil to disable),
+// it must be set before the client is used.
+func (c *MinistreamClient) SetCircuitBreaker(breaker *CircuitBreaker) {
+	c.breaker = breaker
+}
+
+func (c *MinistreamClient) SubscribeCircuitBreaker(listener func(change CircuitBreakerStateChange)) (unsubscribe func()) {
+	if c.breaker == nil {
+		return func() {}
+	}
+	return c.breaker.Subscribe(listener)
+}
+
+// waitRateLimiter blocks until the rate limiter allows a request sending cptRecords records,
+// it is called once per call of the api whatever the number of endpoints tried.
+func (c *MinistreamClient) waitRateLimiter(ctx context.Context, cptRecords int) *APIError {
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.WaitRequest(ctx); err != nil {
+			return APIErrorFromError(err)
+		}
+		if err := c.rateLimiter.WaitRecords(ctx, cptRecords); err != nil {
+			return APIErrorFromError(err)
+		}
+	}
+	return nil
+}
+
+// beforeCall fails fast if the circuit of the endpoint is open.
+func (c *MinistreamClient) beforeCall(endpoint string) *APIError {
+	if c.breaker != nil {
+		return c.breaker.Allow(endpoint)
+	}
+	return nil
+}
+
+// afterCall gives the result of a call allowed by beforeCall to the circuit breaker.
+func (c *MinistreamClient) afterCall(ctx context.Context, endpoint string, resp *http.Response, apiError *APIError) {
+	if c.breaker == nil {
+		return
+	}
+
+	var err error
+	if apiError != nil {
+		err = apiError
+	}
+	c.breaker.Done(endpoint, isServerFailure(ctx, resp, err))
+}
@@ -0,0 +1,133 @@
+package ministreamclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerSettings{WindowSize: 4, MinCalls: 4, FailureRateThreshold: 0.5, OpenTimeout: 20 * time.Millisecond})
+	states := make([]CircuitBreakerState, 0)
+	unsubscribe := breaker.Subscribe(func(change CircuitBreakerStateChange) {
+		states = append(states, change.To)
+	})
+	defer unsubscribe()
+
+	call := func(failed bool) *APIError {
+		t.Helper()
+		if apiError := breaker.Allow("GetRecords"); apiError != nil {
+			return apiError
+		}
+		breaker.Done("GetRecords", failed)
+		return nil
+	}
+
+	// 1 failure out of 4 calls
+	for _, failed := range []bool{false, true, false, false} {
+		if apiError := call(failed); apiError != nil {
+			t.Fatalf("call() = %v, want %v", apiError, nil)
+		}
+	}
+	// 2 failures out of the 4 last calls
+	call(true)
+	if state := breaker.State("GetRecords"); state != CircuitBreakerStateOpen {
+		t.Fatalf("State() = %v, want %v", state, CircuitBreakerStateOpen)
+	}
+	if apiError := call(false); apiError == nil || apiError.Code != ErrorCircuitBreakerOpen {
+		t.Fatalf("call() = %v, want code %d", apiError, ErrorCircuitBreakerOpen)
+	}
+	// the other endpoints are not affected
+	if state := breaker.State("PutRecords"); state != CircuitBreakerStateClosed {
+		t.Errorf("State(PutRecords) = %v, want %v", state, CircuitBreakerStateClosed)
+	}
+
+	// the probe fails, then succeeds
+	time.Sleep(30 * time.Millisecond)
+	if apiError := call(true); apiError != nil {
+		t.Fatalf("probe call() = %v, want %v", apiError, nil)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if apiError := call(false); apiError != nil {
+		t.Fatalf("probe call() = %v, want %v", apiError, nil)
+	}
+
+	expected := []CircuitBreakerState{
+		CircuitBreakerStateOpen,
+		CircuitBreakerStateHalfOpen, CircuitBreakerStateOpen,
+		CircuitBreakerStateHalfOpen, CircuitBreakerStateClosed,
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("states = %v, want %v", states, expected)
+	}
+}
+
+func TestCircuitBreakerHalfOpenMaxCalls(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerSettings{WindowSize: 1, FailureRateThreshold: 1, OpenTimeout: time.Millisecond, HalfOpenMaxCalls: 1})
+	if apiError := breaker.Allow("PutRecords"); apiError != nil {
+		t.Fatalf("Allow() = %v", apiError)
+	}
+	breaker.Done("PutRecords", true)
+	time.Sleep(5 * time.Millisecond)
+
+	// a single probe at a time
+	if apiError := breaker.Allow("PutRecords"); apiError != nil {
+		t.Fatalf("Allow() = %v, want the probe call", apiError)
+	}
+	if apiError := breaker.Allow("PutRecords"); apiError == nil || apiError.Code != ErrorCircuitBreakerOpen {
+		t.Fatalf("Allow() = %v, want code %d", apiError, ErrorCircuitBreakerOpen)
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var cptRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cptRequests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := CreateClient(server.URL, "test", nil, false, time.Second, nil)
+	client.SetCircuitBreaker(NewCircuitBreaker(CircuitBreakerSettings{WindowSize: 3, FailureRateThreshold: 1, OpenTimeout: time.Minute}))
+	var changes []CircuitBreakerStateChange
+	var mu sync.Mutex
+	defer client.SubscribeCircuitBreaker(func(change CircuitBreakerStateChange) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, change)
+	})()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, _, apiError := client.GetRecords(ctx, uuid.New(), uuid.New(), 10)
+		if apiError == nil {
+			t.Fatalf("GetRecords() error = %v, want an error", apiError)
+		}
+		if expected := i >= 3; (apiError.Code == ErrorCircuitBreakerOpen) != expected {
+			t.Errorf("GetRecords() %d error = %v, circuit open %v", i, apiError, expected)
+		}
+	}
+
+	// the circuit is per server: the other apis fail fast too
+	if _, _, apiError := client.PutRecords(ctx, uuid.New(), 0, []interface{}{"hello"}); apiError == nil || apiError.Code != ErrorCircuitBreakerOpen {
+		t.Errorf("PutRecords() error = %v, want code %d", apiError, ErrorCircuitBreakerOpen)
+	}
+
+	// the calls fail fast while the circuit is open
+	if cpt := cptRequests.Load(); cpt != 3 {
+		t.Errorf("requests = %d, want %d", cpt, 3)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != 1 || changes[0].Endpoint != server.URL || changes[0].To != CircuitBreakerStateOpen {
+		t.Errorf("changes = %+v, want the circuit of %s opened", changes, server.URL)
+	}
+}
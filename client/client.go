@@ -10,8 +10,10 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/nbigot/ministream-client-go/client/backoff"
 	. "github.com/nbigot/ministream-client-go/client/types"
 
 	"github.com/google/uuid"
@@ -27,44 +29,63 @@ type JWT struct {
 }
 
 type MinistreamClientAuth struct {
+	// the token is shared by the streams consumed or produced with the same client
 	enabled bool
 	creds   *Credentials
 	jwt     *JWT
+	mu      sync.RWMutex
 }
 
-type MinistreamClient struct {
-	// implements interface IProducerClient
-	url       string
-	userAgent string
-	auth      MinistreamClientAuth
-	client    http.Client
-	logger    *log.Logger
+// bearer returns the value of the Authorization header, empty if the authentication is disabled or not done yet.
+func (a *MinistreamClientAuth) bearer() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.enabled || a.creds == nil || a.jwt == nil {
+		return ""
+	}
+	return "Bearer " + a.jwt.Token
 }
 
-type RecordsIteratorParams struct {
-	Name               *string      `json:"name,omitempty"`
-	IteratorType       IteratorType `json:"iteratorType"`
-	JqFilter           *string      `json:"jqFilter,omitempty"`
-	MessageId          *MessageId   `json:"messageId,omitempty"`
-	Timestamp          *time.Time   `json:"timestamp,omitempty"`
-	MaxWaitTimeSeconds *int         `json:"maxWaitTimeSeconds,omitempty"` // long pooling (set 0 to disable)
+type MinistreamClient struct {
+	// implements interface IProducerClient and IConsumerClient
+	endpoints   *endpointPool
+	userAgent   string
+	auth        MinistreamClientAuth
+	client      http.Client
+	logger      *log.Logger
+	rateLimiter *backoff.RateLimiter // optional, caps the rate of the requests and records
+	breaker     *CircuitBreaker      // optional, fails fast the calls of the failing endpoints
 }
 
 func CreateClient(url string, userAgent string, creds *Credentials, insecureSkipVerifyTLS bool, timeout time.Duration, logger *log.Logger) *MinistreamClient {
-	var tr *http.Transport = nil
+	return CreateClientWithEndpoints([]string{url}, EndpointSelectionPrimary, userAgent, creds, insecureSkipVerifyTLS, timeout, logger)
+}
+
+// CreateClientWithEndpoints returns a client of several servers of the same cluster,
+// the calls fail over to the next endpoint when a server can't be reached.
+func CreateClientWithEndpoints(urls []string, selection EndpointSelection, userAgent string, creds *Credentials, insecureSkipVerifyTLS bool, timeout time.Duration, logger *log.Logger) *MinistreamClient {
+	// a nil *http.Transport must not be stored in the RoundTripper interface (the default transport is used)
+	httpClient := http.Client{Timeout: timeout}
 	if insecureSkipVerifyTLS {
-		tr = &http.Transport{
+		httpClient.Transport = &http.Transport{
 			TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecureSkipVerifyTLS},
 			MaxIdleConnsPerHost: 10,
 		}
 	}
 
-	auth := MinistreamClientAuth{enabled: false, creds: creds, jwt: nil}
+	c := &MinistreamClient{endpoints: newEndpointPool(urls, selection), userAgent: userAgent, client: httpClient, logger: logger}
+	c.auth.creds = creds
 	if creds != nil && len(creds.Login) > 0 {
-		auth.enabled = true
+		c.auth.enabled = true
 	}
+	return c
+}
 
-	return &MinistreamClient{url: url, userAgent: userAgent, auth: auth, client: http.Client{Transport: tr, Timeout: timeout}, logger: logger}
+// SetRateLimiter caps the rate of the requests and records of the client (nil to disable),
+// it must be set before the client is used.
+func (c *MinistreamClient) SetRateLimiter(l *backoff.RateLimiter) {
+	c.rateLimiter = l
 }
 
 func (c *MinistreamClient) Reconnect() *APIError {
@@ -76,13 +97,17 @@ func (c *MinistreamClient) Disconnect() {
 }
 
 func (c *MinistreamClient) Authenticate(ctx context.Context) *APIError {
-	if !c.auth.enabled || c.auth.creds == nil {
+	c.auth.mu.RLock()
+	enabled := c.auth.enabled && c.auth.creds != nil
+	c.auth.mu.RUnlock()
+	if !enabled {
+		c.auth.mu.Lock()
 		c.auth.jwt = nil
+		c.auth.mu.Unlock()
 		return nil
 	}
 
 	method := "GET"
-	url := fmt.Sprintf("%s/api/v1/user/login", c.url)
 	headers := make(map[string]string)
 	headers["Accept"] = "application/json"
 	headers["Connection"] = "keep-alive"
@@ -90,11 +115,16 @@ func (c *MinistreamClient) Authenticate(ctx context.Context) *APIError {
 	headers["ACCESS-KEY-ID"] = c.auth.creds.Login
 	headers["SECRET-ACCESS-KEY"] = c.auth.creds.Password
 	result := LoginUserResponse{}
-	_, err := CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	_, err, _ := c.callWithFailover(ctx, 0, func(baseUrl string) (*http.Response, *APIError) {
+		url := fmt.Sprintf("%s/api/v1/user/login", baseUrl)
+		return CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	})
 	if err != nil {
 		if err.Code == ErrorJWTNotEnabled {
 			// authentication is disabled on server side
+			c.auth.mu.Lock()
 			c.auth.enabled = false
+			c.auth.mu.Unlock()
 			return nil
 		} else {
 			return err
@@ -105,7 +135,9 @@ func (c *MinistreamClient) Authenticate(ctx context.Context) *APIError {
 		return &APIError{Message: ErrorUnexpected, Details: result.Status}
 	}
 
+	c.auth.mu.Lock()
 	c.auth.jwt = &JWT{Token: result.JWT}
+	c.auth.mu.Unlock()
 	return nil
 }
 
@@ -118,18 +150,19 @@ func (c *MinistreamClient) CreateRecordsIterator(ctx context.Context, streamUUID
 	}
 	bodyRequest := string(bytesRequest)
 	method := "POST"
-	url := fmt.Sprintf("%s/api/v1/stream/%s/iterator", c.url, streamUUID)
 	headers := make(map[string]string)
 	headers["Content-Type"] = "application/json"
 	headers["Accept"] = "application/json"
 	headers["Connection"] = "keep-alive"
 	headers["User-Agent"] = c.userAgent
-	if c.auth.enabled && c.auth.creds != nil {
-		headers["Authorization"] = "Bearer " + c.auth.jwt.Token
+	if bearer := c.auth.bearer(); bearer != "" {
+		headers["Authorization"] = bearer
 	}
 	result := CreateRecordsIteratorResponse{}
-
-	_, err := CallWebAPI(ctx, &c.client, method, url, strings.NewReader(bodyRequest), &headers, 200, &result, c.logger)
+	_, err, e := c.callWithFailover(ctx, 0, func(baseUrl string) (*http.Response, *APIError) {
+		url := fmt.Sprintf("%s/api/v1/stream/%s/iterator", baseUrl, streamUUID)
+		return CallWebAPI(ctx, &c.client, method, url, strings.NewReader(bodyRequest), &headers, 200, &result, c.logger)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -138,30 +171,38 @@ func (c *MinistreamClient) CreateRecordsIterator(ctx context.Context, streamUUID
 		return nil, &APIError{Message: ErrorUnexpected, Details: result.Status}
 	}
 
+	// the next calls of the iterator go to the same server
+	c.endpoints.setIteratorEndpoint(result.StreamIteratorUUID, e)
 	return &result, nil
 }
 
 func (c *MinistreamClient) GetRecords(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError) {
 	method := "GET"
-	var url string
-	if maxPullRecords > 0 {
-		url = fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s/records?maxRecords=%d", c.url, streamUUID, streamIteratorUUID, maxPullRecords)
-	} else {
-		url = fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s/records", c.url, streamUUID, streamIteratorUUID)
-	}
 	headers := make(map[string]string)
 	headers["Content-Type"] = "application/json"
 	headers["Accept"] = "application/json"
 	headers["Connection"] = "keep-alive"
 	headers["User-Agent"] = c.userAgent
-	if c.auth.enabled && c.auth.creds != nil {
-		headers["Authorization"] = "Bearer " + c.auth.jwt.Token
+	if bearer := c.auth.bearer(); bearer != "" {
+		headers["Authorization"] = bearer
 	}
 	result := GetStreamRecordsResponse{}
-	resp, err := CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	resp, err := c.callIterator(ctx, streamIteratorUUID, func(baseUrl string) (*http.Response, *APIError) {
+		var url string
+		if maxPullRecords > 0 {
+			url = fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s/records?maxRecords=%d", baseUrl, streamUUID, streamIteratorUUID, maxPullRecords)
+		} else {
+			url = fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s/records", baseUrl, streamUUID, streamIteratorUUID)
+		}
+		return CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	})
 	if err != nil {
 		return nil, resp, err
 	}
+	if c.rateLimiter != nil {
+		// the records received slow down the next requests
+		c.rateLimiter.AddRecords(len(result.Records))
+	}
 
 	if result.Status != StatusSuccess {
 		return nil, resp, &APIError{Message: ErrorUnexpected, Details: result.Status}
@@ -172,13 +213,12 @@ func (c *MinistreamClient) GetRecords(ctx context.Context, streamUUID uuid.UUID,
 
 func (c *MinistreamClient) CloseRecordsIterator(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID) *APIError {
 	method := "DELETE"
-	url := fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s", c.url, streamUUID, streamIteratorUUID)
 	headers := make(map[string]string)
 	headers["Accept"] = "application/json"
 	headers["Connection"] = "keep-alive"
 	headers["User-Agent"] = c.userAgent
-	if c.auth.enabled && c.auth.creds != nil {
-		headers["Authorization"] = "Bearer " + c.auth.jwt.Token
+	if bearer := c.auth.bearer(); bearer != "" {
+		headers["Authorization"] = bearer
 	}
 	result := CloseRecordsIteratorResponse{}
 
@@ -189,7 +229,11 @@ func (c *MinistreamClient) CloseRecordsIterator(ctx context.Context, streamUUID
 	// traceCtx := httptrace.WithClientTrace(ctx, clientTrace)
 	// _, err := CallWebAPI(traceCtx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
 
-	_, err := CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	_, err := c.callIterator(ctx, streamIteratorUUID, func(baseUrl string) (*http.Response, *APIError) {
+		url := fmt.Sprintf("%s/api/v1/stream/%s/iterator/%s", baseUrl, streamUUID, streamIteratorUUID)
+		return CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	})
+	c.endpoints.forgetIterator(streamIteratorUUID)
 	if err != nil {
 		return err
 	}
@@ -203,22 +247,24 @@ func (c *MinistreamClient) CloseRecordsIterator(ctx context.Context, streamUUID
 
 func (c *MinistreamClient) PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*PutRecordsResponse, *http.Response, *APIError) {
 	method := "PUT"
-	url := fmt.Sprintf("%s/api/v1/stream/%s/records", c.url, streamUUID)
 	headers := make(map[string]string)
 	headers["Content-Type"] = "application/json"
 	headers["Accept"] = "application/json"
 	headers["Connection"] = "keep-alive"
 	headers["User-Agent"] = c.userAgent
 	headers["x-ministream-batch-id"] = fmt.Sprintf("%d", batchId)
-	if c.auth.enabled && c.auth.creds != nil {
-		headers["Authorization"] = "Bearer " + c.auth.jwt.Token
+	if bearer := c.auth.bearer(); bearer != "" {
+		headers["Authorization"] = bearer
 	}
 	jsonBody, err := json.Marshal(records)
 	if err != nil {
 		return nil, nil, &APIError{Message: "Can't serialize records into json"}
 	}
 	result := PutRecordsResponse{}
-	resp, apiError := CallWebAPI(ctx, &c.client, method, url, bytes.NewReader(jsonBody), &headers, 202, &result, c.logger)
+	resp, apiError, _ := c.callWithFailover(ctx, len(records), func(baseUrl string) (*http.Response, *APIError) {
+		url := fmt.Sprintf("%s/api/v1/stream/%s/records", baseUrl, streamUUID)
+		return CallWebAPI(ctx, &c.client, method, url, bytes.NewReader(jsonBody), &headers, 202, &result, c.logger)
+	})
 	if apiError != nil {
 		return nil, resp, apiError
 	}
@@ -292,31 +338,3 @@ func CallWebAPI[T any](
 
 	return resp, nil
 }
-
-func (p *RecordsIteratorParams) Validate() *APIError {
-	if p.IteratorType == IteratorTypeAtTimestamp && p.Timestamp.IsZero() {
-		return &APIError{Message: "Timestamp must be set"}
-	}
-
-	// if p.IteratorType not in
-	// switch p.IteratorType {
-	// case IT_FIRST_MESSAGE:
-	// 	return nil
-	// case IT_LAST_MESSAGE:
-	// 	return nil
-	// case IT_AFTER_LAST_MESSAGE:
-	// 	return nil
-	// case IT_AT_MESSAGE_ID:
-	// 	return nil
-	// case IT_AFTER_MESSAGE_ID:
-	// 	return nil
-	// case IteratorTypeAtTimestamp:
-	// 	if p.Timestamp.IsZero() {
-	// 		return &APIError{Message: "Timestamp must be set"}
-	// 	}
-	// default:
-	// 	return &APIError{Message: "invalid IteratorType"}
-	// }
-
-	return nil
-}
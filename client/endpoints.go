@@ -0,0 +1,254 @@
+package ministreamclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+type EndpointSelection int
+
+// Enum values for EndpointSelection
+const (
+	// the first healthy endpoint of the list is used, the next ones are the secondary endpoints
+	EndpointSelectionPrimary EndpointSelection = 0
+	// the healthy endpoints are used in turn
+	EndpointSelectionRoundRobin EndpointSelection = 1
+)
+
+// EndpointStatus is the health of a server endpoint.
+type EndpointStatus struct {
+	Url       string
+	Healthy   bool
+	LastCheck time.Time
+	LastError string
+}
+
+type endpoint struct {
+	url       string
+	healthy   bool
+	lastCheck time.Time
+	lastError string
+}
+
+// endpointPool selects the server endpoints and remembers the endpoint of each iterator
+// (an iterator only exists on the server which has created it), it is safe for concurrent use.
+type endpointPool struct {
+	endpoints []*endpoint
+	selection EndpointSelection
+	next      int
+	iterators map[uuid.UUID]*endpoint
+	mu        sync.Mutex
+}
+
+func newEndpointPool(urls []string, selection EndpointSelection) *endpointPool {
+	pool := endpointPool{selection: selection, iterators: make(map[uuid.UUID]*endpoint)}
+	for _, url := range urls {
+		pool.endpoints = append(pool.endpoints, &endpoint{url: url, healthy: true})
+	}
+	return &pool
+}
+
+// candidates returns the endpoints to try in order: the healthy ones first (according to the selection)
+// then the unhealthy ones as a last resort, the round robin moves to the next endpoint.
+func (p *endpointPool) candidates() []*endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := p.ordered()
+	if p.selection == EndpointSelectionRoundRobin {
+		p.next++
+	}
+	return candidates
+}
+
+// current returns the endpoint of the calls which don't fail over, the round robin is left unchanged.
+func (p *endpointPool) current() *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ordered()[0]
+}
+
+// ordered returns the endpoints in the order of the selection, the mutex must be locked.
+func (p *endpointPool) ordered() []*endpoint {
+	start := 0
+	if p.selection == EndpointSelectionRoundRobin && len(p.endpoints) > 0 {
+		start = p.next % len(p.endpoints)
+	}
+
+	healthy := make([]*endpoint, 0, len(p.endpoints))
+	unhealthy := make([]*endpoint, 0)
+	for idx := range p.endpoints {
+		e := p.endpoints[(start+idx)%len(p.endpoints)]
+		if e.healthy {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *endpointPool) isMultiple() bool {
+	return len(p.endpoints) > 1
+}
+
+func (p *endpointPool) isHealthy(e *endpoint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return e.healthy
+}
+
+func (p *endpointPool) setHealth(e *endpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.healthy = err == nil
+	e.lastCheck = time.Now()
+	e.lastError = ""
+	if err != nil {
+		e.lastError = err.Error()
+	}
+}
+
+// report updates the health of the endpoint with the result of a call.
+func (p *endpointPool) report(e *endpoint, resp *http.Response, apiError *APIError) {
+	if isConnectionError(resp, apiError) {
+		p.setHealth(e, apiError)
+	} else if resp != nil {
+		p.setHealth(e, nil)
+	}
+}
+
+func (p *endpointPool) setIteratorEndpoint(iteratorUUID uuid.UUID, e *endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.iterators[iteratorUUID] = e
+}
+
+func (p *endpointPool) getIteratorEndpoint(iteratorUUID uuid.UUID) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.iterators[iteratorUUID]
+}
+
+func (p *endpointPool) forgetIterator(iteratorUUID uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.iterators, iteratorUUID)
+}
+
+func (p *endpointPool) status() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]EndpointStatus, len(p.endpoints))
+	for idx, e := range p.endpoints {
+		status[idx] = EndpointStatus{Url: e.url, Healthy: e.healthy, LastCheck: e.lastCheck, LastError: e.lastError}
+	}
+	return status
+}
+
+// isConnectionError returns true if the server could not be reached (the request has not been processed),
+// the call can be made again on another endpoint.
+func isConnectionError(resp *http.Response, apiError *APIError) bool {
+	if apiError == nil || resp != nil {
+		return false
+	}
+	return apiError.Code == ErrorURL || apiError.Code == ErrorCircuitBreakerOpen
+}
+
+// callWithFailover calls fn with the base url of the endpoints, in the selection order,
+// until the server is reached.
+func (c *MinistreamClient) callWithFailover(ctx context.Context, cptRecords int, fn func(baseUrl string) (*http.Response, *APIError)) (*http.Response, *APIError, *endpoint) {
+	candidates := c.endpoints.candidates()
+	if apiError := c.waitRateLimiter(ctx, cptRecords); apiError != nil {
+		return nil, apiError, nil
+	}
+
+	var resp *http.Response
+	var apiError *APIError
+	var e *endpoint
+	for _, e = range candidates {
+		resp, apiError = c.callEndpoint(ctx, e, fn)
+		if !isConnectionError(resp, apiError) || ctx.Err() != nil {
+			break
+		}
+	}
+	return resp, apiError, e
+}
+
+// callIterator calls fn with the base url of the endpoint which has created the iterator,
+// if this endpoint is down the iterator is lost: the error code is ErrorStreamIteratorNotFound
+// so that the consumer creates a new iterator on another endpoint.
+func (c *MinistreamClient) callIterator(ctx context.Context, iteratorUUID uuid.UUID, fn func(baseUrl string) (*http.Response, *APIError)) (*http.Response, *APIError) {
+	e := c.endpoints.getIteratorEndpoint(iteratorUUID)
+	if e == nil || !c.endpoints.isMultiple() {
+		resp, apiError, _ := c.callWithFailover(ctx, 0, fn)
+		return resp, apiError
+	}
+
+	if !c.endpoints.isHealthy(e) {
+		c.endpoints.forgetIterator(iteratorUUID)
+		return nil, &APIError{Message: "stream iterator endpoint is down", Details: e.url, Code: ErrorStreamIteratorNotFound}
+	}
+
+	if apiError := c.waitRateLimiter(ctx, 0); apiError != nil {
+		return nil, apiError
+	}
+	resp, apiError := c.callEndpoint(ctx, e, fn)
+	if isConnectionError(resp, apiError) && ctx.Err() == nil {
+		c.endpoints.forgetIterator(iteratorUUID)
+		return resp, &APIError{Message: "stream iterator endpoint is down", Details: apiError.Message, Code: ErrorStreamIteratorNotFound}
+	}
+	return resp, apiError
+}
+
+func (c *MinistreamClient) callEndpoint(ctx context.Context, e *endpoint, fn func(baseUrl string) (*http.Response, *APIError)) (*http.Response, *APIError) {
+	// the circuit breaker is per server: all the apis of a dead server fail fast
+	if apiError := c.beforeCall(e.url); apiError != nil {
+		return nil, apiError
+	}
+
+	resp, apiError := fn(e.url)
+	c.afterCall(ctx, e.url, resp, apiError)
+	c.endpoints.report(e, resp, apiError)
+	return resp, apiError
+}
+
+// CheckEndpoints pings all the endpoints and updates their health.
+func (c *MinistreamClient) CheckEndpoints(ctx context.Context) []EndpointStatus {
+	for _, e := range c.endpoints.endpoints {
+		err := c.pingEndpoint(ctx, e.url)
+		if ctx.Err() != nil {
+			break
+		}
+		c.endpoints.setHealth(e, err)
+	}
+	return c.endpoints.status()
+}
+
+// RunEndpointsHealthChecks pings all the endpoints every interval until ctx is done,
+// an endpoint marked down after a connection error is used again once it answers.
+func (c *MinistreamClient) RunEndpointsHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckEndpoints(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetEndpoints returns the health of the endpoints.
+func (c *MinistreamClient) GetEndpoints() []EndpointStatus {
+	return c.endpoints.status()
+}
@@ -0,0 +1,154 @@
+package ministreamclient_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	ministreamclient "github.com/nbigot/ministream-client-go/client"
+	"github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+	"github.com/nbigot/ministream-client-go/ministreamtest"
+)
+
+// newTestServers starts count fake servers holding the same stream.
+func newTestServers(t *testing.T, count int) ([]*ministreamtest.Server, StreamUUID) {
+	t.Helper()
+	streamUUID := uuid.New()
+	servers := make([]*ministreamtest.Server, count)
+	for idx := range servers {
+		servers[idx] = ministreamtest.NewTestServer(t, ministreamtest.ServerSettings{})
+		servers[idx].CreateStreamWithUUID(streamUUID, nil)
+	}
+	return servers, streamUUID
+}
+
+// newDownUrl returns the url of a server which is not listening anymore.
+func newDownUrl() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func newIteratorParams() *RecordsIteratorParams {
+	return &RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage}
+}
+
+func TestEndpointsFailover(t *testing.T) {
+	ctx := context.Background()
+	servers, streamUUID := newTestServers(t, 1)
+	secondary := servers[0]
+	client := ministreamclient.CreateClientWithEndpoints([]string{newDownUrl(), secondary.URL}, ministreamclient.EndpointSelectionPrimary, "test", nil, false, time.Second, nil)
+
+	if _, apiError := client.CreateRecordsIterator(ctx, streamUUID, newIteratorParams()); apiError != nil {
+		t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+	}
+	endpoints := client.GetEndpoints()
+	if endpoints[0].Healthy || !endpoints[1].Healthy {
+		t.Errorf("GetEndpoints() = %+v, want the primary down", endpoints)
+	}
+
+	// the primary endpoint is not tried anymore
+	if _, apiError := client.CreateRecordsIterator(ctx, streamUUID, newIteratorParams()); apiError != nil {
+		t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+	}
+	if cpt := secondary.Requests(ministreamtest.RouteCreateRecordsIterator); cpt != 2 {
+		t.Errorf("secondary requests = %d, want %d", cpt, 2)
+	}
+}
+
+func TestEndpointsFailoverRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	servers, streamUUID := newTestServers(t, 1)
+	secondary := servers[0]
+	client := ministreamclient.CreateClientWithEndpoints([]string{newDownUrl(), secondary.URL}, ministreamclient.EndpointSelectionPrimary, "test", nil, false, time.Second, nil)
+	// the burst allows a single call of 10 records, the next ones wait 10 seconds
+	client.SetRateLimiter(backoff.NewRateLimiter(1, 1, 1, 10))
+
+	// the tokens are taken once, not once per endpoint tried
+	if _, _, apiError := client.PutRecords(ctx, streamUUID, 0, ministreamtest.NewRecords(10)); apiError != nil {
+		t.Fatalf("PutRecords() = %v, want %v", apiError, nil)
+	}
+	if cpt := secondary.Requests(ministreamtest.RoutePutRecords); cpt != 1 {
+		t.Errorf("secondary requests = %d, want %d", cpt, 1)
+	}
+}
+
+func TestEndpointsRoundRobin(t *testing.T) {
+	ctx := context.Background()
+	servers, streamUUID := newTestServers(t, 3)
+	client := ministreamclient.CreateClientWithEndpoints([]string{servers[0].URL, servers[1].URL, servers[2].URL}, ministreamclient.EndpointSelectionRoundRobin, "test", nil, false, time.Second, nil)
+
+	for i := 0; i < 6; i++ {
+		if _, apiError := client.CreateRecordsIterator(ctx, streamUUID, newIteratorParams()); apiError != nil {
+			t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+		}
+		// the calls which don't fail over don't move the round robin
+		for j := 0; j < 2; j++ {
+			_ = client.Ping(ctx)
+		}
+	}
+	counts := make([]int, len(servers))
+	for idx, server := range servers {
+		counts[idx] = server.Requests(ministreamtest.RouteCreateRecordsIterator)
+	}
+	if !reflect.DeepEqual(counts, []int{2, 2, 2}) {
+		t.Errorf("requests = %v, want %v", counts, []int{2, 2, 2})
+	}
+}
+
+func TestEndpointsStickyIterator(t *testing.T) {
+	ctx := context.Background()
+	servers, streamUUID := newTestServers(t, 2)
+	client := ministreamclient.CreateClientWithEndpoints([]string{servers[0].URL, servers[1].URL}, ministreamclient.EndpointSelectionRoundRobin, "test", nil, false, time.Second, nil)
+	countRequests := func(server *ministreamtest.Server) int {
+		return server.Requests(ministreamtest.RouteCreateRecordsIterator) + server.Requests(ministreamtest.RouteGetRecords)
+	}
+
+	response, apiError := client.CreateRecordsIterator(ctx, streamUUID, newIteratorParams())
+	if apiError != nil {
+		t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+	}
+
+	// the calls of the iterator go to the server which has created it
+	for i := 0; i < 3; i++ {
+		if _, _, apiError := client.GetRecords(ctx, streamUUID, response.StreamIteratorUUID, 10); apiError != nil {
+			t.Fatalf("GetRecords() = %v, want %v", apiError, nil)
+		}
+	}
+	if counts := []int{countRequests(servers[0]), countRequests(servers[1])}; !reflect.DeepEqual(counts, []int{4, 0}) {
+		t.Errorf("requests = %v, want %v", counts, []int{4, 0})
+	}
+
+	// the server of the iterator goes down, the iterator must be created again
+	servers[0].Close()
+	_, _, apiError = client.GetRecords(ctx, streamUUID, response.StreamIteratorUUID, 10)
+	if apiError == nil || apiError.Code != ErrorStreamIteratorNotFound {
+		t.Fatalf("GetRecords() = %v, want code %d", apiError, ErrorStreamIteratorNotFound)
+	}
+	if _, apiError := client.CreateRecordsIterator(ctx, streamUUID, newIteratorParams()); apiError != nil {
+		t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+	}
+	if cpt := countRequests(servers[1]); cpt != 1 {
+		t.Errorf("second server requests = %d, want %d", cpt, 1)
+	}
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	up := ministreamtest.NewTestServer(t, ministreamtest.ServerSettings{})
+	down := newDownUrl()
+
+	client := ministreamclient.CreateClientWithEndpoints([]string{down, up.URL}, ministreamclient.EndpointSelectionPrimary, "test", nil, false, time.Second, nil)
+	status := client.CheckEndpoints(context.Background())
+	if status[0].Healthy || status[0].LastError == "" || !status[1].Healthy {
+		t.Errorf("CheckEndpoints() = %+v, want the first endpoint down", status)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() = %v, want the healthy endpoint", err)
+	}
+}
@@ -0,0 +1,155 @@
+package ministreamclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type HealthMonitorSettings struct {
+	Interval         time.Duration // duration between two pings
+	Timeout          time.Duration // timeout of a ping (0 for the timeout of the client)
+	FailureThreshold int           // number of consecutive failed pings which makes the server unhealthy
+}
+
+func DefaultHealthMonitorSettings() HealthMonitorSettings {
+	return HealthMonitorSettings{
+		Interval:         10 * time.Second,
+		Timeout:          2 * time.Second,
+		FailureThreshold: 3,
+	}
+}
+
+// HealthStatus is the result of the last pings of the server.
+type HealthStatus struct {
+	Healthy             bool          `json:"healthy"`
+	Latency             time.Duration `json:"latency"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	LastCheck           time.Time     `json:"lastCheck"`
+	LastError           string        `json:"lastError,omitempty"`
+}
+
+// HealthMonitor pings the server in the background, it is safe for concurrent use.
+// The server is unhealthy until the first ping succeeds and after FailureThreshold consecutive failed pings.
+// HealthMonitor implements http.Handler to be mounted as a readiness endpoint.
+type HealthMonitor struct {
+	client     *MinistreamClient
+	settings   HealthMonitorSettings
+	status     HealthStatus
+	listeners  map[int]func(status HealthStatus)
+	listenerId int
+	mu         sync.Mutex
+}
+
+func NewHealthMonitor(client *MinistreamClient, settings HealthMonitorSettings) *HealthMonitor {
+	defaults := DefaultHealthMonitorSettings()
+	if settings.Interval <= 0 {
+		settings.Interval = defaults.Interval
+	}
+	if settings.FailureThreshold < 1 {
+		settings.FailureThreshold = defaults.FailureThreshold
+	}
+	return &HealthMonitor{client: client, settings: settings, listeners: make(map[int]func(status HealthStatus))}
+}
+
+// Subscribe adds a listener of the changes of health, it is called by the goroutine of the pings,
+// until the returned function is called.
+func (m *HealthMonitor) Subscribe(listener func(status HealthStatus)) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.listenerId++
+	id := m.listenerId
+	m.listeners[id] = listener
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.listeners, id)
+	}
+}
+
+// Run pings the server every interval until ctx is done.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.settings.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check pings the server once and returns the updated status.
+func (m *HealthMonitor) Check(ctx context.Context) HealthStatus {
+	pingCtx := ctx
+	if m.settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		pingCtx, cancel = context.WithTimeout(ctx, m.settings.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := m.client.Ping(pingCtx)
+	if ctx.Err() != nil {
+		// the monitor is stopped, the server is not at fault
+		return m.Status()
+	}
+
+	m.mu.Lock()
+	wasHealthy := m.status.Healthy
+	m.status.LastCheck = time.Now()
+	m.status.Latency = m.status.LastCheck.Sub(start)
+	if err == nil {
+		m.status.Healthy = true
+		m.status.ConsecutiveFailures = 0
+		m.status.LastError = ""
+	} else {
+		m.status.ConsecutiveFailures++
+		m.status.LastError = err.Error()
+		if m.status.ConsecutiveFailures >= m.settings.FailureThreshold {
+			m.status.Healthy = false
+		}
+	}
+	status := m.status
+	var listeners []func(status HealthStatus)
+	if status.Healthy != wasHealthy {
+		for _, listener := range m.listeners {
+			listeners = append(listeners, listener)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(status)
+	}
+	return status
+}
+
+func (m *HealthMonitor) Status() HealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *HealthMonitor) Healthy() bool {
+	return m.Status().Healthy
+}
+
+// ServeHTTP answers 200 if the server is healthy, 503 otherwise, with the status in json.
+func (m *HealthMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := m.Status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
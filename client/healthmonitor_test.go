@@ -0,0 +1,107 @@
+package ministreamclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := CreateClient(server.URL, "test", nil, false, time.Second, nil)
+	monitor := NewHealthMonitor(client, HealthMonitorSettings{Interval: time.Minute, FailureThreshold: 2})
+	changes := make([]bool, 0)
+	defer monitor.Subscribe(func(status HealthStatus) {
+		changes = append(changes, status.Healthy)
+	})()
+
+	readiness := func() int {
+		recorder := httptest.NewRecorder()
+		monitor.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+		return recorder.Code
+	}
+
+	// not ready before the first ping
+	if code := readiness(); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		failing             bool
+		healthy             bool
+		consecutiveFailures int
+		readiness           int
+	}{
+		{false, true, 0, http.StatusOK},
+		{true, true, 1, http.StatusOK},
+		{true, false, 2, http.StatusServiceUnavailable},
+		{true, false, 3, http.StatusServiceUnavailable},
+		{false, true, 0, http.StatusOK},
+	}
+	for idx, tt := range tests {
+		failing.Store(tt.failing)
+		status := monitor.Check(ctx)
+		if status.Healthy != tt.healthy || status.ConsecutiveFailures != tt.consecutiveFailures {
+			t.Errorf("Check() %d = %+v, want healthy %v and %d failures", idx, status, tt.healthy, tt.consecutiveFailures)
+		}
+		if tt.failing && status.LastError == "" {
+			t.Errorf("Check() %d LastError is empty", idx)
+		}
+		if monitor.Healthy() != tt.healthy {
+			t.Errorf("Healthy() %d = %v, want %v", idx, monitor.Healthy(), tt.healthy)
+		}
+		if code := readiness(); code != tt.readiness {
+			t.Errorf("readiness %d = %d, want %d", idx, code, tt.readiness)
+		}
+	}
+
+	if expected := []bool{true, false, true}; !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes = %v, want %v", changes, expected)
+	}
+}
+
+func TestHealthMonitorRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := CreateClient(server.URL, "test", nil, false, time.Second, nil)
+	monitor := NewHealthMonitor(client, HealthMonitorSettings{Interval: time.Millisecond})
+	healthy := make(chan struct{})
+	defer monitor.Subscribe(func(status HealthStatus) {
+		close(healthy)
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitor.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-healthy:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the monitor has not become healthy")
+	}
+	cancel()
+	<-done
+	if !monitor.Healthy() {
+		t.Errorf("Healthy() = false, want true")
+	}
+}
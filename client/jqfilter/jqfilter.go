@@ -0,0 +1,214 @@
+// Package jqfilter builds and validates the jq filters of the records iterators (RecordsIteratorParams.JqFilter).
+//
+// Example:
+//
+//	filter, err := jqfilter.Select(jqfilter.And(
+//		jqfilter.Eq(".level", "error"),
+//		jqfilter.In(".service", "api", "auth"),
+//		jqfilter.Range(".duration", 100, 500),
+//	))
+//	// select(((.level == "error") and ((.service == "api") or (.service == "auth")) and ((.duration >= 100) and (.duration <= 500))))
+package jqfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// Condition is a jq boolean expression.
+type Condition struct {
+	expr string
+	err  error
+}
+
+func (c Condition) String() string {
+	return c.expr
+}
+
+// Err returns the first error encountered while building the condition (invalid value).
+func (c Condition) Err() error {
+	return c.err
+}
+
+// Raw wraps a free-form jq boolean expression, it is checked by Validate.
+func Raw(expr string) Condition {
+	return Condition{expr: "(" + expr + ")"}
+}
+
+// Eq matches the records whose field equals the value.
+func Eq(path string, value interface{}) Condition {
+	return compare(path, "==", value)
+}
+
+// Ne matches the records whose field does not equal the value.
+func Ne(path string, value interface{}) Condition {
+	return compare(path, "!=", value)
+}
+
+// Gt matches the records whose field is greater than the value.
+func Gt(path string, value interface{}) Condition {
+	return compare(path, ">", value)
+}
+
+// Gte matches the records whose field is greater than or equal to the value.
+func Gte(path string, value interface{}) Condition {
+	return compare(path, ">=", value)
+}
+
+// Lt matches the records whose field is less than the value.
+func Lt(path string, value interface{}) Condition {
+	return compare(path, "<", value)
+}
+
+// Lte matches the records whose field is less than or equal to the value.
+func Lte(path string, value interface{}) Condition {
+	return compare(path, "<=", value)
+}
+
+// In matches the records whose field equals one of the values.
+func In(path string, values ...interface{}) Condition {
+	conditions := make([]Condition, len(values))
+	for idx, value := range values {
+		conditions[idx] = Eq(path, value)
+	}
+	return Or(conditions...)
+}
+
+// Range matches the records whose field is between min and max (inclusive).
+func Range(path string, min interface{}, max interface{}) Condition {
+	return And(Gte(path, min), Lte(path, max))
+}
+
+// Exists matches the records whose field is set (and not null).
+func Exists(path string) Condition {
+	jqPath, err := Path(path)
+	return Condition{expr: fmt.Sprintf("(%s != null)", jqPath), err: err}
+}
+
+// And matches the records matching all the conditions (all the records if there is none).
+func And(conditions ...Condition) Condition {
+	return join("and", "true", conditions)
+}
+
+// Or matches the records matching at least one of the conditions (no record if there is none).
+func Or(conditions ...Condition) Condition {
+	return join("or", "false", conditions)
+}
+
+// Not matches the records which don't match the condition.
+func Not(condition Condition) Condition {
+	return Condition{expr: fmt.Sprintf("(%s | not)", condition.expr), err: condition.err}
+}
+
+// Select returns the jq filter which keeps the records matching the condition,
+// or the error encountered while building the condition.
+func Select(condition Condition) (string, error) {
+	if condition.err != nil {
+		return "", condition.err
+	}
+	return fmt.Sprintf("select(%s)", condition.expr), nil
+}
+
+// Build returns the jq filter of the condition, checked with Validate.
+func Build(condition Condition) (string, error) {
+	filter, err := Select(condition)
+	if err != nil {
+		return "", err
+	}
+	if err := Validate(filter); err != nil {
+		return "", err
+	}
+	return filter, nil
+}
+
+func compare(path string, operator string, value interface{}) Condition {
+	jqPath, err := Path(path)
+	if err != nil {
+		return Condition{err: err}
+	}
+	literal, err := json.Marshal(value)
+	if err != nil {
+		return Condition{err: fmt.Errorf("jqfilter: invalid value for %s: %s", path, err.Error())}
+	}
+	return Condition{expr: fmt.Sprintf("(%s %s %s)", jqPath, operator, literal)}
+}
+
+func join(operator string, empty string, conditions []Condition) Condition {
+	if len(conditions) == 0 {
+		return Condition{expr: empty}
+	}
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+
+	exprs := make([]string, len(conditions))
+	for idx, condition := range conditions {
+		if condition.err != nil {
+			return Condition{err: condition.err}
+		}
+		exprs[idx] = condition.expr
+	}
+	return Condition{expr: "(" + strings.Join(exprs, " "+operator+" ") + ")"}
+}
+
+var identifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Path converts a dotted field path ("level", ".http.status", "tags.0") into a jq path.
+// Keys which are not identifiers are quoted, numeric keys are array indexes.
+func Path(path string) (string, error) {
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return ".", nil
+	}
+
+	var sb strings.Builder
+	for _, key := range strings.Split(path, ".") {
+		switch {
+		case key == "":
+			return "", fmt.Errorf("jqfilter: invalid path %q", path)
+		case identifier.MatchString(key):
+			sb.WriteString("." + key)
+		case isIndex(key):
+			sb.WriteString("[" + key + "]")
+		default:
+			quoted, _ := json.Marshal(key)
+			sb.WriteString("." + string(quoted))
+		}
+	}
+	return sb.String(), nil
+}
+
+func isIndex(key string) bool {
+	for _, r := range key {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// SyntaxError is returned by Validate when the filter can't be parsed or compiled.
+type SyntaxError struct {
+	Filter  string
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid jq filter %q: %s", e.Filter, e.Message)
+}
+
+// Validate checks the syntax of a jq filter locally (parsing and compilation, the filter is not run).
+func Validate(filter string) error {
+	query, err := gojq.Parse(filter)
+	if err != nil {
+		return &SyntaxError{Filter: filter, Message: err.Error()}
+	}
+	if _, err := gojq.Compile(query); err != nil {
+		return &SyntaxError{Filter: filter, Message: err.Error()}
+	}
+	return nil
+}
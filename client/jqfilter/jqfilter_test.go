@@ -0,0 +1,86 @@
+package jqfilter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition Condition
+		expected  string
+	}{
+		{
+			name:      "equals",
+			condition: Eq(".level", "error"),
+			expected:  `select((.level == "error"))`,
+		},
+		{
+			name:      "nested path with special keys",
+			condition: Gte("http.status code.0", 500),
+			expected:  `select((.http."status code"[0] >= 500))`,
+		},
+		{
+			name:      "in set",
+			condition: In("service", "api", "auth"),
+			expected:  `select(((.service == "api") or (.service == "auth")))`,
+		},
+		{
+			name:      "and, range, exists, not",
+			condition: And(Range(".duration", 100, 500), Exists(".user.id"), Not(Eq(".debug", true))),
+			expected:  `select((((.duration >= 100) and (.duration <= 500)) and (.user.id != null) and ((.debug == true) | not)))`,
+		},
+		{
+			name:      "raw expression",
+			condition: Or(Raw(`.msg | startswith("hello")`), Lt(".priority", 2)),
+			expected:  `select(((.msg | startswith("hello")) or (.priority < 2)))`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Build(tt.condition)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Build() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		filter  string
+		isValid bool
+	}{
+		{filter: `select(.level == "error")`, isValid: true},
+		{filter: `.m | {name, level}`, isValid: true},
+		{filter: `select(.level == "error"`, isValid: false},
+		{filter: `select(.level = = 1)`, isValid: false},
+		{filter: `select(unknownfunction(.level))`, isValid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := Validate(tt.filter)
+			if (err == nil) != tt.isValid {
+				t.Errorf("Validate() = %v, want valid=%v", err, tt.isValid)
+			}
+			var syntaxError *SyntaxError
+			if err != nil && !errors.As(err, &syntaxError) {
+				t.Errorf("Validate() error type = %T, want *SyntaxError", err)
+			}
+		})
+	}
+
+	if _, err := Build(Raw(`.level ==`)); err == nil {
+		t.Errorf("Build() of an invalid raw expression must fail")
+	}
+	if _, err := Build(Eq("a..b", 1)); err == nil {
+		t.Errorf("Build() of an invalid path must fail")
+	}
+	if _, err := Select(And(Eq(".level", "error"), Eq(".a..b", 1))); err == nil {
+		t.Errorf("Select() of an invalid path must fail")
+	}
+}
@@ -29,7 +29,7 @@ type Pbkdf2Response struct {
 
 func (c *MinistreamClient) Pbkdf2(ctx context.Context, r *Pbkdf2Request) (*Pbkdf2Response, error) {
 	jsonData, _ := json.Marshal(*r)
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/v1/utils/pbkdf2", c.url), bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/api/v1/utils/pbkdf2", c.endpoints.current().url), bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, err
 	}
@@ -61,20 +61,36 @@ func (c *MinistreamClient) Pbkdf2(ctx context.Context, r *Pbkdf2Request) (*Pbkdf
 	return &result, nil
 }
 
+// MakePbkdf2Request returns a request with a random salt, it panics if the random generator fails.
+//
+// Deprecated: use NewPbkdf2Request which returns the error of the random generator.
 func MakePbkdf2Request(password string) *Pbkdf2Request {
+	r, err := NewPbkdf2Request(password)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// NewPbkdf2Request returns a request with a random salt.
+func NewPbkdf2Request(password string) (*Pbkdf2Request, error) {
+	salt, err := randomString(64)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Pbkdf2Request{
 		Digest:     "sha512",
 		Iterations: 1000,
-		Salt:       randomString(64),
+		Salt:       salt,
 		Password:   password,
-	}
+	}, nil
 }
 
-func randomString(length int) string {
+func randomString(length int) (string, error) {
 	b := make([]byte, length)
-	_, err := rand.Read(b)
-	if err != nil {
-		panic(err)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%x", b)[:length]
+	return fmt.Sprintf("%x", b)[:length], nil
 }
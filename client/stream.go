@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/google/uuid"
 	. "github.com/nbigot/ministream-client-go/client/types"
 )
 
@@ -17,13 +18,21 @@ func (c *MinistreamClient) CreateStream(ctx context.Context, properties *StreamP
 	}{Properties: properties}
 
 	method := "POST"
-	url := fmt.Sprintf("%s/api/v1/stream/", c.url)
+	e := c.endpoints.current()
+	url := fmt.Sprintf("%s/api/v1/stream/", e.url)
 
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
+	if apiError := c.waitRateLimiter(ctx, 0); apiError != nil {
+		return nil, apiError
+	}
+	if apiError := c.beforeCall(e.url); apiError != nil {
+		return nil, apiError
+	}
+
 	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
 	if err != nil {
 		return nil, err
@@ -33,14 +42,19 @@ func (c *MinistreamClient) CreateStream(ctx context.Context, properties *StreamP
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Connection", "keep-alive")
 	req.Header.Add("User-Agent", c.userAgent)
-	if c.auth.enabled && c.auth.creds != nil {
-		req.Header.Set("Authorization", "Bearer "+c.auth.jwt.Token)
+	if bearer := c.auth.bearer(); bearer != "" {
+		req.Header.Set("Authorization", bearer)
 	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
+		apiError := APIErrorFromError(err)
+		c.afterCall(ctx, e.url, nil, apiError)
+		c.endpoints.report(e, nil, apiError)
 		return nil, err
 	}
+	c.afterCall(ctx, e.url, resp, nil)
+	c.endpoints.report(e, resp, nil)
 
 	defer resp.Body.Close()
 
@@ -68,3 +82,25 @@ func (c *MinistreamClient) CreateStream(ctx context.Context, properties *StreamP
 		return &result, nil
 	}
 }
+
+func (c *MinistreamClient) GetStreamInformation(ctx context.Context, streamUUID uuid.UUID) (*StreamInformation, *APIError) {
+	method := "GET"
+	headers := make(map[string]string)
+	headers["Accept"] = "application/json"
+	headers["Connection"] = "keep-alive"
+	headers["User-Agent"] = c.userAgent
+	if bearer := c.auth.bearer(); bearer != "" {
+		headers["Authorization"] = bearer
+	}
+	result := StreamInformation{}
+	_, apiError, _ := c.callWithFailover(ctx, 0, func(baseUrl string) (*http.Response, *APIError) {
+		url := fmt.Sprintf("%s/api/v1/stream/%s", baseUrl, streamUUID)
+		return CallWebAPI(ctx, &c.client, method, url, nil, &headers, 200, &result, c.logger)
+	})
+	if apiError != nil {
+		apiError.StreamUUID = streamUUID
+		return nil, apiError
+	}
+
+	return &result, nil
+}
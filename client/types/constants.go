@@ -29,3 +29,4 @@ const ErrorContextDeadlineExceeded = 2002
 const ErrorTransportReadFromServerError = 2003
 const ErrorURL = 2004
 const ErrorTooManyRequests = 2005
+const ErrorCircuitBreakerOpen = 2006
@@ -34,3 +34,12 @@ const (
 	ProducerStateClosing     ProducerState = 3
 	ProducerStateClosed      ProducerState = 4
 )
+
+type CircuitBreakerState string
+
+// Enum values for CircuitBreakerState
+const (
+	CircuitBreakerStateClosed   CircuitBreakerState = "CLOSED"
+	CircuitBreakerStateOpen     CircuitBreakerState = "OPEN"
+	CircuitBreakerStateHalfOpen CircuitBreakerState = "HALF_OPEN"
+)
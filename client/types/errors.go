@@ -10,7 +10,7 @@ import (
 
 func (e *APIError) CanRetry() bool {
 	switch e.Code {
-	case ErrorHTTPTimeout, ErrorTimeout, ErrorTransportReadFromServerError:
+	case ErrorHTTPTimeout, ErrorTimeout, ErrorTransportReadFromServerError, ErrorCircuitBreakerOpen:
 		return true
 	default:
 		return false
@@ -0,0 +1,40 @@
+package types
+
+import "time"
+
+type RecordsIteratorParams struct {
+	Name               *string      `json:"name,omitempty"`
+	IteratorType       IteratorType `json:"iteratorType"`
+	JqFilter           *string      `json:"jqFilter,omitempty"`
+	MessageId          *MessageId   `json:"messageId,omitempty"`
+	Timestamp          *time.Time   `json:"timestamp,omitempty"`
+	MaxWaitTimeSeconds *int         `json:"maxWaitTimeSeconds,omitempty"` // long pooling (set 0 to disable)
+}
+
+func (p *RecordsIteratorParams) Validate() *APIError {
+	if p.IteratorType == IteratorTypeAtTimestamp && (p.Timestamp == nil || p.Timestamp.IsZero()) {
+		return &APIError{Message: "Timestamp must be set"}
+	}
+
+	// if p.IteratorType not in
+	// switch p.IteratorType {
+	// case IT_FIRST_MESSAGE:
+	// 	return nil
+	// case IT_LAST_MESSAGE:
+	// 	return nil
+	// case IT_AFTER_LAST_MESSAGE:
+	// 	return nil
+	// case IT_AT_MESSAGE_ID:
+	// 	return nil
+	// case IT_AFTER_MESSAGE_ID:
+	// 	return nil
+	// case IteratorTypeAtTimestamp:
+	// 	if p.Timestamp.IsZero() {
+	// 		return &APIError{Message: "Timestamp must be set"}
+	// 	}
+	// default:
+	// 	return &APIError{Message: "invalid IteratorType"}
+	// }
+
+	return nil
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"time"
 
@@ -40,6 +41,9 @@ type CreateStreamResponse struct {
 	LastMsgId    MessageId        `json:"lastMsgId"`
 }
 
+// StreamInformation is the description of a stream (same fields as the response of the stream creation).
+type StreamInformation = CreateStreamResponse
+
 type GetStreamRecordsResponse struct {
 	Status             string             `json:"status"`
 	Duration           time.Duration      `json:"duration"`
@@ -52,6 +56,39 @@ type GetStreamRecordsResponse struct {
 	Records            []interface{}      `json:"records"`
 }
 
+// UnmarshalJSON decodes the records as usual but keeps their message id ("i") as a json.Number,
+// a float64 can't hold the message ids above 2^53.
+func (r *GetStreamRecordsResponse) UnmarshalJSON(data []byte) error {
+	type response GetStreamRecordsResponse
+	var raw struct {
+		*response
+		Records []json.RawMessage `json:"records"`
+	}
+	raw.response = (*response)(r)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	r.Records = nil
+	if raw.Records != nil {
+		r.Records = make([]interface{}, len(raw.Records))
+	}
+	for idx, data := range raw.Records {
+		if err := json.Unmarshal(data, &r.Records[idx]); err != nil {
+			return err
+		}
+		if record, ok := r.Records[idx].(map[string]interface{}); ok {
+			var envelope struct {
+				Id json.Number `json:"i"`
+			}
+			if err := json.Unmarshal(data, &envelope); err == nil && envelope.Id != "" {
+				record["i"] = envelope.Id
+			}
+		}
+	}
+	return nil
+}
+
 type CreateRecordsIteratorResponse struct {
 	Status             string             `json:"status"`
 	Message            string             `json:"message"`
@@ -98,3 +135,31 @@ type IProducerClient interface {
 	Authenticate(ctx context.Context) *APIError
 	PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*PutRecordsResponse, *http.Response, *APIError)
 }
+
+// IStreamInformationClient is implemented by the clients which can describe a stream.
+type IStreamInformationClient interface {
+	GetStreamInformation(ctx context.Context, streamUUID uuid.UUID) (*StreamInformation, *APIError)
+}
+
+// CircuitBreakerStateChange is the event sent when the circuit of an endpoint changes its state.
+type CircuitBreakerStateChange struct {
+	Endpoint    string // url of the server for the circuits of the client
+	From        CircuitBreakerState
+	To          CircuitBreakerState
+	FailureRate float64 // failure rate of the last calls when the state changed
+	Date        time.Time
+}
+
+// ICircuitBreakerClient is implemented by the clients with a circuit breaker,
+// the listener is called on each state change until the returned function is called.
+type ICircuitBreakerClient interface {
+	SubscribeCircuitBreaker(listener func(change CircuitBreakerStateChange)) (unsubscribe func())
+}
+
+type IConsumerClient interface {
+	Disconnect()
+	Authenticate(ctx context.Context) *APIError
+	CreateRecordsIterator(ctx context.Context, streamUUID uuid.UUID, p *RecordsIteratorParams) (*CreateRecordsIteratorResponse, *APIError)
+	GetRecords(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError)
+	CloseRecordsIterator(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID) *APIError
+}
@@ -7,7 +7,11 @@ import (
 )
 
 func (c *MinistreamClient) Ping(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/v1/utils/ping", c.url), nil)
+	return c.pingEndpoint(ctx, c.endpoints.current().url)
+}
+
+func (c *MinistreamClient) pingEndpoint(ctx context.Context, baseUrl string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/v1/utils/ping", baseUrl), nil)
 	if err != nil {
 		return err
 	}
@@ -23,7 +27,7 @@ func (c *MinistreamClient) Ping(ctx context.Context) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("Authenticate failed")
+		return fmt.Errorf("ping failed: %s", resp.Status)
 	}
 	return nil
 }
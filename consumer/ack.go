@@ -0,0 +1,127 @@
+package ministreamconsumer
+
+import (
+	"sync"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// StreamConsumerAckHandler is implemented by the handlers which acknowledge the records explicitly (at-least-once processing).
+// When the handler implements it, OnGetRecordsToAck is called instead of OnGetRecordsSuccess.
+// The consumer position only moves past the contiguous acknowledged records,
+// the records after the first unacknowledged one are delivered again (the iterator is recreated at that position).
+type StreamConsumerAckHandler interface {
+	// OnGetRecordsToAck must acknowledge the records before returning.
+	// Return false to stop the consumption.
+	OnGetRecordsToAck(response *GetStreamRecordsResponse, ack *RecordsAck) bool
+}
+
+type ackStatus int
+
+const (
+	ackStatusPending ackStatus = iota
+	ackStatusAcked
+	ackStatusNacked
+)
+
+// RecordsAck tracks the acknowledgement of the records of a GetRecords response.
+// It is safe for concurrent use.
+type RecordsAck struct {
+	envelopes []*ResponseRecordEnvelope
+	status    []ackStatus
+	indexes   map[MessageId]int
+	mu        sync.Mutex
+}
+
+func NewRecordsAck(envelopes []*ResponseRecordEnvelope) *RecordsAck {
+	a := RecordsAck{
+		envelopes: envelopes,
+		status:    make([]ackStatus, len(envelopes)),
+		indexes:   make(map[MessageId]int, len(envelopes)),
+	}
+	for idx, envelope := range envelopes {
+		a.indexes[envelope.Id] = idx
+	}
+	return &a
+}
+
+// Envelopes returns the records of the response, in stream order.
+func (a *RecordsAck) Envelopes() []*ResponseRecordEnvelope {
+	return a.envelopes
+}
+
+// Ack marks the record as successfully processed, returns false if the message id is unknown.
+func (a *RecordsAck) Ack(messageId MessageId) bool {
+	return a.setStatus(messageId, ackStatusAcked)
+}
+
+// Nack marks the record as failed, it will be delivered again (as well as all the records after it).
+func (a *RecordsAck) Nack(messageId MessageId) bool {
+	return a.setStatus(messageId, ackStatusNacked)
+}
+
+// AckAll marks all the pending records as successfully processed.
+func (a *RecordsAck) AckAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for idx := range a.status {
+		if a.status[idx] == ackStatusPending {
+			a.status[idx] = ackStatusAcked
+		}
+	}
+}
+
+func (a *RecordsAck) setStatus(messageId MessageId, status ackStatus) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	idx, found := a.indexes[messageId]
+	if !found {
+		return false
+	}
+	a.status[idx] = status
+	return true
+}
+
+// copyStatus copies the status of the records of the other ack (the records unknown to the other ack are not modified).
+func (a *RecordsAck) copyStatus(other *RecordsAck) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	for idx, envelope := range other.envelopes {
+		if other.status[idx] != ackStatusPending {
+			a.setStatus(envelope.Id, other.status[idx])
+		}
+	}
+}
+
+// CountCommitted returns the number of contiguous acknowledged records from the beginning of the response.
+func (a *RecordsAck) CountCommitted() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for idx, status := range a.status {
+		if status != ackStatusAcked {
+			return idx
+		}
+	}
+	return len(a.status)
+}
+
+// IsFullyAcked returns true when all the records have been acknowledged.
+func (a *RecordsAck) IsFullyAcked() bool {
+	return a.CountCommitted() == len(a.envelopes)
+}
+
+func parseRecordEnvelopes(records []interface{}) ([]*ResponseRecordEnvelope, error) {
+	envelopes := make([]*ResponseRecordEnvelope, len(records))
+	for idx, record := range records {
+		envelope, err := ParseRecordEnvelope(record)
+		if err != nil {
+			return nil, err
+		}
+		envelopes[idx] = envelope
+	}
+	return envelopes, nil
+}
@@ -0,0 +1,45 @@
+package ministreamconsumer
+
+import (
+	"testing"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+func TestRecordsAck(t *testing.T) {
+	envelopes := []*ResponseRecordEnvelope{{Id: 1}, {Id: 2}, {Id: 3}, {Id: 4}}
+	tests := []struct {
+		name              string
+		ack               func(ack *RecordsAck)
+		expectedCommitted int
+	}{
+		{name: "nothing acked", ack: func(ack *RecordsAck) {}, expectedCommitted: 0},
+		{name: "all acked", ack: func(ack *RecordsAck) { ack.AckAll() }, expectedCommitted: 4},
+		{
+			name:              "acked out of order",
+			ack:               func(ack *RecordsAck) { ack.Ack(2); ack.Ack(1); ack.Ack(4) },
+			expectedCommitted: 2,
+		},
+		{
+			name:              "nacked record is not committed by AckAll",
+			ack:               func(ack *RecordsAck) { ack.Nack(3); ack.AckAll() },
+			expectedCommitted: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := NewRecordsAck(envelopes)
+			tt.ack(ack)
+			if got := ack.CountCommitted(); got != tt.expectedCommitted {
+				t.Errorf("CountCommitted() = %v, want %v", got, tt.expectedCommitted)
+			}
+			if got := ack.IsFullyAcked(); got != (tt.expectedCommitted == len(envelopes)) {
+				t.Errorf("IsFullyAcked() = %v", got)
+			}
+		})
+	}
+
+	if NewRecordsAck(envelopes).Ack(99) {
+		t.Errorf("Ack() of an unknown message id must return false")
+	}
+}
@@ -0,0 +1,143 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// Checkpoint is the position of the last record processed by a consumer.
+type Checkpoint struct {
+	StreamUUID   StreamUUID `json:"streamUUID"`
+	MessageId    MessageId  `json:"messageId"`
+	CreationDate time.Time  `json:"creationDate"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+// CheckpointStore persists the consumers positions.
+// Implement this interface to store the checkpoints elsewhere (database, key-value store, ...).
+type CheckpointStore interface {
+	// LoadCheckpoint returns nil (and no error) when there is no checkpoint for the key.
+	LoadCheckpoint(ctx context.Context, key string) (*Checkpoint, error)
+	SaveCheckpoint(ctx context.Context, key string, checkpoint *Checkpoint) error
+}
+
+type MemoryCheckpointStore struct {
+	// implements interface CheckpointStore
+	checkpoints map[string]Checkpoint
+	mu          sync.Mutex
+}
+
+func (s *MemoryCheckpointStore) LoadCheckpoint(ctx context.Context, key string) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if checkpoint, found := s.checkpoints[key]; found {
+		return &checkpoint, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryCheckpointStore) SaveCheckpoint(ctx context.Context, key string, checkpoint *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[key] = *checkpoint
+	return nil
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: make(map[string]Checkpoint)}
+}
+
+type FileCheckpointStore struct {
+	// implements interface CheckpointStore
+	// one json file per key, files are replaced atomically (write a temporary file then rename it),
+	// the file and the directory are synced before SaveCheckpoint returns
+	directory string
+	mu        sync.Mutex
+}
+
+var invalidFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func (s *FileCheckpointStore) filePath(key string) string {
+	return filepath.Join(s.directory, invalidFileNameChars.ReplaceAllString(key, "_")+".checkpoint.json")
+}
+
+func (s *FileCheckpointStore) LoadCheckpoint(ctx context.Context, key string) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.filePath(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *FileCheckpointStore) SaveCheckpoint(ctx context.Context, key string, checkpoint *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(s.directory, ".checkpoint-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpFilePath := tmpFile.Name()
+	defer os.Remove(tmpFilePath) // no effect once renamed
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFilePath, s.filePath(key)); err != nil {
+		return err
+	}
+
+	// the rename is durable once the directory is synced
+	return syncDirectory(s.directory)
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func NewFileCheckpointStore(directory string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{directory: directory}, nil
+}
@@ -0,0 +1,96 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+func TestCheckpointStores(t *testing.T) {
+	fileStore, err := NewFileCheckpointStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileCheckpointStore() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		store CheckpointStore
+	}{
+		{name: "MemoryCheckpointStore", store: NewMemoryCheckpointStore()},
+		{name: "FileCheckpointStore", store: fileStore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "consumer/" + uuid.NewString()
+
+			checkpoint, err := tt.store.LoadCheckpoint(ctx, key)
+			if err != nil || checkpoint != nil {
+				t.Fatalf("LoadCheckpoint() = %v, %v, want nil, nil", checkpoint, err)
+			}
+
+			// the message ids above 2^53 can't be held by a float64
+			for _, messageId := range []uint64{10, 20, 1<<53 + 1} {
+				saved := Checkpoint{StreamUUID: uuid.New(), MessageId: messageId, CreationDate: time.Now().UTC()}
+				if err := tt.store.SaveCheckpoint(ctx, key, &saved); err != nil {
+					t.Fatalf("SaveCheckpoint() error = %v", err)
+				}
+
+				checkpoint, err = tt.store.LoadCheckpoint(ctx, key)
+				if err != nil {
+					t.Fatalf("LoadCheckpoint() error = %v", err)
+				}
+				if checkpoint == nil || checkpoint.MessageId != saved.MessageId || checkpoint.StreamUUID != saved.StreamUUID || !checkpoint.CreationDate.Equal(saved.CreationDate) {
+					t.Errorf("LoadCheckpoint() = %+v, want %+v", checkpoint, saved)
+				}
+			}
+		})
+	}
+
+	// no temporary files must be left behind
+	entries, err := os.ReadDir(fileStore.directory)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("len(entries) = %v, want %v", len(entries), 1)
+	}
+}
+
+func TestParseRecordEnvelope(t *testing.T) {
+	record := map[string]interface{}{"i": float64(42), "d": "2023-06-01T10:00:00.5Z", "m": map[string]interface{}{"msg": "hello"}}
+	envelope, err := ParseRecordEnvelope(record)
+	if err != nil {
+		t.Fatalf("ParseRecordEnvelope() error = %v", err)
+	}
+	if envelope.Id != 42 {
+		t.Errorf("Id = %v, want %v", envelope.Id, 42)
+	}
+	if !envelope.CreationDate.Equal(time.Date(2023, 6, 1, 10, 0, 0, 500000000, time.UTC)) {
+		t.Errorf("CreationDate = %v", envelope.CreationDate)
+	}
+
+	// the message ids decoded from a GetRecords response are exact
+	var response GetStreamRecordsResponse
+	if err := json.Unmarshal([]byte(`{"count":1,"records":[{"i":9007199254740993,"d":"2023-06-01T10:00:00Z","m":{"n":1.5}}]}`), &response); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if envelope, err = ParseRecordEnvelope(response.Records[0]); err != nil {
+		t.Fatalf("ParseRecordEnvelope() error = %v", err)
+	}
+	if envelope.Id != 1<<53+1 {
+		t.Errorf("Id = %v, want %v", envelope.Id, uint64(1<<53+1))
+	}
+	if n := envelope.Msg.(map[string]interface{})["n"]; n != 1.5 {
+		t.Errorf("Msg[n] = %v, want %v", n, 1.5)
+	}
+
+	if _, err := ParseRecordEnvelope(map[string]interface{}{"m": "no id"}); err == nil {
+		t.Errorf("ParseRecordEnvelope() must fail when the message id is missing")
+	}
+}
@@ -2,19 +2,28 @@ package ministreamconsumer
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
-	. "github.com/nbigot/ministream-client-go/client"
 	. "github.com/nbigot/ministream-client-go/client/backoff"
+	"github.com/nbigot/ministream-client-go/client/jqfilter"
 	. "github.com/nbigot/ministream-client-go/client/types"
 
 	"github.com/google/uuid"
 )
 
+// CloseRecordsIteratorTimeout is the timeout to close the iterator when the consumer context is already canceled.
+const CloseRecordsIteratorTimeout = 5 * time.Second
+
+// DefaultResumeRecreateIteratorAfter is the default pause duration after which the iterator is recreated on resume.
+const DefaultResumeRecreateIteratorAfter = 30 * time.Second
+
 type StreamConsumer struct {
-	client              *MinistreamClient
+	client              IConsumerClient
 	logger              *log.Logger
 	scanInterval        time.Duration
 	maxPullRecords      Size64
@@ -24,13 +33,49 @@ type StreamConsumer struct {
 	hasRecordsIterator  bool
 	mustStop            bool
 	Params              RecordsIteratorParams
-	StatusPause         bool
-	PauseDuration       time.Duration
 	WaitForBackPressure bool
 	BackPressure        *ExpBackoff
+	AdaptiveLimiter     *AdaptiveLimiter // optional (nil by default), slows down before the quota of the server is exhausted
+	RateLimiter         *RateLimiter     // optional, caps the rate of the requests and records received
 	RecordChannel       chan int
 	GetRecordsChunks    int
 	Handler             StreamConsumerHandler
+	Checkpoints         CheckpointStore // optional, persists the position of the consumer
+	CheckpointKey       string
+	hasPosition         bool
+	position            Checkpoint // last record processed
+	positionMu          sync.Mutex // the position is read by the lag monitor
+	redeliverAt         *MessageId // first record to deliver again when there is no position yet
+	lastDelivered       *MessageId // last record given to the handler, the iterator is recreated after it when there is no position yet
+	Workers             int        // number of workers processing the records concurrently (0 to disable)
+	PartitionKey        PartitionKeyExtractor
+	workerPool          *workerPool
+	PrefetchPages       int          // number of GetRecords responses fetched in advance (0 to disable)
+	Replay              *ReplayRange // optional, bounds the consumption
+	replayEndReached    bool
+	fatalError          *APIError // unrecoverable error which has stopped the consumption
+	metrics             consumerMetrics
+	// the server deletes the idle iterators, after a longer pause the iterator is recreated at the consumer position (0 to disable)
+	ResumeRecreateIteratorAfter time.Duration
+	pause                       consumerPause
+	LagRefreshInterval          time.Duration // period of the lag refresh while the consumer runs (0 to disable)
+	LagThreshold                LagThreshold
+	lag                         consumerLag
+	// Deprecated: read the pause state with GetPauseSatus and change it with Pause and Resume,
+	// the field mirrors the pause state but setting it has no effect.
+	StatusPause bool
+	// Deprecated: a paused consumer waits for Resume instead of polling every PauseDuration,
+	// the field has no effect (see ResumeRecreateIteratorAfter for the long pauses).
+	PauseDuration time.Duration
+}
+
+// consumerPause is the pause state, Pause and Resume are called from other goroutines.
+type consumerPause struct {
+	paused           bool
+	pausedAt         time.Time
+	resumed          chan struct{} // closed on resume
+	recreateIterator bool          // the iterator must be recreated after a long pause
+	mu               sync.Mutex
 }
 
 func CreateConsumer(ctx context.Context, streamUUID StreamUUID, handler StreamConsumerHandler, getRecordsChunks int) *StreamConsumer {
@@ -40,31 +85,266 @@ func CreateConsumer(ctx context.Context, streamUUID StreamUUID, handler StreamCo
 		getRecordsChunks = MaxPullRecordsByCall
 	}
 
+	logger := handler.GetLogger()
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
 	c := StreamConsumer{
 		client:              handler.GetClient(),
-		logger:              handler.GetLogger(),
+		logger:              logger,
 		scanInterval:        250 * time.Millisecond,
 		maxPullRecords:      MaxPullRecordsByCall,
 		streamUUID:          streamUUID,
 		isAuthenticated:     false,
 		hasRecordsIterator:  false,
 		mustStop:            false,
-		StatusPause:         false,
-		PauseDuration:       500 * time.Millisecond,
 		WaitForBackPressure: false,
-		BackPressure:        NewExpBackoff(ctx.Done(), time.Duration(200)*time.Millisecond, time.Duration(30)*time.Second),
+		BackPressure:        NewExponentialBackoff(time.Duration(200)*time.Millisecond, time.Duration(30)*time.Second),
 		Params:              RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage, MaxWaitTimeSeconds: nil},
 		GetRecordsChunks:    getRecordsChunks,
 		Handler:             handler,
+		CheckpointKey:       streamUUID.String(),
+
+		ResumeRecreateIteratorAfter: DefaultResumeRecreateIteratorAfter,
+		PauseDuration:               500 * time.Millisecond,
 	}
 	return &c
 }
 
+// SetBackoffStrategy changes how the delays grow while the server pushes back (e.g. with jitter).
+func (c *StreamConsumer) SetBackoffStrategy(strategy Strategy) {
+	c.BackPressure.SetStrategy(strategy)
+	c.BackPressure.Reset()
+}
+
+// SetRateLimiter caps the rate of the requests and records received by the consumer (nil to disable).
+func (c *StreamConsumer) SetRateLimiter(l *RateLimiter) {
+	c.RateLimiter = l
+}
+
+func (c *StreamConsumer) SetCheckpointStore(store CheckpointStore, key string) {
+	c.Checkpoints = store
+	if key != "" {
+		c.CheckpointKey = key
+	}
+}
+
+// GetPosition returns the last record processed by the consumer (false if none yet).
+func (c *StreamConsumer) GetPosition() (Checkpoint, bool) {
+	c.positionMu.Lock()
+	defer c.positionMu.Unlock()
+	return c.position, c.hasPosition
+}
+
+func (c *StreamConsumer) SetPosition(messageId MessageId, creationDate time.Time) {
+	c.positionMu.Lock()
+	defer c.positionMu.Unlock()
+	c.position = Checkpoint{StreamUUID: c.streamUUID, MessageId: messageId, CreationDate: creationDate, UpdatedAt: time.Now()}
+	c.hasPosition = true
+}
+
+// LoadCheckpoint restores the position of the consumer, it has no effect during a replay.
+func (c *StreamConsumer) LoadCheckpoint(ctx context.Context) *APIError {
+	if c.Checkpoints == nil || c.Replay != nil {
+		return nil
+	}
+
+	checkpoint, err := c.Checkpoints.LoadCheckpoint(ctx, c.CheckpointKey)
+	if err != nil {
+		return &APIError{Message: "can't load checkpoint", Details: err.Error(), StreamUUID: c.streamUUID}
+	}
+
+	if checkpoint != nil {
+		c.positionMu.Lock()
+		defer c.positionMu.Unlock()
+		c.position = *checkpoint
+		c.hasPosition = true
+	}
+	return nil
+}
+
+// SaveCheckpoint persists the position of the consumer, it has no effect during a replay.
+func (c *StreamConsumer) SaveCheckpoint(ctx context.Context) *APIError {
+	if c.Checkpoints == nil || c.Replay != nil || !c.hasPosition {
+		return nil
+	}
+
+	if err := c.Checkpoints.SaveCheckpoint(ctx, c.CheckpointKey, &c.position); err != nil {
+		return &APIError{Message: "can't save checkpoint", Details: err.Error(), StreamUUID: c.streamUUID}
+	}
+	return nil
+}
+
+// GetRecordsIteratorParams returns the handler parameters,
+// the start point is replaced by the replay range start if any,
+// and by the consumer position if it has one (resume after the last processed record).
+func (c *StreamConsumer) GetRecordsIteratorParams() *RecordsIteratorParams {
+	p := *c.Handler.GetRecordsIteratorParams()
+	if c.Replay != nil {
+		c.Replay.applyRecordsIteratorParams(&p)
+	}
+
+	if c.redeliverAt != nil && !c.hasPosition {
+		messageId := *c.redeliverAt
+		p.IteratorType = IteratorTypeAtMessageId
+		p.MessageId = &messageId
+		p.Timestamp = nil
+	} else if c.hasPosition {
+		messageId := c.position.MessageId
+		p.IteratorType = IteratorTypeAfterMessageId
+		p.MessageId = &messageId
+		p.Timestamp = nil
+	} else if c.lastDelivered != nil {
+		// the records given to the handler are being processed (they are not committed yet)
+		messageId := *c.lastDelivered
+		p.IteratorType = IteratorTypeAfterMessageId
+		p.MessageId = &messageId
+		p.Timestamp = nil
+	}
+	return &p
+}
+
+// updatePosition moves the position of the consumer after the last record of the response.
+func (c *StreamConsumer) updatePosition(ctx context.Context, response *GetStreamRecordsResponse) *APIError {
+	if len(response.Records) == 0 {
+		return nil
+	}
+
+	envelope, err := ParseRecordEnvelope(response.Records[len(response.Records)-1])
+	if err != nil {
+		return &APIError{Message: "can't read record envelope", Details: err.Error(), StreamUUID: c.streamUUID}
+	}
+
+	c.SetPosition(envelope.Id, envelope.CreationDate)
+	return c.SaveCheckpoint(ctx)
+}
+
+// handleRecordsWithAck gives the records to the handler and commits the contiguous acknowledged records.
+// return true if all the records have been acknowledged and the consumption must go on, false otherwise
+func (c *StreamConsumer) handleRecordsWithAck(ctx context.Context, handler StreamConsumerAckHandler, response *GetStreamRecordsResponse) bool {
+	ack := c.newRecordsAck(ctx, response)
+	if ack == nil {
+		return false
+	}
+
+	mustContinue := handler.OnGetRecordsToAck(response, ack)
+	return c.commitRecordsAck(ctx, ack, mustContinue)
+}
+
+// handleRecordsWithWorkerPool processes the records concurrently and commits them in stream order.
+func (c *StreamConsumer) handleRecordsWithWorkerPool(ctx context.Context, response *GetStreamRecordsResponse) bool {
+	ack := c.newRecordsAck(ctx, response)
+	if ack == nil {
+		return false
+	}
+
+	mustContinue := c.workerPool.process(ack)
+	return c.commitRecordsAck(ctx, ack, mustContinue)
+}
+
+func (c *StreamConsumer) newRecordsAck(ctx context.Context, response *GetStreamRecordsResponse) *RecordsAck {
+	envelopes, err := parseRecordEnvelopes(response.Records)
+	if err != nil {
+		if !c.Handler.OnUnexpectedError(&APIError{Message: "can't read record envelope", Details: err.Error(), StreamUUID: c.streamUUID}) {
+			c.mustStop = true
+		} else {
+			// the records have not been delivered, fetch them again with a new iterator
+			c.DropRecordsIterator(ctx)
+			c.WaitForBackPressure = true
+		}
+		return nil
+	}
+
+	if len(envelopes) > 0 {
+		messageId := envelopes[len(envelopes)-1].Id
+		c.lastDelivered = &messageId
+	}
+	return NewRecordsAck(envelopes)
+}
+
+// commitRecordsAck moves the position past the contiguous acknowledged records,
+// and asks for the redelivery of the remaining ones.
+func (c *StreamConsumer) commitRecordsAck(ctx context.Context, ack *RecordsAck, mustContinue bool) bool {
+	envelopes := ack.Envelopes()
+	cptCommitted := ack.CountCommitted()
+	if cptCommitted > 0 {
+		last := envelopes[cptCommitted-1]
+		c.SetPosition(last.Id, last.CreationDate)
+		if apiError := c.SaveCheckpoint(ctx); apiError != nil {
+			if !c.Handler.OnUnexpectedError(apiError) {
+				mustContinue = false
+			}
+		}
+	}
+
+	if !mustContinue {
+		c.mustStop = true
+		return false
+	}
+
+	if cptCommitted < len(envelopes) {
+		c.RedeliverFrom(ctx, envelopes[cptCommitted].Id)
+		return false
+	}
+
+	return true
+}
+
+// RedeliverFrom recreates the records iterator so that the records are delivered again,
+// starting after the consumer position (or at the given message id if the consumer has no position yet).
+func (c *StreamConsumer) RedeliverFrom(ctx context.Context, messageId MessageId) {
+	c.redeliverAt = &messageId
+	c.DropRecordsIterator(ctx)
+	// wait a little before the redelivery
+	c.WaitForBackPressure = true
+}
+
+// DropRecordsIterator closes the current records iterator (errors are ignored), a new one will be created.
+func (c *StreamConsumer) DropRecordsIterator(ctx context.Context) {
+	if c.streamIteratorUUID != uuid.Nil {
+		_ = c.client.CloseRecordsIterator(ctx, c.streamUUID, c.streamIteratorUUID)
+		c.streamIteratorUUID = uuid.Nil
+	}
+	c.hasRecordsIterator = false
+}
+
+// SetPrefetch enables the prefetching of pages: the next GetRecords call is issued while the handler is processing the current response.
+// At most pages responses are buffered, the prefetching is paused while the buffer is full.
+func (c *StreamConsumer) SetPrefetch(pages int) {
+	if pages < 0 {
+		pages = 0
+	}
+	c.PrefetchPages = pages
+}
+
+// SetWorkerPool enables the concurrent processing of the records,
+// the handler must implement StreamConsumerRecordHandler.
+// Records with the same partition key are processed in order (partitionKey may be nil).
+func (c *StreamConsumer) SetWorkerPool(workers int, partitionKey PartitionKeyExtractor) *APIError {
+	if workers > 0 {
+		if _, ok := c.Handler.(StreamConsumerRecordHandler); !ok {
+			return &APIError{Message: "the handler must implement StreamConsumerRecordHandler to use a worker pool"}
+		}
+	}
+
+	c.Workers = workers
+	c.PartitionKey = partitionKey
+	return nil
+}
+
 func (c *StreamConsumer) SetRecordsIteratorParams(p *RecordsIteratorParams) *APIError {
 	if err := p.Validate(); err != nil {
 		return err
 	}
 
+	if p.JqFilter != nil && *p.JqFilter != "" {
+		// catch the syntax errors before the server does
+		if err := jqfilter.Validate(*p.JqFilter); err != nil {
+			return &APIError{Message: "invalid jq filter", Details: err.Error(), StreamUUID: c.streamUUID}
+		}
+	}
+
 	c.Params = *p
 	return nil
 }
@@ -90,15 +370,78 @@ func (c *StreamConsumer) GetRecords(ctx context.Context, maxPullRecords int) (*G
 		return nil, nil, &APIError{Message: "streamIteratorUUID is not set, please create a stream iterator!"}
 	}
 
-	return c.client.GetRecords(ctx, c.streamUUID, c.streamIteratorUUID, maxPullRecords)
+	return c.fetchRecords(ctx, c.streamUUID, c.streamIteratorUUID, maxPullRecords)
+}
+
+// fetchRecords calls GetRecords once the limiters allow it.
+func (c *StreamConsumer) fetchRecords(ctx context.Context, streamUUID StreamUUID, streamIteratorUUID StreamIteratorUUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError) {
+	if c.AdaptiveLimiter != nil {
+		if err := c.AdaptiveLimiter.Wait(ctx); err != nil {
+			return nil, nil, APIErrorFromError(err)
+		}
+	}
+	if c.RateLimiter != nil {
+		if err := c.RateLimiter.WaitRequest(ctx); err != nil {
+			return nil, nil, APIErrorFromError(err)
+		}
+	}
+
+	response, httpResponse, apiError := c.client.GetRecords(ctx, streamUUID, streamIteratorUUID, maxPullRecords)
+	if c.AdaptiveLimiter != nil {
+		c.AdaptiveLimiter.Update(httpResponse)
+	}
+	if c.RateLimiter != nil {
+		// the records received slow down the next requests
+		c.RateLimiter.AddRecords(countRecords(response))
+	}
+	return response, httpResponse, apiError
 }
 
-func (c *StreamConsumer) Run(ctx context.Context) *APIError {
+// Run consumes the stream until ctx is canceled or the handler stops the consumption,
+// it returns the unrecoverable error which has stopped the consumption if any (see StreamConsumerFatalErrorHandler).
+func (c *StreamConsumer) Run(ctx context.Context) (apiError *APIError) {
 	c.isAuthenticated = false
 	c.hasRecordsIterator = false
+	c.fatalError = nil
+
+	defer func() {
+		// a panic of the handler must not crash the host process
+		if r := recover(); r != nil {
+			c.fatal(&APIError{Message: "consumer panic", Details: fmt.Sprint(r), StreamUUID: c.streamUUID})
+			_ = c.Close(ctx)
+			apiError = c.fatalError
+		}
+	}()
+
+	if handler, ok := c.Handler.(StreamConsumerCircuitBreakerHandler); ok {
+		if client, ok := c.client.(ICircuitBreakerClient); ok {
+			defer client.SubscribeCircuitBreaker(handler.OnCircuitBreakerStateChanged)()
+		}
+	}
 
 	c.Handler.OnStart()
 
+	if recordHandler, ok := c.Handler.(StreamConsumerRecordHandler); ok && c.Workers > 0 {
+		c.workerPool = newWorkerPool(c.Workers, recordHandler, c.PartitionKey)
+		defer func() {
+			c.workerPool.stop()
+			c.workerPool = nil
+		}()
+	}
+
+	if apiError := c.LoadCheckpoint(ctx); apiError != nil {
+		if !c.Handler.OnUnexpectedError(apiError) {
+			return c.close(ctx)
+		}
+	}
+
+	var stopLagMonitor func()
+	defer func() {
+		if stopLagMonitor != nil {
+			stopLagMonitor()
+		}
+	}()
+
 	for {
 		if !c.EnsureIsAuthenticated(ctx) {
 			if c.mustStop {
@@ -108,6 +451,11 @@ func (c *StreamConsumer) Run(ctx context.Context) *APIError {
 			}
 		}
 
+		if stopLagMonitor == nil {
+			// the stream information is fetched with the token of the consumer
+			stopLagMonitor = c.startLagMonitor(ctx)
+		}
+
 		if !c.EnsureHasRecordsIterator(ctx) {
 			if c.mustStop {
 				break
@@ -125,7 +473,26 @@ func (c *StreamConsumer) Run(ctx context.Context) *APIError {
 		}
 	}
 
-	return c.Close(ctx)
+	return c.close(ctx)
+}
+
+// close closes the consumer, it returns the unrecoverable error which has stopped the consumption if any.
+func (c *StreamConsumer) close(ctx context.Context) *APIError {
+	apiError := c.Close(ctx)
+	if c.fatalError != nil {
+		return c.fatalError
+	}
+	return apiError
+}
+
+// fatal stops the consumption on an unrecoverable error.
+func (c *StreamConsumer) fatal(apiError *APIError) {
+	c.fatalError = apiError
+	c.mustStop = true
+	c.logger.Printf("StreamConsumer: fatal error: %s\n", apiError.ToJson())
+	if fatalErrorHandler, ok := c.Handler.(StreamConsumerFatalErrorHandler); ok {
+		fatalErrorHandler.OnFatalError(apiError)
+	}
 }
 
 func (c *StreamConsumer) EnsureIsAuthenticated(ctx context.Context) bool {
@@ -139,7 +506,7 @@ func (c *StreamConsumer) EnsureIsAuthenticated(ctx context.Context) bool {
 			c.mustStop = true
 			return false
 		} else {
-			if !c.Handler.OnAuthenticationFailure(apiError) || !c.BackPressure.Wait() {
+			if !c.Handler.OnAuthenticationFailure(apiError) || c.BackPressure.Wait(ctx) != nil {
 				c.mustStop = true
 			}
 			return false
@@ -158,7 +525,7 @@ func (c *StreamConsumer) EnsureHasRecordsIterator(ctx context.Context) bool {
 		return true
 	}
 
-	if apiError := c.CreateRecordsIterator(ctx, c.Handler.GetRecordsIteratorParams()); apiError != nil {
+	if apiError := c.CreateRecordsIterator(ctx, c.GetRecordsIteratorParams()); apiError != nil {
 		if ctx.Err() != nil {
 			c.mustStop = true
 			return false
@@ -169,7 +536,7 @@ func (c *StreamConsumer) EnsureHasRecordsIterator(ctx context.Context) bool {
 				return false
 			}
 
-			if !c.Handler.OnCreateRecordsIteratorFailure(apiError) || !c.BackPressure.Wait() {
+			if !c.Handler.OnCreateRecordsIteratorFailure(apiError) || c.BackPressure.Wait(ctx) != nil {
 				c.mustStop = true
 			}
 			return false
@@ -177,6 +544,7 @@ func (c *StreamConsumer) EnsureHasRecordsIterator(ctx context.Context) bool {
 	} else {
 		c.Handler.OnCreateRecordsIteratorSuccess()
 		c.hasRecordsIterator = true
+		c.redeliverAt = nil
 		c.BackPressure.Reset()
 		return true
 	}
@@ -184,21 +552,24 @@ func (c *StreamConsumer) EnsureHasRecordsIterator(ctx context.Context) bool {
 
 func (c *StreamConsumer) Consume(ctx context.Context) bool {
 	// return true if success, false otherwise
+	if c.PrefetchPages > 0 || c.workerPool != nil {
+		// fetch the next pages while the current one is being processed
+		return c.ConsumeWithPrefetch(ctx, c.PrefetchPages)
+	}
+
 	for {
 		if ctx.Err() != nil {
 			c.mustStop = true
 			return false
 		}
 
-		if c.StatusPause {
-			// the consumer is paused
-			time.Sleep(c.PauseDuration)
-			continue
+		if !c.waitWhilePaused(ctx) {
+			return false
 		}
 
 		if c.WaitForBackPressure {
 			// handle backpressure
-			if !c.BackPressure.Wait() {
+			if c.BackPressure.Wait(ctx) != nil {
 				// a cancel event occurred during the wait
 				c.mustStop = true
 				return false
@@ -211,8 +582,66 @@ func (c *StreamConsumer) Consume(ctx context.Context) bool {
 	}
 }
 
+// ConsumeWithPrefetch is like Consume but GetRecords is called in the background,
+// up to depth responses are buffered while the handler is processing the records.
+func (c *StreamConsumer) ConsumeWithPrefetch(ctx context.Context, depth int) bool {
+	// return true if success, false otherwise
+	if c.WaitForBackPressure {
+		// handle backpressure (previous error)
+		if c.BackPressure.Wait(ctx) != nil {
+			// a cancel event occurred during the wait
+			c.mustStop = true
+			return false
+		}
+		c.WaitForBackPressure = false
+	}
+
+	pf := c.startPrefetcher(ctx, depth)
+	defer func() {
+		if pf.stop(&c.metrics) && !c.mustStop {
+			// the records fetched in advance are lost, create a new iterator at the consumer position
+			c.DropRecordsIterator(ctx)
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			c.mustStop = true
+			return false
+		}
+
+		if !c.waitWhilePaused(ctx) {
+			return false
+		}
+
+		result, ok := pf.next(ctx, &c.metrics)
+		if !ok {
+			c.mustStop = true
+			return false
+		}
+
+		if !c.HandleGetRecordsResult(ctx, result.response, result.apiError) {
+			return false
+		}
+	}
+}
+
 func (c *StreamConsumer) Poll(ctx context.Context) bool {
-	if response, httpResponse, apiError := c.GetRecords(ctx, c.GetRecordsChunks); apiError != nil {
+	fetchStartTime := time.Now()
+	response, httpResponse, apiError := c.GetRecords(ctx, c.GetRecordsChunks)
+	c.metrics.addFetch(time.Since(fetchStartTime), countRecords(response), apiError != nil)
+	if !c.HandleGetRecordsResult(ctx, response, apiError) {
+		return false
+	}
+
+	c.updateBackPressure(response, httpResponse)
+	return true
+}
+
+// HandleGetRecordsResult gives the result of a GetRecords call to the handler.
+// return true if success and the consumption must go on, false otherwise
+func (c *StreamConsumer) HandleGetRecordsResult(ctx context.Context, response *GetStreamRecordsResponse, apiError *APIError) bool {
+	if apiError != nil {
 		if !c.Handler.OnGetRecordsFailure(apiError) {
 			c.mustStop = true
 			return false
@@ -229,20 +658,24 @@ func (c *StreamConsumer) Poll(ctx context.Context) bool {
 				// need to recreate a stream iterator
 				c.hasRecordsIterator = false
 			}
-		case ErrorStreamIteratorIsBusy:
+		case ErrorStreamIteratorIsBusy, ErrorTooManyRequests, ErrorCircuitBreakerOpen:
 			{
-				// retry later
+				// retry later (the adaptive limiter waits for the Retry-After delay)
 				c.WaitForBackPressure = true
 			}
-		case ErrorHTTPTimeout:
+		case ErrorHTTPTimeout, ErrorContextDeadlineExceeded, ErrorTransportReadFromServerError:
 			{
+				// the response is lost but the server may have moved the iterator forward,
+				// recreate the iterator at the consumer position so that no record is skipped
+				if ctx.Err() == nil {
+					c.DropRecordsIterator(ctx)
+				}
 				// retry later
 				c.WaitForBackPressure = true
 			}
 		case ErrorCantGetMessagesFromStream:
 			{
-				c.mustStop = true
-				c.logger.Panicf("Poll: ErrorCantGetMessagesFromStream: %s\n", apiError.ToJson())
+				c.fatal(apiError)
 			}
 		default:
 			if !c.Handler.OnUnexpectedError(apiError) {
@@ -257,45 +690,190 @@ func (c *StreamConsumer) Poll(ctx context.Context) bool {
 		return false
 	} else {
 		// success
-		// response is handled by the handler
-		if !c.Handler.OnGetRecordsSuccess(response) {
+		processStartTime := time.Now()
+		defer func() { c.metrics.addProcess(time.Since(processStartTime)) }()
+
+		response, endReached, apiError := c.applyReplayRange(response)
+		if apiError != nil {
+			if !c.Handler.OnUnexpectedError(apiError) {
+				c.mustStop = true
+			} else {
+				// the records have not been delivered, fetch them again with a new iterator
+				c.DropRecordsIterator(ctx)
+				c.WaitForBackPressure = true
+			}
+			return false
+		}
+
+		if !c.handleRecords(ctx, response) {
+			return false
+		}
+
+		if endReached {
+			// the end of the replay range is reached, stop the consumption
+			c.replayEndReached = true
 			c.mustStop = true
 			return false
 		}
 
-		// handle back pressure
-		if response.Remain {
-			rateLimit := RateLimitFromHttpResponse(httpResponse)
-			if rateLimit.RetryAfter > 0 {
-				c.WaitForBackPressure = true
-			} else {
-				if c.WaitForBackPressure {
-					c.WaitForBackPressure = false
-					c.BackPressure.Reset()
-				}
-			}
-		} else {
-			// preventive action: stream don't have any new records yet
-			c.WaitForBackPressure = true
+		return true
+	}
+}
+
+// handleRecords gives the records to the handler (or to the worker pool).
+// return true if success and the consumption must go on, false otherwise
+func (c *StreamConsumer) handleRecords(ctx context.Context, response *GetStreamRecordsResponse) bool {
+	if c.workerPool != nil {
+		// the records are processed by the workers and acknowledged one by one
+		return c.handleRecordsWithWorkerPool(ctx, response)
+	}
+
+	if ackHandler, ok := c.Handler.(StreamConsumerAckHandler); ok {
+		// the handler acknowledges the records explicitly
+		return c.handleRecordsWithAck(ctx, ackHandler, response)
+	}
+
+	if len(response.Records) > 0 {
+		if envelope, err := ParseRecordEnvelope(response.Records[len(response.Records)-1]); err == nil {
+			messageId := envelope.Id
+			c.lastDelivered = &messageId
+		}
+	}
+
+	// response is handled by the handler
+	mustContinue := c.Handler.OnGetRecordsSuccess(response)
+
+	// the records have been processed, even if the handler has decided to stop the consumption
+	if apiError := c.updatePosition(ctx, response); apiError != nil {
+		if !c.Handler.OnUnexpectedError(apiError) {
+			mustContinue = false
 		}
+	}
 
+	if !mustContinue {
+		c.mustStop = true
+		return false
+	}
+
+	return true
+}
+
+func (c *StreamConsumer) updateBackPressure(response *GetStreamRecordsResponse, httpResponse *http.Response) {
+	if mustWaitForBackPressure(response, httpResponse) {
+		c.WaitForBackPressure = true
+	} else if c.WaitForBackPressure {
+		c.WaitForBackPressure = false
+		c.BackPressure.Reset()
+	}
+}
+
+func mustWaitForBackPressure(response *GetStreamRecordsResponse, httpResponse *http.Response) bool {
+	if !response.Remain {
+		// preventive action: stream don't have any new records yet
 		return true
 	}
+
+	if httpResponse == nil {
+		return false
+	}
+
+	rateLimit := RateLimitFromHttpResponse(httpResponse)
+	return rateLimit.RetryAfterDuration > 0
+}
+
+// Metrics returns the time spent fetching vs processing the records, it is safe for concurrent use.
+func (c *StreamConsumer) Metrics() ConsumerMetrics {
+	return c.metrics.snapshot()
 }
 
+// Pause stops fetching records until Resume is called (the current response is processed), it is safe for concurrent use.
 func (c *StreamConsumer) Pause() {
-	c.Handler.OnPause()
+	c.pause.mu.Lock()
+	if c.pause.paused {
+		c.pause.mu.Unlock()
+		return
+	}
+	c.pause.paused = true
+	c.pause.pausedAt = time.Now()
+	c.pause.resumed = make(chan struct{})
 	c.StatusPause = true
+	c.pause.mu.Unlock()
+
+	// the handler may call the pause methods
+	c.Handler.OnPause()
 }
 
+// Resume restarts fetching records, it is safe for concurrent use.
+// After a pause longer than ResumeRecreateIteratorAfter the iterator is recreated at the consumer position
+// (or after the last record given to the handler if none has been committed yet),
+// because the server may have deleted it.
 func (c *StreamConsumer) Resume() {
-	c.Handler.OnResume()
+	c.pause.mu.Lock()
+	if !c.pause.paused {
+		c.pause.mu.Unlock()
+		return
+	}
+	c.pause.paused = false
+	if c.ResumeRecreateIteratorAfter > 0 && time.Since(c.pause.pausedAt) >= c.ResumeRecreateIteratorAfter {
+		c.pause.recreateIterator = true
+	}
+	resumed := c.pause.resumed
 	c.StatusPause = false
-	c.WaitForBackPressure = false
+	c.pause.mu.Unlock()
+
+	// the handler may call the pause methods, the consumption restarts once it is notified
+	c.Handler.OnResume()
+	close(resumed)
 }
 
 func (c *StreamConsumer) GetPauseSatus() bool {
-	return c.StatusPause
+	c.pause.mu.Lock()
+	defer c.pause.mu.Unlock()
+
+	return c.pause.paused
+}
+
+// waitForResume blocks while the consumer is paused, it returns false if ctx is canceled.
+func (c *StreamConsumer) waitForResume(ctx context.Context) bool {
+	c.pause.mu.Lock()
+	paused, resumed := c.pause.paused, c.pause.resumed
+	c.pause.mu.Unlock()
+
+	if !paused {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// waitWhilePaused blocks while the consumer is paused.
+// return false if the consumption must be interrupted (canceled, or the iterator must be recreated)
+func (c *StreamConsumer) waitWhilePaused(ctx context.Context) bool {
+	if c.GetPauseSatus() {
+		if !c.waitForResume(ctx) {
+			c.mustStop = true
+			return false
+		}
+		// don't wait for the back pressure of the requests made before the pause
+		c.WaitForBackPressure = false
+		c.BackPressure.Reset()
+	}
+
+	c.pause.mu.Lock()
+	recreateIterator := c.pause.recreateIterator
+	c.pause.recreateIterator = false
+	c.pause.mu.Unlock()
+
+	if recreateIterator {
+		// the iterator has probably been deleted by the server, create a new one at the consumer position
+		c.DropRecordsIterator(ctx)
+		return false
+	}
+	return true
 }
 
 func (c *StreamConsumer) Close(ctx context.Context) *APIError {
@@ -308,5 +886,12 @@ func (c *StreamConsumer) Close(ctx context.Context) *APIError {
 	}()
 	defer c.client.Disconnect()
 
+	if ctx.Err() != nil {
+		// the consumer has been stopped by the context, give the iterator a chance to be closed on the server side
+		ctxClose, cancel := context.WithTimeout(context.Background(), CloseRecordsIteratorTimeout)
+		defer cancel()
+		ctx = ctxClose
+	}
+
 	return c.client.CloseRecordsIterator(ctx, c.streamUUID, c.streamIteratorUUID)
 }
@@ -0,0 +1,1002 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+	"github.com/nbigot/ministream-client-go/ministreamtest"
+)
+
+func newTestConsumer(ctx context.Context, handler StreamConsumerHandler) *StreamConsumer {
+	c := CreateConsumer(ctx, uuid.New(), handler, 100)
+	c.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+	return c
+}
+
+func TestRunStateTransitions(t *testing.T) {
+	tests := []struct {
+		name               string
+		client             *MockConsumerClient
+		stopOnCptRecords   int
+		continueOnFailure  bool
+		expectedEvents     []string
+		expectedCalls      []string
+		expectedMessageIds []MessageId
+	}{
+		{
+			name: "consume until the handler stops",
+			client: &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(1, 10, true)},
+				{Response: NewMockGetRecordsResponse(11, 10, false)},
+			}},
+			stopOnCptRecords:  20,
+			continueOnFailure: true,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationSuccess", "OnCreateRecordsIteratorSuccess",
+				"OnGetRecordsSuccess", "OnGetRecordsSuccess", "OnClose",
+			},
+			expectedCalls:      []string{"Authenticate", "CreateRecordsIterator", "GetRecords", "GetRecords", "CloseRecordsIterator", "Disconnect"},
+			expectedMessageIds: ministreamtest.MessageIds(1, 20),
+		},
+		{
+			name:              "authentication failure stops the consumer",
+			client:            &MockConsumerClient{AuthenticateErrors: []*APIError{{Code: ErrorWrongCredentials}}},
+			stopOnCptRecords:  1,
+			continueOnFailure: false,
+			expectedEvents:    []string{"OnStart", "OnAuthenticationFailure", "OnClose"},
+			expectedCalls:     []string{"Authenticate"},
+		},
+		{
+			name: "authentication is retried",
+			client: &MockConsumerClient{
+				AuthenticateErrors: []*APIError{{Code: ErrorHTTPTimeout}, {Code: ErrorHTTPTimeout}},
+				GetRecordsResults:  []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(1, 5, false)}},
+			},
+			stopOnCptRecords:  5,
+			continueOnFailure: true,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationFailure", "OnAuthenticationFailure", "OnAuthenticationSuccess",
+				"OnCreateRecordsIteratorSuccess", "OnGetRecordsSuccess", "OnClose",
+			},
+			expectedCalls:      []string{"Authenticate", "Authenticate", "Authenticate", "CreateRecordsIterator", "GetRecords", "CloseRecordsIterator", "Disconnect"},
+			expectedMessageIds: ministreamtest.MessageIds(1, 5),
+		},
+		{
+			name: "token expired while creating the iterator",
+			client: &MockConsumerClient{
+				CreateRecordsIteratorErrors: []*APIError{{Code: ErrorJWTInvalidOrExpired}},
+				GetRecordsResults:           []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(1, 5, false)}},
+			},
+			stopOnCptRecords:  5,
+			continueOnFailure: true,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationSuccess", "OnAuthenticationSuccess",
+				"OnCreateRecordsIteratorSuccess", "OnGetRecordsSuccess", "OnClose",
+			},
+			expectedCalls:      []string{"Authenticate", "CreateRecordsIterator", "Authenticate", "CreateRecordsIterator", "GetRecords", "CloseRecordsIterator", "Disconnect"},
+			expectedMessageIds: ministreamtest.MessageIds(1, 5),
+		},
+		{
+			name: "token expired while getting records",
+			client: &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(1, 5, true)},
+				{Error: &APIError{Code: ErrorJWTInvalidOrExpired}},
+				{Response: NewMockGetRecordsResponse(6, 5, false)},
+			}},
+			stopOnCptRecords:  10,
+			continueOnFailure: true,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationSuccess", "OnCreateRecordsIteratorSuccess", "OnGetRecordsSuccess",
+				"OnGetRecordsFailure", "OnAuthenticationSuccess", "OnGetRecordsSuccess", "OnClose",
+			},
+			expectedCalls: []string{
+				"Authenticate", "CreateRecordsIterator", "GetRecords", "GetRecords",
+				"Authenticate", "GetRecords", "CloseRecordsIterator", "Disconnect",
+			},
+			expectedMessageIds: ministreamtest.MessageIds(1, 10),
+		},
+		{
+			name: "iterator not found is recreated",
+			client: &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(1, 5, true)},
+				{Error: &APIError{Code: ErrorStreamIteratorNotFound}},
+				{Response: NewMockGetRecordsResponse(6, 5, false)},
+			}},
+			stopOnCptRecords:  10,
+			continueOnFailure: true,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationSuccess", "OnCreateRecordsIteratorSuccess", "OnGetRecordsSuccess",
+				"OnGetRecordsFailure", "OnCreateRecordsIteratorSuccess", "OnGetRecordsSuccess", "OnClose",
+			},
+			expectedCalls: []string{
+				"Authenticate", "CreateRecordsIterator", "GetRecords", "GetRecords",
+				"CreateRecordsIterator", "GetRecords", "CloseRecordsIterator", "Disconnect",
+			},
+			expectedMessageIds: ministreamtest.MessageIds(1, 10),
+		},
+		{
+			name: "unexpected error stops the consumer",
+			client: &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Error: &APIError{Code: ErrorRBACForbidden}},
+			}},
+			stopOnCptRecords:  10,
+			continueOnFailure: false,
+			expectedEvents: []string{
+				"OnStart", "OnAuthenticationSuccess", "OnCreateRecordsIteratorSuccess", "OnGetRecordsFailure", "OnClose",
+			},
+			expectedCalls: []string{"Authenticate", "CreateRecordsIterator", "GetRecords", "CloseRecordsIterator", "Disconnect"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			handler := NewMockConsumerHandler(tt.client, tt.stopOnCptRecords)
+			handler.ContinueOnFailure = tt.continueOnFailure
+			consumer := newTestConsumer(ctx, handler)
+			if err := consumer.Run(ctx); err != nil {
+				t.Errorf("Run() = %v, want %v", err, nil)
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("Run() did not stop before the timeout")
+			}
+
+			if events := handler.GetEvents(); !reflect.DeepEqual(events, tt.expectedEvents) {
+				t.Errorf("events = %v, want %v", events, tt.expectedEvents)
+			}
+			if !reflect.DeepEqual(tt.client.Calls, tt.expectedCalls) {
+				t.Errorf("calls = %v, want %v", tt.client.Calls, tt.expectedCalls)
+			}
+			if ids := handler.GetMessageIds(); len(ids) > 0 || len(tt.expectedMessageIds) > 0 {
+				if !reflect.DeepEqual(ids, tt.expectedMessageIds) {
+					t.Errorf("message ids = %v, want %v", ids, tt.expectedMessageIds)
+				}
+			}
+		})
+	}
+}
+
+func TestRunRecreatesIteratorAfterLastMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 5, true)},
+		{Error: &APIError{Code: ErrorStreamIteratorNotFound}},
+		{Response: NewMockGetRecordsResponse(6, 5, false)},
+	}}
+	handler := NewMockConsumerHandler(client, 10)
+	consumer := newTestConsumer(ctx, handler)
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if len(client.IteratorParams) != 2 {
+		t.Fatalf("len(IteratorParams) = %v, want %v", len(client.IteratorParams), 2)
+	}
+	if client.IteratorParams[0].IteratorType != IteratorTypeFirstMessage {
+		t.Errorf("IteratorParams[0].IteratorType = %v, want %v", client.IteratorParams[0].IteratorType, IteratorTypeFirstMessage)
+	}
+	params := client.IteratorParams[1]
+	if params.IteratorType != IteratorTypeAfterMessageId || params.MessageId == nil || *params.MessageId != 5 {
+		t.Errorf("IteratorParams[1] = %+v, want AFTER_MESSAGE_ID 5", params)
+	}
+}
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(42, 3, false)},
+	}}
+	handler := NewMockConsumerHandler(client, 3)
+	consumer := newTestConsumer(ctx, handler)
+
+	store := NewMemoryCheckpointStore()
+	if err := store.SaveCheckpoint(ctx, "my-consumer", &Checkpoint{MessageId: 41}); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	consumer.SetCheckpointStore(store, "my-consumer")
+
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	params := client.IteratorParams[0]
+	if params.IteratorType != IteratorTypeAfterMessageId || params.MessageId == nil || *params.MessageId != 41 {
+		t.Errorf("IteratorParams[0] = %+v, want AFTER_MESSAGE_ID 41", params)
+	}
+
+	checkpoint, _ := store.LoadCheckpoint(ctx, "my-consumer")
+	if checkpoint == nil || checkpoint.MessageId != 44 {
+		t.Errorf("LoadCheckpoint() = %+v, want message id 44", checkpoint)
+	}
+}
+
+type mockAckHandler struct {
+	*MockConsumerHandler
+	nackOnce map[MessageId]bool
+}
+
+func (h *mockAckHandler) OnGetRecordsToAck(response *GetStreamRecordsResponse, ack *RecordsAck) bool {
+	h.addEvent("OnGetRecordsToAck")
+	for _, envelope := range ack.Envelopes() {
+		if h.nackOnce[envelope.Id] {
+			delete(h.nackOnce, envelope.Id)
+			ack.Nack(envelope.Id)
+			continue
+		}
+		ack.Ack(envelope.Id)
+		h.mu.Lock()
+		h.MessageIds = append(h.MessageIds, envelope.Id)
+		h.mu.Unlock()
+	}
+	return len(h.GetMessageIds()) < h.StopOnCptRecords
+}
+
+func TestRunRedeliversUnacknowledgedRecords(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 5, true)},
+		{Response: NewMockGetRecordsResponse(3, 3, false)},
+	}}
+	handler := &mockAckHandler{MockConsumerHandler: NewMockConsumerHandler(client, 6), nackOnce: map[MessageId]bool{3: true}}
+	consumer := newTestConsumer(ctx, handler)
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if client.CountCalls("CreateRecordsIterator") != 2 {
+		t.Fatalf("CreateRecordsIterator calls = %v, want %v", client.CountCalls("CreateRecordsIterator"), 2)
+	}
+	params := client.IteratorParams[1]
+	if params.IteratorType != IteratorTypeAfterMessageId || *params.MessageId != 2 {
+		t.Errorf("IteratorParams[1] = %+v, want AFTER_MESSAGE_ID 2", params)
+	}
+
+	// records 4 and 5 have been acked after the nacked record 3, they are delivered again
+	expected := []MessageId{1, 2, 4, 5, 3, 4, 5}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("message ids = %v, want %v", ids, expected)
+	}
+	if position, ok := consumer.GetPosition(); !ok || position.MessageId != 5 {
+		t.Errorf("GetPosition() = %v, %v, want message id 5", position, ok)
+	}
+}
+
+func TestRunRecreatesIteratorAfterUnreadableRecords(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the server has moved the iterator past the records which can't be read
+	malformed := NewMockGetRecordsResponse(1, 5, true)
+	delete(malformed.Records[2].(map[string]interface{}), "i")
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: malformed},
+		{Response: NewMockGetRecordsResponse(1, 5, true)},
+		{Response: NewMockGetRecordsResponse(6, 5, false)},
+	}}
+	handler := &mockAckHandler{MockConsumerHandler: NewMockConsumerHandler(client, 10)}
+	consumer := newTestConsumer(ctx, handler)
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if client.CountCalls("CreateRecordsIterator") != 2 {
+		t.Fatalf("CreateRecordsIterator calls = %v, want %v", client.CountCalls("CreateRecordsIterator"), 2)
+	}
+	// none of the records has been delivered, the new iterator starts at the beginning
+	if params := client.IteratorParams[1]; params.IteratorType != IteratorTypeFirstMessage {
+		t.Errorf("IteratorParams[1] = %+v, want FIRST_MESSAGE", params)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 10)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 10))
+	}
+}
+
+type mockRecordHandler struct {
+	*MockConsumerHandler
+	processed map[MessageId]int
+	mu        sync.Mutex
+}
+
+func (h *mockRecordHandler) OnRecord(envelope *ResponseRecordEnvelope) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.processed[envelope.Id]++
+	if len(h.processed) >= h.StopOnCptRecords {
+		return ErrStopConsuming
+	}
+	return nil
+}
+
+func TestRunWithWorkerPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 100, true)},
+		{Response: NewMockGetRecordsResponse(101, 100, true)},
+		{Response: NewMockGetRecordsResponse(201, 100, false)},
+	}}
+	handler := &mockRecordHandler{MockConsumerHandler: NewMockConsumerHandler(client, 300), processed: make(map[MessageId]int)}
+	consumer := newTestConsumer(ctx, handler)
+	if err := consumer.SetWorkerPool(4, nil); err != nil {
+		t.Fatalf("SetWorkerPool() = %v", err)
+	}
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if len(handler.processed) != 300 {
+		t.Errorf("len(processed) = %v, want %v", len(handler.processed), 300)
+	}
+	for id, cpt := range handler.processed {
+		if cpt != 1 {
+			t.Errorf("record %d processed %d times", id, cpt)
+		}
+	}
+
+	metrics := consumer.Metrics()
+	if metrics.FetchCount < 3 || metrics.RecordsCount < 300 {
+		t.Errorf("Metrics() = %+v", metrics)
+	}
+}
+
+func TestSetWorkerPoolRequiresRecordHandler(t *testing.T) {
+	consumer := newTestConsumer(context.Background(), NewMockConsumerHandler(NewMockConsumerClient(), 0))
+	if err := consumer.SetWorkerPool(2, nil); err == nil {
+		t.Errorf("SetWorkerPool() must fail when the handler does not implement StreamConsumerRecordHandler")
+	}
+}
+
+func TestPullConsumer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 5, true)},
+		{Response: NewMockGetRecordsResponse(6, 5, true)},
+	}}
+	consumer := NewPullConsumer(ctx, client, uuid.New(), nil, 100, nil)
+	consumer.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+
+	ids := make([]MessageId, 0)
+	consumer.All(ctx)(func(envelope Envelope, err error) bool {
+		if err != nil {
+			t.Fatalf("All() error = %v", err)
+		}
+		ids = append(ids, envelope.Id)
+		return len(ids) < 7
+	})
+
+	if !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 7)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 7))
+	}
+	if position, ok := consumer.GetPosition(); !ok || position.MessageId != 7 {
+		t.Errorf("GetPosition() = %v, %v, want message id 7", position, ok)
+	}
+	if consumer.Err() != nil {
+		t.Errorf("Err() = %v, want nil", consumer.Err())
+	}
+}
+
+func TestPullConsumerCommitsYieldedRecords(t *testing.T) {
+	// the records received by All after the iteration is stopped are not committed
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		store := NewMemoryCheckpointStore()
+		client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(1, 10, true)}}}
+		consumer := NewPullConsumer(ctx, client, uuid.New(), nil, 100, nil)
+		consumer.SetCheckpointStore(store, "pull")
+
+		cpt := 0
+		consumer.All(ctx)(func(envelope Envelope, err error) bool {
+			cpt++
+			return cpt < 3
+		})
+
+		checkpoint, err := store.LoadCheckpoint(ctx, "pull")
+		if err != nil || checkpoint == nil || checkpoint.MessageId != 3 {
+			t.Fatalf("LoadCheckpoint() = %v, %v, want message id 3", checkpoint, err)
+		}
+
+		// the next consumption starts after the last record yielded
+		client.GetRecordsResults = []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(4, 7, true)}}
+		ids := make([]MessageId, 0)
+		consumer.All(ctx)(func(envelope Envelope, err error) bool {
+			ids = append(ids, envelope.Id)
+			return len(ids) < 7
+		})
+		if !reflect.DeepEqual(ids, ministreamtest.MessageIds(4, 10)) {
+			t.Fatalf("message ids = %v, want %v", ids, ministreamtest.MessageIds(4, 10))
+		}
+		if params := client.IteratorParams[1]; params.IteratorType != IteratorTypeAfterMessageId || *params.MessageId != 3 {
+			t.Fatalf("IteratorParams[1] = %v, want the iterator after message id 3", params)
+		}
+	}
+}
+
+func TestPullConsumerError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{AuthenticateErrors: []*APIError{{Code: ErrorWrongCredentials}}}
+	consumer := NewPullConsumer(ctx, client, uuid.New(), nil, 100, nil)
+
+	cpt := 0
+	for range consumer.Records(ctx) {
+		cpt++
+	}
+	if cpt != 0 {
+		t.Errorf("received %d records, want 0", cpt)
+	}
+
+	var apiError *APIError
+	if err := consumer.Err(); err == nil {
+		t.Fatalf("Err() = nil, want an error")
+	} else if apiError = err.(*APIError); apiError.Code != ErrorWrongCredentials {
+		t.Errorf("Err() = %v, want code %d", err, ErrorWrongCredentials)
+	}
+}
+
+func TestRunRecreatesIteratorAfterLostResponse(t *testing.T) {
+	// the server may have moved the iterator forward before the response was lost,
+	// the iterator is recreated after the last record processed so that no record is skipped
+	tests := []struct {
+		name string
+		code int
+	}{
+		{name: "http timeout", code: ErrorHTTPTimeout},
+		{name: "client timeout", code: ErrorContextDeadlineExceeded},
+		{name: "dropped connection", code: ErrorTransportReadFromServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(1, 3, true)},
+				{Error: &APIError{Code: tt.code, Message: "response lost"}},
+				{Response: NewMockGetRecordsResponse(4, 3, true)},
+			}}
+			handler := NewMockConsumerHandler(client, 6)
+			consumer := newTestConsumer(ctx, handler)
+			if err := consumer.Run(ctx); err != nil {
+				t.Fatalf("Run() = %v, want %v", err, nil)
+			}
+
+			if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 6)) {
+				t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 6))
+			}
+			if cpt := client.CountCalls("CreateRecordsIterator"); cpt != 2 {
+				t.Fatalf("CreateRecordsIterator calls = %d, want %d", cpt, 2)
+			}
+			if params := client.IteratorParams[1]; params.IteratorType != IteratorTypeAfterMessageId || *params.MessageId != 3 {
+				t.Errorf("IteratorParams[1] = %v %v, want %v 3", params.IteratorType, *params.MessageId, IteratorTypeAfterMessageId)
+			}
+		})
+	}
+}
+
+func TestRunStopsAtReplayRangeEnd(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 10, 0, time.UTC)
+	tests := []struct {
+		name               string
+		replay             *ReplayRange
+		expectedParams     RecordsIteratorParams
+		expectedMessageIds []MessageId
+	}{
+		{
+			name:               "message id range",
+			replay:             NewMessageIdReplayRange(10, 17),
+			expectedParams:     RecordsIteratorParams{IteratorType: IteratorTypeAtMessageId},
+			expectedMessageIds: ministreamtest.MessageIds(10, 17),
+		},
+		{
+			name:   "time range",
+			replay: NewTimeReplayRange(start, start.Add(12*time.Second)),
+			// the mock records are created one second apart (see NewMockGetRecordsResponse)
+			expectedParams:     RecordsIteratorParams{IteratorType: IteratorTypeAtTimestamp},
+			expectedMessageIds: ministreamtest.MessageIds(10, 22),
+		},
+		{
+			name:               "end past the last record",
+			replay:             NewMessageIdReplayRange(10, 100),
+			expectedParams:     RecordsIteratorParams{IteratorType: IteratorTypeAtMessageId},
+			expectedMessageIds: ministreamtest.MessageIds(10, 29),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(10, 5, true)},
+				{Response: NewMockGetRecordsResponse(15, 5, true)},
+				{Response: NewMockGetRecordsResponse(20, 5, true)},
+				{Response: NewMockGetRecordsResponse(25, 5, true)},
+			}}
+			handler := NewMockConsumerHandler(client, 0)
+			consumer := newTestConsumer(ctx, handler)
+			if err := consumer.SetReplayRange(tt.replay); err != nil {
+				t.Fatalf("SetReplayRange() = %v", err)
+			}
+			if err := consumer.Run(ctx); err != nil {
+				t.Fatalf("Run() = %v, want %v", err, nil)
+			}
+
+			if !consumer.ReplayEndReached() {
+				t.Errorf("ReplayEndReached() = false, want true")
+			}
+			if params := client.IteratorParams[0]; params.IteratorType != tt.expectedParams.IteratorType {
+				t.Errorf("IteratorParams[0].IteratorType = %v, want %v", params.IteratorType, tt.expectedParams.IteratorType)
+			}
+			if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, tt.expectedMessageIds) {
+				t.Errorf("message ids = %v, want %v", ids, tt.expectedMessageIds)
+			}
+		})
+	}
+}
+
+func TestReplayRecreatesIteratorAfterUnreadableRecords(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the server has moved the iterator past the records which can't be read
+	malformed := NewMockGetRecordsResponse(15, 5, true)
+	delete(malformed.Records[2].(map[string]interface{}), "i")
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(10, 5, true)},
+		{Response: malformed},
+		{Response: NewMockGetRecordsResponse(15, 5, true)},
+	}}
+	handler := NewMockConsumerHandler(client, 0)
+	consumer := newTestConsumer(ctx, handler)
+	if err := consumer.SetReplayRange(NewMessageIdReplayRange(10, 17)); err != nil {
+		t.Fatalf("SetReplayRange() = %v", err)
+	}
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if client.CountCalls("CreateRecordsIterator") != 2 {
+		t.Fatalf("CreateRecordsIterator calls = %v, want %v", client.CountCalls("CreateRecordsIterator"), 2)
+	}
+	if params := client.IteratorParams[1]; params.IteratorType != IteratorTypeAfterMessageId || *params.MessageId != 14 {
+		t.Errorf("IteratorParams[1] = %v %v, want %v %v", params.IteratorType, params.MessageId, IteratorTypeAfterMessageId, 14)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(10, 17)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(10, 17))
+	}
+}
+
+func TestReplayKeepsCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(10, 5, true)},
+		{Response: NewMockGetRecordsResponse(15, 5, true)},
+	}}
+	handler := NewMockConsumerHandler(client, 0)
+	consumer := newTestConsumer(ctx, handler)
+
+	// the checkpoint of the live consumer (default key)
+	store := NewMemoryCheckpointStore()
+	saved := Checkpoint{StreamUUID: consumer.streamUUID, MessageId: 50, CreationDate: time.Now().UTC()}
+	if err := store.SaveCheckpoint(ctx, consumer.CheckpointKey, &saved); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	consumer.SetCheckpointStore(store, "")
+	if err := consumer.SetReplayRange(NewMessageIdReplayRange(10, 17)); err != nil {
+		t.Fatalf("SetReplayRange() = %v", err)
+	}
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	// the replay starts at the start of the range, not at the checkpoint
+	if params := client.IteratorParams[0]; params.IteratorType != IteratorTypeAtMessageId || *params.MessageId != 10 {
+		t.Errorf("IteratorParams[0] = %v %v, want %v %v", params.IteratorType, params.MessageId, IteratorTypeAtMessageId, 10)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(10, 17)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(10, 17))
+	}
+	checkpoint, err := store.LoadCheckpoint(ctx, consumer.CheckpointKey)
+	if err != nil || checkpoint == nil || checkpoint.MessageId != 50 {
+		t.Errorf("LoadCheckpoint() = %+v, %v, want message id %v", checkpoint, err, 50)
+	}
+}
+
+func TestSetRecordsIteratorParamsValidation(t *testing.T) {
+	consumer := newTestConsumer(context.Background(), NewMockConsumerHandler(NewMockConsumerClient(), 0))
+	tests := []struct {
+		name     string
+		jqFilter string
+		isValid  bool
+	}{
+		{name: "no filter", jqFilter: "", isValid: true},
+		{name: "valid filter", jqFilter: `select(.level == "error")`, isValid: true},
+		{name: "invalid filter", jqFilter: `select(.level == "error"`, isValid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jqFilter := tt.jqFilter
+			err := consumer.SetRecordsIteratorParams(&RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage, JqFilter: &jqFilter})
+			if (err == nil) != tt.isValid {
+				t.Errorf("SetRecordsIteratorParams() = %v, want valid=%v", err, tt.isValid)
+			}
+		})
+	}
+}
+
+func TestSetReplayRangeValidation(t *testing.T) {
+	consumer := newTestConsumer(context.Background(), NewMockConsumerHandler(NewMockConsumerClient(), 0))
+	if err := consumer.SetReplayRange(&ReplayRange{}); err == nil {
+		t.Errorf("SetReplayRange() must fail without end point")
+	}
+	if err := consumer.SetReplayRange(NewMessageIdReplayRange(10, 5)); err == nil {
+		t.Errorf("SetReplayRange() must fail when the end is before the start")
+	}
+}
+
+func TestPausedConsumerStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	client := NewMockConsumerClient()
+	handler := NewMockConsumerHandler(client, 0)
+	consumer := newTestConsumer(ctx, handler)
+	consumer.Pause()
+
+	startTime := time.Now()
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Second {
+		t.Errorf("Run() returned after %s", elapsed)
+	}
+	if cpt := client.CountCalls("GetRecords"); cpt != 0 {
+		t.Errorf("GetRecords calls = %d, want %d", cpt, 0)
+	}
+}
+
+// mockPauseHandler pauses the consumer after the first response and resumes it later.
+type mockPauseHandler struct {
+	*MockConsumerHandler
+	consumer      *StreamConsumer
+	pauseDuration time.Duration
+	paused        bool
+	statuses      []bool // pause status read by OnPause and OnResume
+	mu            sync.Mutex
+}
+
+func (h *mockPauseHandler) OnPause() {
+	h.MockConsumerHandler.OnPause()
+	h.addStatus(h.consumer.GetPauseSatus())
+}
+
+func (h *mockPauseHandler) OnResume() {
+	h.MockConsumerHandler.OnResume()
+	h.addStatus(h.consumer.GetPauseSatus())
+}
+
+func (h *mockPauseHandler) addStatus(paused bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statuses = append(h.statuses, paused)
+}
+
+func (h *mockPauseHandler) getStatuses() []bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]bool{}, h.statuses...)
+}
+
+func (h *mockPauseHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	mustContinue := h.MockConsumerHandler.OnGetRecordsSuccess(response)
+	if !h.paused {
+		h.paused = true
+		h.consumer.Pause()
+		go func() {
+			time.Sleep(h.pauseDuration)
+			h.consumer.Resume()
+		}()
+	}
+	return mustContinue
+}
+
+func TestResumeAfterPause(t *testing.T) {
+	tests := []struct {
+		name                        string
+		resumeRecreateIteratorAfter time.Duration
+		expectedIterators           int
+	}{
+		{name: "short pause keeps the iterator", resumeRecreateIteratorAfter: time.Minute, expectedIterators: 1},
+		{name: "long pause recreates the iterator", resumeRecreateIteratorAfter: 10 * time.Millisecond, expectedIterators: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+				{Response: NewMockGetRecordsResponse(1, 3, true)},
+				{Response: NewMockGetRecordsResponse(4, 3, true)},
+			}}
+			handler := &mockPauseHandler{MockConsumerHandler: NewMockConsumerHandler(client, 6), pauseDuration: 30 * time.Millisecond}
+			consumer := newTestConsumer(ctx, handler)
+			consumer.ResumeRecreateIteratorAfter = tt.resumeRecreateIteratorAfter
+			handler.consumer = consumer
+			if err := consumer.Run(ctx); err != nil {
+				t.Fatalf("Run() = %v, want %v", err, nil)
+			}
+
+			if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 6)) {
+				t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 6))
+			}
+			if cpt := client.CountCalls("CreateRecordsIterator"); cpt != tt.expectedIterators {
+				t.Fatalf("CreateRecordsIterator calls = %d, want %d", cpt, tt.expectedIterators)
+			}
+			if tt.expectedIterators > 1 {
+				// the iterator is recreated after the last record processed
+				params := client.IteratorParams[1]
+				if params.IteratorType != IteratorTypeAfterMessageId || *params.MessageId != 3 {
+					t.Errorf("IteratorParams[1] = %v %v, want %v 3", params.IteratorType, *params.MessageId, IteratorTypeAfterMessageId)
+				}
+			}
+			events := handler.GetEvents()
+			if !reflect.DeepEqual(events[4:6], []string{"OnPause", "OnResume"}) {
+				t.Errorf("events = %v, want OnPause then OnResume after the first response", events)
+			}
+			// the pause handlers can read the pause status (no deadlock)
+			if statuses := handler.getStatuses(); !reflect.DeepEqual(statuses, []bool{true, false}) {
+				t.Errorf("pause statuses = %v, want %v", statuses, []bool{true, false})
+			}
+			if consumer.StatusPause {
+				t.Errorf("StatusPause = true, want false")
+			}
+		})
+	}
+}
+
+func TestGetRecordsIteratorParamsStartPoint(t *testing.T) {
+	messageId := func(id MessageId) *MessageId { return &id }
+	tests := []struct {
+		name              string
+		position          *MessageId
+		redeliverAt       *MessageId
+		lastDelivered     *MessageId
+		expectedType      IteratorType
+		expectedMessageId *MessageId
+	}{
+		{name: "handler params", expectedType: IteratorTypeAfterLastMessage},
+		{name: "position", position: messageId(5), lastDelivered: messageId(8), expectedType: IteratorTypeAfterMessageId, expectedMessageId: messageId(5)},
+		{name: "redelivery", redeliverAt: messageId(3), lastDelivered: messageId(8), expectedType: IteratorTypeAtMessageId, expectedMessageId: messageId(3)},
+		{name: "records delivered but not committed", lastDelivered: messageId(8), expectedType: IteratorTypeAfterMessageId, expectedMessageId: messageId(8)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewMockConsumerHandler(NewMockConsumerClient(), 0)
+			handler.Params.IteratorType = IteratorTypeAfterLastMessage
+			consumer := newTestConsumer(context.Background(), handler)
+			if tt.position != nil {
+				consumer.SetPosition(*tt.position, time.Now())
+			}
+			consumer.redeliverAt = tt.redeliverAt
+			consumer.lastDelivered = tt.lastDelivered
+
+			p := consumer.GetRecordsIteratorParams()
+			if p.IteratorType != tt.expectedType || !reflect.DeepEqual(p.MessageId, tt.expectedMessageId) {
+				t.Errorf("GetRecordsIteratorParams() = %v %v, want %v %v", p.IteratorType, p.MessageId, tt.expectedType, tt.expectedMessageId)
+			}
+		})
+	}
+}
+
+// mockPanicHandler panics when it receives records.
+type mockPanicHandler struct {
+	*MockConsumerHandler
+}
+
+func (h *mockPanicHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	panic("unexpected record")
+}
+
+// mockNoLoggerHandler has no logger.
+type mockNoLoggerHandler struct {
+	*MockConsumerHandler
+}
+
+func (h *mockNoLoggerHandler) GetLogger() *log.Logger {
+	return nil
+}
+
+func TestRunReturnsFatalError(t *testing.T) {
+	tests := []struct {
+		name            string
+		client          *MockConsumerClient
+		panics          bool
+		noLogger        bool
+		expectedMessage string
+	}{
+		{
+			name:            "can't get messages from stream",
+			client:          &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{{Error: &APIError{Code: ErrorCantGetMessagesFromStream, Message: "disk error"}}}},
+			expectedMessage: "disk error",
+		},
+		{
+			name:            "handler panic",
+			client:          &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(1, 3, true)}}},
+			panics:          true,
+			expectedMessage: "consumer panic",
+		},
+		{
+			name:            "handler without logger",
+			client:          &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{{Error: &APIError{Code: ErrorCantGetMessagesFromStream, Message: "disk error"}}}},
+			noLogger:        true,
+			expectedMessage: "disk error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			mockHandler := NewMockConsumerHandler(tt.client, 0)
+			mockHandler.ContinueOnFailure = true
+			var handler StreamConsumerHandler = mockHandler
+			if tt.panics {
+				handler = &mockPanicHandler{MockConsumerHandler: mockHandler}
+			} else if tt.noLogger {
+				handler = &mockNoLoggerHandler{MockConsumerHandler: mockHandler}
+			}
+			consumer := newTestConsumer(ctx, handler)
+			err := consumer.Run(ctx)
+			if err == nil || err.Message != tt.expectedMessage {
+				t.Fatalf("Run() = %v, want %q", err, tt.expectedMessage)
+			}
+
+			events := mockHandler.GetEvents()
+			if events[len(events)-2] != "OnFatalError" || events[len(events)-1] != "OnClose" {
+				t.Errorf("events = %v, want OnFatalError then OnClose", events)
+			}
+			if cpt := tt.client.CountCalls("CloseRecordsIterator"); cpt != 1 {
+				t.Errorf("CloseRecordsIterator calls = %d, want %d", cpt, 1)
+			}
+		})
+	}
+}
+
+func TestRefreshLag(t *testing.T) {
+	creationDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	stream := &StreamInformation{LastMsgId: 100, CptMessages: 100, LastUpdate: creationDate.Add(100 * time.Second)}
+	tests := []struct {
+		name             string
+		position         MessageId // 0 if no record has been processed
+		threshold        LagThreshold
+		expectedMessages uint64
+		expectedTime     time.Duration
+		expectedEvent    bool
+	}{
+		{name: "no position", expectedMessages: 100},
+		{name: "behind", position: 40, expectedMessages: 60, expectedTime: 60 * time.Second},
+		{name: "up to date", position: 100, threshold: LagThreshold{Messages: 1}},
+		{name: "messages threshold", position: 40, threshold: LagThreshold{Messages: 50}, expectedMessages: 60, expectedTime: 60 * time.Second, expectedEvent: true},
+		{name: "time threshold", position: 90, threshold: LagThreshold{Time: 5 * time.Second}, expectedMessages: 10, expectedTime: 10 * time.Second, expectedEvent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockConsumerClient{StreamInformation: stream}
+			handler := NewMockConsumerHandler(client, 0)
+			consumer := newTestConsumer(context.Background(), handler)
+			consumer.LagThreshold = tt.threshold
+			if tt.position != 0 {
+				consumer.SetPosition(tt.position, creationDate.Add(time.Duration(tt.position)*time.Second))
+			}
+
+			if _, found := consumer.Lag(); found {
+				t.Fatalf("Lag() found before the first refresh")
+			}
+			lag, err := consumer.RefreshLag(context.Background())
+			if err != nil {
+				t.Fatalf("RefreshLag() error = %v", err)
+			}
+			if lag.Messages != tt.expectedMessages || lag.Time != tt.expectedTime {
+				t.Errorf("RefreshLag() = %d messages %v, want %d messages %v", lag.Messages, lag.Time, tt.expectedMessages, tt.expectedTime)
+			}
+			if cached, found := consumer.Lag(); !found || cached.Messages != lag.Messages {
+				t.Errorf("Lag() = %+v %v, want %+v", cached, found, lag)
+			}
+
+			// the event is sent once while the lag stays over the threshold
+			if _, err := consumer.RefreshLag(context.Background()); err != nil {
+				t.Fatalf("RefreshLag() error = %v", err)
+			}
+			cptEvents := 0
+			for _, event := range handler.GetEvents() {
+				if event == "OnLagThresholdExceeded" {
+					cptEvents++
+				}
+			}
+			if expected := map[bool]int{false: 0, true: 1}[tt.expectedEvent]; cptEvents != expected {
+				t.Errorf("OnLagThresholdExceeded events = %d, want %d", cptEvents, expected)
+			}
+		})
+	}
+}
+
+func TestRunMonitorsLag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{
+		GetRecordsResults: []MockGetRecordsResult{{Response: NewMockGetRecordsResponse(1, 5, false)}},
+		StreamInformation: &StreamInformation{LastMsgId: 10, CptMessages: 10},
+	}
+	handler := NewMockConsumerHandler(client, 0)
+	consumer := newTestConsumer(ctx, handler)
+	consumer.LagRefreshInterval = time.Millisecond
+	done := make(chan *APIError, 1)
+	go func() { done <- consumer.Run(ctx) }()
+
+	waitForCondition(t, "the lag is refreshed after the records are processed", func() bool {
+		lag, found := consumer.Lag()
+		return found && lag.MessageId == 5 && lag.Messages == 5
+	})
+
+	// the consumer catches up
+	client.SetStreamInformation(&StreamInformation{LastMsgId: 5, CptMessages: 5})
+	waitForCondition(t, "the consumer has no lag", func() bool {
+		lag, _ := consumer.Lag()
+		return lag.Messages == 0
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+}
+
+func TestRunWithRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 10, true)},
+		{Response: NewMockGetRecordsResponse(11, 10, true)},
+		{Response: NewMockGetRecordsResponse(21, 10, true)},
+	}}
+	handler := NewMockConsumerHandler(client, 30)
+	consumer := newTestConsumer(ctx, handler)
+	consumer.SetRateLimiter(NewRateLimiter(0, 0, 200, 10))
+
+	// 10 records are allowed at once, the last request waits for the records of the second page (50ms)
+	startTime := time.Now()
+	if err := consumer.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+	if elapsed := time.Since(startTime); elapsed < 45*time.Millisecond {
+		t.Errorf("Run() took %v, want at least %v", elapsed, 50*time.Millisecond)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 30)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 30))
+	}
+}
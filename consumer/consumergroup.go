@@ -0,0 +1,430 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// GroupAssignment is a unit of work of a consumer group: a stream, or a hash partition of a stream.
+type GroupAssignment struct {
+	StreamUUID StreamUUID
+	Partition  int
+	Partitions int // 1 when the whole stream is assigned
+}
+
+// Key identifies the assignment in the lease and checkpoint stores.
+func (a GroupAssignment) Key() string {
+	if a.Partitions <= 1 {
+		return a.StreamUUID.String()
+	}
+	return fmt.Sprintf("%s/%d-%d", a.StreamUUID, a.Partition, a.Partitions)
+}
+
+type ConsumerGroupHandler interface {
+	GetLogger() *log.Logger
+	// NewStreamConsumerHandler returns the handler of an assignment, it is called every time the assignment is acquired.
+	NewStreamConsumerHandler(assignment GroupAssignment) StreamConsumerHandler
+	OnAssignmentsChanged(assigned []GroupAssignment, revoked []GroupAssignment)
+	// OnLeaseStoreError returns false to stop the member (the leases are retried at the next heartbeat otherwise,
+	// the assignments whose lease expires before the next heartbeat are stopped).
+	OnLeaseStoreError(err error) bool
+}
+
+// ConsumerGroup shares the consumption of streams between the members of a group (the replicas of a service).
+//
+// Every member holds a membership lease, renewed at every heartbeat.
+// The assignments (the streams, or their hash partitions) are spread over the live members sorted by id,
+// every member computes the same distribution. A member only consumes an assignment while it holds its lease,
+// so when the members change (join, leave or lease expiration) the previous owner stops the assignment and
+// releases the lease before the new owner starts it from the checkpoint saved in the shared CheckpointStore.
+type ConsumerGroup struct {
+	Group             string
+	MemberId          string
+	Streams           []StreamUUID
+	Partitions        int                   // number of hash partitions per stream (0 or 1 to assign whole streams)
+	PartitionKey      PartitionKeyExtractor // key of the hash partitions (default is the message id)
+	Leases            LeaseStore
+	Checkpoints       CheckpointStore
+	LeaseTTL          time.Duration // default is 10 seconds
+	HeartbeatInterval time.Duration // must be lower than LeaseTTL, default is a third of LeaseTTL
+	GetRecordsChunks  int
+	Handler           ConsumerGroupHandler
+	// ConfigureConsumer is called before the consumer of an assignment is started (optional),
+	// ctx is the context of the assignment.
+	ConfigureConsumer func(ctx context.Context, assignment GroupAssignment, c *StreamConsumer)
+	client            *sharedAuthClient
+	running           map[string]*groupAssignmentRun
+	mu                sync.Mutex
+}
+
+// groupAssignmentRun is an assignment being consumed by the member.
+type groupAssignmentRun struct {
+	assignment     GroupAssignment
+	consumer       *StreamConsumer
+	cancel         context.CancelFunc
+	done           chan struct{}
+	leaseExpiresAt time.Time // local time, updated by the heartbeat goroutine only
+}
+
+// partitionFilterHandler gives to the handler the records of a hash partition,
+// the records of the other partitions are acknowledged without being processed.
+type partitionFilterHandler struct {
+	// implements interface StreamConsumerHandler and StreamConsumerAckHandler
+	StreamConsumerHandler
+	assignment   GroupAssignment
+	partitionKey PartitionKeyExtractor
+}
+
+func (h *partitionFilterHandler) OnGetRecordsToAck(response *GetStreamRecordsResponse, ack *RecordsAck) bool {
+	envelopes := ack.Envelopes()
+	kept := make([]*ResponseRecordEnvelope, 0, len(envelopes))
+	records := make([]interface{}, 0, len(envelopes))
+	for idx, envelope := range envelopes {
+		if partitionOf(h.partitionKey(envelope), h.assignment.Partitions) == h.assignment.Partition {
+			kept = append(kept, envelope)
+			records = append(records, response.Records[idx])
+		} else {
+			ack.Ack(envelope.Id)
+		}
+	}
+
+	if len(kept) == 0 && len(envelopes) > 0 {
+		// no record of the partition
+		return true
+	}
+
+	filtered := *response
+	filtered.Records = records
+	filtered.Count = len(records)
+	if ackHandler, ok := h.StreamConsumerHandler.(StreamConsumerAckHandler); ok {
+		partitionAck := NewRecordsAck(kept)
+		mustContinue := ackHandler.OnGetRecordsToAck(&filtered, partitionAck)
+		ack.copyStatus(partitionAck)
+		return mustContinue
+	}
+
+	mustContinue := h.StreamConsumerHandler.OnGetRecordsSuccess(&filtered)
+	// the records have been processed, even if the handler has decided to stop the consumption
+	ack.AckAll()
+	return mustContinue
+}
+
+func (h *partitionFilterHandler) OnFatalError(apiError *APIError) {
+	if fatalErrorHandler, ok := h.StreamConsumerHandler.(StreamConsumerFatalErrorHandler); ok {
+		fatalErrorHandler.OnFatalError(apiError)
+	}
+}
+
+func messageIdPartitionKey(envelope *ResponseRecordEnvelope) string {
+	return strconv.FormatUint(uint64(envelope.Id), 10)
+}
+
+func (g *ConsumerGroup) memberLeaseKey(memberId string) string {
+	return g.Group + "/members/" + memberId
+}
+
+func (g *ConsumerGroup) assignmentLeaseKey(assignment GroupAssignment) string {
+	return g.Group + "/assignments/" + assignment.Key()
+}
+
+func (g *ConsumerGroup) checkpointKey(assignment GroupAssignment) string {
+	return g.Group + "/" + assignment.Key()
+}
+
+// AllAssignments returns the assignments of the group (all the members), in order.
+func (g *ConsumerGroup) AllAssignments() []GroupAssignment {
+	partitions := g.Partitions
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	assignments := make([]GroupAssignment, 0, len(g.Streams)*partitions)
+	for _, streamUUID := range g.Streams {
+		for partition := 0; partition < partitions; partition++ {
+			assignments = append(assignments, GroupAssignment{StreamUUID: streamUUID, Partition: partition, Partitions: partitions})
+		}
+	}
+	return assignments
+}
+
+// Assignments returns the assignments being consumed by the member.
+func (g *ConsumerGroup) Assignments() []GroupAssignment {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	assignments := make([]GroupAssignment, 0, len(g.running))
+	for _, assignment := range g.AllAssignments() {
+		if _, found := g.running[assignment.Key()]; found {
+			assignments = append(assignments, assignment)
+		}
+	}
+	return assignments
+}
+
+// distribute returns the assignments of the member, given the ids of the live members.
+func (g *ConsumerGroup) distribute(memberIds []string) []GroupAssignment {
+	memberIdx := -1
+	for idx, memberId := range memberIds {
+		if memberId == g.MemberId {
+			memberIdx = idx
+		}
+	}
+
+	assignments := make([]GroupAssignment, 0)
+	if memberIdx < 0 {
+		return assignments
+	}
+	for idx, assignment := range g.AllAssignments() {
+		if idx%len(memberIds) == memberIdx {
+			assignments = append(assignments, assignment)
+		}
+	}
+	return assignments
+}
+
+// Run joins the group and consumes the assignments of the member until ctx is canceled,
+// then it leaves the group (the leases are released so that the other members take over immediately).
+func (g *ConsumerGroup) Run(ctx context.Context) *APIError {
+	if g.Leases == nil || g.Handler == nil {
+		return &APIError{Message: "the consumer group must have a lease store and a handler"}
+	}
+	if g.LeaseTTL <= 0 {
+		g.LeaseTTL = 10 * time.Second
+	}
+	if g.HeartbeatInterval <= 0 {
+		g.HeartbeatInterval = g.LeaseTTL / 3
+	}
+	if g.HeartbeatInterval >= g.LeaseTTL {
+		return &APIError{Message: "the heartbeat interval of the consumer group must be lower than the lease ttl"}
+	}
+
+	defer g.leave()
+
+	ticker := time.NewTicker(g.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if apiError := g.heartbeat(ctx); apiError != nil {
+			return apiError
+		}
+		// the leases which have not been renewed (lease store error) must not be used once expired
+		g.stopExpiringAssignments()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat renews the leases of the member and rebalances the assignments.
+func (g *ConsumerGroup) heartbeat(ctx context.Context) *APIError {
+	assigned := make([]GroupAssignment, 0)
+	revoked := make([]GroupAssignment, 0)
+	defer func() {
+		// the changes are notified even if the heartbeat has been interrupted by an error
+		if len(assigned) > 0 || len(revoked) > 0 {
+			g.Handler.OnAssignmentsChanged(assigned, revoked)
+		}
+	}()
+
+	acquired, err := g.Leases.AcquireLease(ctx, g.memberLeaseKey(g.MemberId), g.MemberId, g.LeaseTTL)
+	if err == nil && !acquired {
+		return &APIError{Message: "the member id is used by another member of the group", Details: g.MemberId}
+	}
+	if err != nil {
+		return g.onLeaseStoreError(ctx, err)
+	}
+
+	leases, err := g.Leases.ListLeases(ctx, g.memberLeaseKey(""))
+	if err != nil {
+		return g.onLeaseStoreError(ctx, err)
+	}
+	memberIds := make([]string, len(leases))
+	for idx, lease := range leases {
+		memberIds[idx] = lease.Owner
+	}
+
+	wanted := make(map[string]bool)
+	for _, assignment := range g.distribute(memberIds) {
+		wanted[assignment.Key()] = true
+	}
+
+	// stop the assignments of the other members (and the ones which have stopped by themselves)
+	for key, run := range g.getRunning() {
+		stoppedByItself := isClosed(run.done)
+		if wanted[key] && !stoppedByItself {
+			continue
+		}
+		g.stopAssignment(run, true)
+		if !stoppedByItself {
+			revoked = append(revoked, run.assignment)
+		}
+	}
+
+	for _, assignment := range g.distribute(memberIds) {
+		run, isRunning := g.getRunning()[assignment.Key()]
+		// the lease expires at the latest ttl after the request
+		leaseExpiresAt := time.Now().Add(g.LeaseTTL)
+		acquired, err := g.Leases.AcquireLease(ctx, g.assignmentLeaseKey(assignment), g.MemberId, g.LeaseTTL)
+		if err != nil {
+			return g.onLeaseStoreError(ctx, err)
+		}
+
+		switch {
+		case acquired && isRunning:
+			run.leaseExpiresAt = leaseExpiresAt
+		case acquired && !isRunning:
+			g.startAssignment(ctx, assignment, leaseExpiresAt)
+			assigned = append(assigned, assignment)
+		case !acquired && isRunning:
+			// the lease has been lost (expired then taken by another member)
+			g.stopAssignment(run, false)
+			revoked = append(revoked, assignment)
+		}
+		// not acquired: the previous owner has not released it yet, retry at the next heartbeat
+	}
+	return nil
+}
+
+// stopExpiringAssignments stops the assignments whose lease expires before the next heartbeat can renew it.
+func (g *ConsumerGroup) stopExpiringAssignments() {
+	renewableUntil := time.Now().Add(g.HeartbeatInterval)
+	revoked := make([]GroupAssignment, 0)
+	for _, run := range g.getRunning() {
+		if run.leaseExpiresAt.After(renewableUntil) {
+			continue
+		}
+		// the lease store is failing, the lease is left to expire
+		g.stopAssignment(run, false)
+		revoked = append(revoked, run.assignment)
+	}
+	if len(revoked) > 0 {
+		g.Handler.OnAssignmentsChanged(nil, revoked)
+	}
+}
+
+func (g *ConsumerGroup) onLeaseStoreError(ctx context.Context, err error) *APIError {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if !g.Handler.OnLeaseStoreError(err) {
+		return &APIError{Message: "lease store error", Details: err.Error()}
+	}
+	return nil
+}
+
+func (g *ConsumerGroup) getRunning() map[string]*groupAssignmentRun {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	running := make(map[string]*groupAssignmentRun, len(g.running))
+	for key, run := range g.running {
+		running[key] = run
+	}
+	return running
+}
+
+func (g *ConsumerGroup) startAssignment(ctx context.Context, assignment GroupAssignment, leaseExpiresAt time.Time) {
+	ctxAssignment, cancel := context.WithCancel(ctx)
+	handler := g.Handler.NewStreamConsumerHandler(assignment)
+	if assignment.Partitions > 1 {
+		partitionKey := g.PartitionKey
+		if partitionKey == nil {
+			partitionKey = messageIdPartitionKey
+		}
+		handler = &partitionFilterHandler{StreamConsumerHandler: handler, assignment: assignment, partitionKey: partitionKey}
+	}
+
+	consumer := CreateConsumer(ctxAssignment, assignment.StreamUUID, handler, g.GetRecordsChunks)
+	consumer.client = g.client
+	if g.Checkpoints != nil {
+		consumer.SetCheckpointStore(g.Checkpoints, g.checkpointKey(assignment))
+	}
+	if g.ConfigureConsumer != nil {
+		g.ConfigureConsumer(ctxAssignment, assignment, consumer)
+	}
+
+	run := &groupAssignmentRun{assignment: assignment, consumer: consumer, cancel: cancel, done: make(chan struct{}), leaseExpiresAt: leaseExpiresAt}
+	g.mu.Lock()
+	g.running[assignment.Key()] = run
+	g.mu.Unlock()
+
+	go func() {
+		defer close(run.done)
+		if apiError := consumer.Run(ctxAssignment); apiError != nil && ctxAssignment.Err() == nil {
+			g.Handler.GetLogger().Printf("ConsumerGroup: assignment %s stopped: %s\n", assignment.Key(), apiError.ToJson())
+		}
+	}()
+}
+
+// stopAssignment stops the consumer of the assignment (its checkpoint is saved) then releases the lease.
+func (g *ConsumerGroup) stopAssignment(run *groupAssignmentRun, release bool) {
+	run.cancel()
+	<-run.done
+
+	g.mu.Lock()
+	delete(g.running, run.assignment.Key())
+	g.mu.Unlock()
+
+	if release {
+		ctx, cancel := context.WithTimeout(context.Background(), CloseRecordsIteratorTimeout)
+		defer cancel()
+		if err := g.Leases.ReleaseLease(ctx, g.assignmentLeaseKey(run.assignment), g.MemberId); err != nil {
+			g.Handler.GetLogger().Printf("ConsumerGroup: can't release the lease of %s: %s\n", run.assignment.Key(), err.Error())
+		}
+	}
+}
+
+// leave stops all the assignments and releases the leases of the member.
+func (g *ConsumerGroup) leave() {
+	revoked := make([]GroupAssignment, 0)
+	for _, run := range g.getRunning() {
+		g.stopAssignment(run, true)
+		revoked = append(revoked, run.assignment)
+	}
+	if len(revoked) > 0 {
+		g.Handler.OnAssignmentsChanged(nil, revoked)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CloseRecordsIteratorTimeout)
+	defer cancel()
+	if err := g.Leases.ReleaseLease(ctx, g.memberLeaseKey(g.MemberId), g.MemberId); err != nil {
+		g.Handler.GetLogger().Printf("ConsumerGroup: can't release the membership lease: %s\n", err.Error())
+	}
+	g.client.client.Disconnect()
+}
+
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewConsumerGroup creates a member of a consumer group, memberId must be unique in the group.
+// The leases expire after 10 seconds without heartbeat (see LeaseTTL and HeartbeatInterval).
+func NewConsumerGroup(client IConsumerClient, group string, memberId string, streams []StreamUUID, leases LeaseStore, checkpoints CheckpointStore, handler ConsumerGroupHandler) *ConsumerGroup {
+	return &ConsumerGroup{
+		Group:             strings.TrimSuffix(group, "/"),
+		MemberId:          memberId,
+		Streams:           append([]StreamUUID{}, streams...),
+		Leases:            leases,
+		Checkpoints:       checkpoints,
+		LeaseTTL:          10 * time.Second,
+		HeartbeatInterval: 3 * time.Second,
+		GetRecordsChunks:  MaxPullRecordsByCall,
+		Handler:           handler,
+		client:            newSharedAuthClient(client),
+		running:           make(map[string]*groupAssignmentRun),
+	}
+}
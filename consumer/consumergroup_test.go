@@ -0,0 +1,267 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+	"github.com/nbigot/ministream-client-go/ministreamtest"
+)
+
+type mockGroupHandler struct {
+	// implements interface ConsumerGroupHandler
+	client   *MockConsumerClient
+	handlers map[string]*MockConsumerHandler
+	mu       sync.Mutex
+}
+
+func (h *mockGroupHandler) GetLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+func (h *mockGroupHandler) NewStreamConsumerHandler(assignment GroupAssignment) StreamConsumerHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	handler := NewMockConsumerHandler(h.client, 0)
+	h.handlers[assignment.Key()] = handler
+	return handler
+}
+
+func (h *mockGroupHandler) OnAssignmentsChanged(assigned []GroupAssignment, revoked []GroupAssignment) {
+}
+
+func (h *mockGroupHandler) OnLeaseStoreError(err error) bool {
+	return true
+}
+
+func (h *mockGroupHandler) GetHandler(key string) *MockConsumerHandler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.handlers[key]
+}
+
+// failingLeaseStore is a MemoryLeaseStore which fails while Failing is set.
+type failingLeaseStore struct {
+	*MemoryLeaseStore
+	Failing atomic.Bool
+}
+
+func (s *failingLeaseStore) AcquireLease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	if s.Failing.Load() {
+		return false, errors.New("lease store unavailable")
+	}
+	return s.MemoryLeaseStore.AcquireLease(ctx, key, owner, ttl)
+}
+
+type testGroupMember struct {
+	group  *ConsumerGroup
+	client *MockConsumerClient
+	cancel context.CancelFunc
+	done   chan *APIError
+}
+
+func startTestGroupMember(t *testing.T, memberId string, client *MockConsumerClient, streams []StreamUUID, leases LeaseStore, checkpoints CheckpointStore, partitions int) *testGroupMember {
+	handler := &mockGroupHandler{client: client, handlers: make(map[string]*MockConsumerHandler)}
+	group := NewConsumerGroup(client, "my-group", memberId, streams, leases, checkpoints, handler)
+	group.Partitions = partitions
+	group.LeaseTTL = time.Second
+	group.HeartbeatInterval = 5 * time.Millisecond
+	group.ConfigureConsumer = func(ctx context.Context, assignment GroupAssignment, c *StreamConsumer) {
+		c.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	member := &testGroupMember{group: group, client: client, cancel: cancel, done: make(chan *APIError, 1)}
+	go func() { member.done <- group.Run(ctx) }()
+	t.Cleanup(member.stop)
+	return member
+}
+
+func (m *testGroupMember) stop() {
+	m.cancel()
+	<-m.done
+	m.done <- nil
+}
+
+func (m *testGroupMember) streams() []StreamUUID {
+	streams := make([]StreamUUID, 0)
+	for _, assignment := range m.group.Assignments() {
+		streams = append(streams, assignment.StreamUUID)
+	}
+	return streams
+}
+
+func waitForCondition(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout: %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsumerGroupRebalance(t *testing.T) {
+	streams := []StreamUUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	leases := NewMemoryLeaseStore()
+	checkpoints := NewMemoryCheckpointStore()
+
+	first := startTestGroupMember(t, "member-1", NewMockConsumerClient(), streams, leases, checkpoints, 0)
+	waitForCondition(t, "the first member owns all the streams", func() bool {
+		return reflect.DeepEqual(first.streams(), streams)
+	})
+
+	// a member joins the group
+	second := startTestGroupMember(t, "member-2", NewMockConsumerClient(), streams, leases, checkpoints, 0)
+	waitForCondition(t, "the streams are shared", func() bool {
+		return reflect.DeepEqual(first.streams(), []StreamUUID{streams[0], streams[2]}) &&
+			reflect.DeepEqual(second.streams(), []StreamUUID{streams[1], streams[3]})
+	})
+
+	// the member leaves the group
+	second.stop()
+	waitForCondition(t, "the first member owns all the streams again", func() bool {
+		return reflect.DeepEqual(first.streams(), streams)
+	})
+}
+
+func TestConsumerGroupCheckpointHandOff(t *testing.T) {
+	streams := []StreamUUID{uuid.New(), uuid.New()}
+	leases := NewMemoryLeaseStore()
+	checkpoints := NewMemoryCheckpointStore()
+
+	firstClient := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+		streams[1]: {{Response: NewMockGetRecordsResponse(1, 5, false)}},
+	}}
+	startTestGroupMember(t, "member-1", firstClient, streams, leases, checkpoints, 0)
+	waitForCondition(t, "the records of the second stream are processed", func() bool {
+		checkpoint, _ := checkpoints.LoadCheckpoint(context.Background(), "my-group/"+streams[1].String())
+		return checkpoint != nil && checkpoint.MessageId == 5
+	})
+
+	// the second stream is handed off to the new member, it resumes after the last processed record
+	secondClient := NewMockConsumerClient()
+	second := startTestGroupMember(t, "member-2", secondClient, streams, leases, checkpoints, 0)
+	waitForCondition(t, "the second member owns the second stream", func() bool {
+		return secondClient.CountCalls("CreateRecordsIterator") > 0
+	})
+
+	if secondStreams := second.streams(); !reflect.DeepEqual(secondStreams, []StreamUUID{streams[1]}) {
+		t.Errorf("second member streams = %v, want %v", secondStreams, []StreamUUID{streams[1]})
+	}
+	secondClient.mu.Lock()
+	params := secondClient.IteratorParams[0]
+	secondClient.mu.Unlock()
+	if params.IteratorType != IteratorTypeAfterMessageId || params.MessageId == nil || *params.MessageId != 5 {
+		t.Errorf("IteratorParams = %v %v, want %v 5", params.IteratorType, params.MessageId, IteratorTypeAfterMessageId)
+	}
+}
+
+func TestConsumerGroupHashPartitions(t *testing.T) {
+	streams := []StreamUUID{uuid.New()}
+	leases := NewMemoryLeaseStore()
+	checkpoints := NewMemoryCheckpointStore()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 10, false)},
+		{Response: NewMockGetRecordsResponse(1, 10, false)},
+	}}
+	member := startTestGroupMember(t, "member-1", client, streams, leases, checkpoints, 2)
+	handlers := member.group.Handler.(*mockGroupHandler)
+	keys := []string{
+		GroupAssignment{StreamUUID: streams[0], Partition: 0, Partitions: 2}.Key(),
+		GroupAssignment{StreamUUID: streams[0], Partition: 1, Partitions: 2}.Key(),
+	}
+
+	// each partition consumes the whole stream and keeps its records
+	waitForCondition(t, "the records of the partitions are processed", func() bool {
+		cpt := 0
+		for _, key := range keys {
+			if handler := handlers.GetHandler(key); handler != nil {
+				cpt += len(handler.GetMessageIds())
+			}
+		}
+		return cpt == 10
+	})
+
+	ids := make([]MessageId, 0)
+	for _, key := range keys {
+		partitionIds := handlers.GetHandler(key).GetMessageIds()
+		if len(partitionIds) == 0 || len(partitionIds) == 10 {
+			t.Errorf("partition %s message ids = %v, want a subset", key, partitionIds)
+		}
+		ids = append(ids, partitionIds...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 10)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 10))
+	}
+}
+
+func TestConsumerGroupStopsExpiredAssignments(t *testing.T) {
+	streams := []StreamUUID{uuid.New(), uuid.New()}
+	leases := &failingLeaseStore{MemoryLeaseStore: NewMemoryLeaseStore()}
+
+	member := startTestGroupMember(t, "member-1", NewMockConsumerClient(), streams, leases, NewMemoryCheckpointStore(), 0)
+	waitForCondition(t, "the member owns all the streams", func() bool {
+		return reflect.DeepEqual(member.streams(), streams)
+	})
+
+	// the leases can't be renewed, the streams are stopped before the leases expire (ttl is 1 second)
+	failedAt := time.Now()
+	leases.Failing.Store(true)
+	waitForCondition(t, "the member has stopped the streams", func() bool {
+		return len(member.streams()) == 0
+	})
+	// (the condition is polled every 5 milliseconds)
+	if elapsed := time.Since(failedAt); elapsed < member.group.LeaseTTL/2 || elapsed > member.group.LeaseTTL+50*time.Millisecond {
+		t.Errorf("streams stopped after %v, want just before the lease ttl %v", elapsed, member.group.LeaseTTL)
+	}
+
+	leases.Failing.Store(false)
+	waitForCondition(t, "the member owns all the streams again", func() bool {
+		return reflect.DeepEqual(member.streams(), streams)
+	})
+}
+
+func TestConsumerGroupHeartbeatInterval(t *testing.T) {
+	tests := []struct {
+		name              string
+		heartbeatInterval time.Duration
+		expected          time.Duration
+		isValid           bool
+	}{
+		{name: "default", heartbeatInterval: 0, expected: 10 * time.Second / 3, isValid: true},
+		{name: "lower than the lease ttl", heartbeatInterval: time.Second, expected: time.Second, isValid: true},
+		{name: "equal to the lease ttl", heartbeatInterval: 10 * time.Second, isValid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &mockGroupHandler{client: NewMockConsumerClient(), handlers: make(map[string]*MockConsumerHandler)}
+			group := NewConsumerGroup(handler.client, "my-group", "member-1", nil, NewMemoryLeaseStore(), nil, handler)
+			group.HeartbeatInterval = tt.heartbeatInterval
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := group.Run(ctx)
+			if (err == nil) != tt.isValid {
+				t.Fatalf("Run() = %v, want valid=%v", err, tt.isValid)
+			}
+			if tt.isValid && group.HeartbeatInterval != tt.expected {
+				t.Errorf("HeartbeatInterval = %v, want %v", group.HeartbeatInterval, tt.expected)
+			}
+		})
+	}
+}
@@ -3,13 +3,12 @@ package ministreamconsumer
 import (
 	"log"
 
-	. "github.com/nbigot/ministream-client-go/client"
 	. "github.com/nbigot/ministream-client-go/client/types"
 )
 
 type StreamConsumerHandler interface {
 	GetLogger() *log.Logger
-	GetClient() *MinistreamClient
+	GetClient() IConsumerClient
 	GetRecordsIteratorParams() *RecordsIteratorParams
 	OnAuthenticationSuccess()
 	OnAuthenticationFailure(e *APIError) bool
@@ -23,3 +22,22 @@ type StreamConsumerHandler interface {
 	OnResume()
 	OnClose()
 }
+
+// StreamConsumerFatalErrorHandler is an optional interface of the handlers,
+// OnFatalError is called when the consumption stops on an unrecoverable error (Run returns the error).
+type StreamConsumerFatalErrorHandler interface {
+	OnFatalError(apiError *APIError)
+}
+
+// StreamConsumerCircuitBreakerHandler is an optional interface of the handlers,
+// OnCircuitBreakerStateChanged is called when the circuit breaker of the client changes its state
+// (by the goroutine making the call, see ICircuitBreakerClient).
+type StreamConsumerCircuitBreakerHandler interface {
+	OnCircuitBreakerStateChanged(change CircuitBreakerStateChange)
+}
+
+// StreamConsumerLagHandler is an optional interface of the handlers,
+// OnLagThresholdExceeded is called by the lag monitor goroutine when the lag goes over the LagThreshold.
+type StreamConsumerLagHandler interface {
+	OnLagThresholdExceeded(lag ConsumerLag)
+}
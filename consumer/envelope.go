@@ -0,0 +1,64 @@
+package ministreamconsumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// ParseRecordEnvelope converts a record returned by GetRecords into a ResponseRecordEnvelope.
+func ParseRecordEnvelope(record interface{}) (*ResponseRecordEnvelope, error) {
+	switch r := record.(type) {
+	case *ResponseRecordEnvelope:
+		return r, nil
+	case ResponseRecordEnvelope:
+		return &r, nil
+	case map[string]interface{}:
+		// fast path: the records are decoded from the json response as maps
+		envelope := ResponseRecordEnvelope{Msg: r["m"]}
+		id, err := parseMessageId(r["i"])
+		if err != nil {
+			return nil, err
+		}
+		envelope.Id = id
+		if d, ok := r["d"].(string); ok {
+			creationDate, err := time.Parse(time.RFC3339Nano, d)
+			if err != nil {
+				return nil, fmt.Errorf("invalid record envelope: %s", err.Error())
+			}
+			envelope.CreationDate = creationDate
+		}
+		return &envelope, nil
+	default:
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		var envelope ResponseRecordEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		return &envelope, nil
+	}
+}
+
+func parseMessageId(value interface{}) (MessageId, error) {
+	switch id := value.(type) {
+	case json.Number:
+		// exact, see GetStreamRecordsResponse.UnmarshalJSON
+		messageId, err := strconv.ParseUint(id.String(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid record envelope: %s", err.Error())
+		}
+		return messageId, nil
+	case float64:
+		return MessageId(id), nil
+	case MessageId:
+		return id, nil
+	default:
+		return 0, fmt.Errorf("invalid record envelope: missing message id")
+	}
+}
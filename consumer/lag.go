@@ -0,0 +1,149 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// ConsumerLag is how far behind the last record of the stream the consumer is.
+type ConsumerLag struct {
+	LastMsgId        MessageId     // last record of the stream
+	CptMessages      Size64        // number of records in the stream
+	StreamLastUpdate time.Time     // creation date of the last record of the stream
+	HasPosition      bool          // false if no record has been processed yet
+	MessageId        MessageId     // last record processed
+	CreationDate     time.Time     // creation date of the last record processed
+	Messages         uint64        // number of records not processed yet
+	Time             time.Duration // age of the last record processed compared to the last record of the stream
+	UpdatedAt        time.Time     // when the stream information was fetched
+}
+
+// LagThreshold triggers the OnLagThresholdExceeded event (0 to disable a limit).
+type LagThreshold struct {
+	Messages uint64
+	Time     time.Duration
+}
+
+func (t LagThreshold) isExceeded(lag ConsumerLag) bool {
+	return (t.Messages > 0 && lag.Messages > t.Messages) || (t.Time > 0 && lag.Time > t.Time)
+}
+
+// consumerLag is the last stream information fetched, the lag is refreshed by another goroutine.
+type consumerLag struct {
+	stream    *StreamInformation
+	fetchedAt time.Time
+	exceeded  bool
+	mu        sync.Mutex
+}
+
+// Lag returns the lag of the consumer, computed from the last stream information fetched
+// and the current position (false if the stream information has not been fetched yet).
+func (c *StreamConsumer) Lag() (ConsumerLag, bool) {
+	c.lag.mu.Lock()
+	stream, fetchedAt := c.lag.stream, c.lag.fetchedAt
+	c.lag.mu.Unlock()
+
+	if stream == nil {
+		return ConsumerLag{}, false
+	}
+	return c.computeLag(stream, fetchedAt), true
+}
+
+func (c *StreamConsumer) computeLag(stream *StreamInformation, fetchedAt time.Time) ConsumerLag {
+	lag := ConsumerLag{
+		LastMsgId:        stream.LastMsgId,
+		CptMessages:      stream.CptMessages,
+		StreamLastUpdate: stream.LastUpdate,
+		UpdatedAt:        fetchedAt,
+	}
+
+	position, hasPosition := c.GetPosition()
+	if !hasPosition {
+		// nothing processed yet, the whole stream is behind
+		lag.Messages = stream.CptMessages
+		return lag
+	}
+
+	lag.HasPosition = true
+	lag.MessageId = position.MessageId
+	lag.CreationDate = position.CreationDate
+	if stream.LastMsgId > position.MessageId {
+		lag.Messages = stream.LastMsgId - position.MessageId
+		if stream.LastUpdate.After(position.CreationDate) {
+			lag.Time = stream.LastUpdate.Sub(position.CreationDate)
+		}
+	}
+	return lag
+}
+
+// RefreshLag fetches the stream information and returns the lag of the consumer,
+// the OnLagThresholdExceeded event is sent when the lag goes over the threshold.
+func (c *StreamConsumer) RefreshLag(ctx context.Context) (ConsumerLag, *APIError) {
+	client, ok := c.client.(IStreamInformationClient)
+	if !ok {
+		return ConsumerLag{}, &APIError{Message: "stream information not supported by the client", StreamUUID: c.streamUUID}
+	}
+
+	stream, apiError := client.GetStreamInformation(ctx, c.streamUUID)
+	if apiError != nil {
+		return ConsumerLag{}, apiError
+	}
+
+	fetchedAt := time.Now()
+	lag := c.computeLag(stream, fetchedAt)
+	exceeded := c.LagThreshold.isExceeded(lag)
+
+	c.lag.mu.Lock()
+	c.lag.stream = stream
+	c.lag.fetchedAt = fetchedAt
+	notify := exceeded && !c.lag.exceeded
+	c.lag.exceeded = exceeded
+	c.lag.mu.Unlock()
+
+	// the event is sent once, then again after the lag went back under the threshold
+	if handler, ok := c.Handler.(StreamConsumerLagHandler); ok && notify {
+		handler.OnLagThresholdExceeded(lag)
+	}
+	return lag, nil
+}
+
+// startLagMonitor refreshes the lag in a goroutine (if enabled), it returns the function which stops it.
+func (c *StreamConsumer) startLagMonitor(ctx context.Context) func() {
+	if _, ok := c.client.(IStreamInformationClient); !ok || c.LagRefreshInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		c.monitorLag(ctx, done)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// monitorLag refreshes the lag every LagRefreshInterval until done is closed.
+func (c *StreamConsumer) monitorLag(ctx context.Context, done <-chan struct{}) {
+	ticker := time.NewTicker(c.LagRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, apiError := c.RefreshLag(ctx); apiError != nil && ctx.Err() == nil {
+			c.logger.Printf("StreamConsumer: can't refresh lag: %s\n", apiError.ToJson())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
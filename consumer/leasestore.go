@@ -0,0 +1,280 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lease gives the ownership of a key to an owner until it expires.
+type Lease struct {
+	Key       string    `json:"key"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (l *Lease) isExpired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// LeaseStore stores the leases of a consumer group (members and assignments).
+// Implement this interface to store the leases elsewhere (database, key-value store, ...).
+type LeaseStore interface {
+	// AcquireLease takes or renews the lease of the key for ttl,
+	// it returns false (and no error) when the key is held by another owner and the lease has not expired.
+	AcquireLease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease releases the lease of the key if it is held by the owner.
+	ReleaseLease(ctx context.Context, key string, owner string) error
+	// ListLeases returns the leases which have not expired and whose key starts with prefix, sorted by key.
+	ListLeases(ctx context.Context, prefix string) ([]Lease, error)
+}
+
+// leaseTable is the in-memory state of the leases, it is not safe for concurrent use.
+type leaseTable map[string]Lease
+
+func (t leaseTable) acquire(key string, owner string, ttl time.Duration, now time.Time) bool {
+	if lease, found := t[key]; found && lease.Owner != owner && !lease.isExpired(now) {
+		return false
+	}
+	t[key] = Lease{Key: key, Owner: owner, ExpiresAt: now.Add(ttl)}
+	return true
+}
+
+func (t leaseTable) release(key string, owner string) {
+	if lease, found := t[key]; found && lease.Owner == owner {
+		delete(t, key)
+	}
+}
+
+func (t leaseTable) list(prefix string, now time.Time) []Lease {
+	leases := make([]Lease, 0)
+	for key, lease := range t {
+		if strings.HasPrefix(key, prefix) && !lease.isExpired(now) {
+			leases = append(leases, lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Key < leases[j].Key })
+	return leases
+}
+
+func (t leaseTable) removeExpired(now time.Time) {
+	for key, lease := range t {
+		if lease.isExpired(now) {
+			delete(t, key)
+		}
+	}
+}
+
+type MemoryLeaseStore struct {
+	// implements interface LeaseStore
+	// the members of the group must share the same instance (single process)
+	leases leaseTable
+	mu     sync.Mutex
+}
+
+func (s *MemoryLeaseStore) AcquireLease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.leases.acquire(key, owner, ttl, time.Now()), nil
+}
+
+func (s *MemoryLeaseStore) ReleaseLease(ctx context.Context, key string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leases.release(key, owner)
+	return nil
+}
+
+func (s *MemoryLeaseStore) ListLeases(ctx context.Context, prefix string) ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.leases.list(prefix, time.Now()), nil
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: make(leaseTable)}
+}
+
+// FileLockStaleAfter is the age after which a lock file is considered abandoned (the process holding it has crashed).
+const FileLockStaleAfter = 10 * time.Second
+
+type FileLeaseStore struct {
+	// implements interface LeaseStore
+	// the leases are stored in a json file shared by the processes of a single host,
+	// the file is protected by a lock file (created atomically with a unique token)
+	directory string
+	mu        sync.Mutex
+}
+
+var ErrLeaseStoreLocked = errors.New("lease store is locked")
+
+func (s *FileLeaseStore) filePath() string {
+	return filepath.Join(s.directory, "leases.json")
+}
+
+func (s *FileLeaseStore) lockFilePath() string {
+	return filepath.Join(s.directory, "leases.lock")
+}
+
+// update runs f on the leases while holding the lock, the leases are saved if f returns true.
+func (s *FileLeaseStore) update(ctx context.Context, f func(leases leaseTable, now time.Time) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.unlock(token)
+
+	leases := make(leaseTable)
+	data, err := os.ReadFile(s.filePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &leases); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if !f(leases, now) {
+		return nil
+	}
+
+	leases.removeExpired(now)
+	data, err = json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+
+	tmpFilePath, err := s.writeTempFile(".leases-*.tmp", data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilePath) // no effect once renamed
+	return os.Rename(tmpFilePath, s.filePath())
+}
+
+// writeTempFile writes data to a new temporary file of the directory and returns its path.
+func (s *FileLeaseStore) writeTempFile(pattern string, data []byte) (string, error) {
+	tmpFile, err := os.CreateTemp(s.directory, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// lock creates the lock file, it waits while another process holds it.
+// The lock file is a temporary file holding a unique token which is linked to the lock file path
+// (the link fails if the lock file exists), it returns the token.
+func (s *FileLeaseStore) lock(ctx context.Context) (string, error) {
+	token := uuid.New().String()
+	tmpFilePath, err := s.writeTempFile(".leases-*.lock", []byte(token))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFilePath)
+
+	for {
+		err := os.Link(tmpFilePath, s.lockFilePath())
+		if err == nil {
+			return token, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+
+		if s.removeStaleLock() {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ErrLeaseStoreLocked
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// removeStaleLock removes the lock file if the process holding it has crashed, it returns true if removed.
+// The lock file is renamed first so that a single process takes it over, and the file which has been
+// renamed is checked again: if another process has locked meanwhile its lock file is put back.
+func (s *FileLeaseStore) removeStaleLock() bool {
+	if info, err := os.Stat(s.lockFilePath()); err != nil || time.Since(info.ModTime()) <= FileLockStaleAfter {
+		return false
+	}
+
+	staleFilePath := filepath.Join(s.directory, ".leases-"+uuid.New().String()+".stale")
+	if err := os.Rename(s.lockFilePath(), staleFilePath); err != nil {
+		// another process has taken the lock over
+		return false
+	}
+	defer os.Remove(staleFilePath)
+
+	if info, err := os.Stat(staleFilePath); err == nil && time.Since(info.ModTime()) > FileLockStaleAfter {
+		return true
+	}
+	_ = os.Link(staleFilePath, s.lockFilePath())
+	return false
+}
+
+// unlock removes the lock file if it still holds the token (it has not been taken over).
+func (s *FileLeaseStore) unlock(token string) {
+	if data, err := os.ReadFile(s.lockFilePath()); err == nil && string(data) == token {
+		_ = os.Remove(s.lockFilePath())
+	}
+}
+
+func (s *FileLeaseStore) AcquireLease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := s.update(ctx, func(leases leaseTable, now time.Time) bool {
+		acquired = leases.acquire(key, owner, ttl, now)
+		return acquired
+	})
+	return acquired && err == nil, err
+}
+
+func (s *FileLeaseStore) ReleaseLease(ctx context.Context, key string, owner string) error {
+	return s.update(ctx, func(leases leaseTable, now time.Time) bool {
+		leases.release(key, owner)
+		return true
+	})
+}
+
+func (s *FileLeaseStore) ListLeases(ctx context.Context, prefix string) ([]Lease, error) {
+	var leases []Lease
+	err := s.update(ctx, func(table leaseTable, now time.Time) bool {
+		leases = table.list(prefix, now)
+		return false
+	})
+	return leases, err
+}
+
+func NewFileLeaseStore(directory string) (*FileLeaseStore, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileLeaseStore{directory: directory}, nil
+}
@@ -0,0 +1,240 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// mockLeaseLogClient is an in-memory stream for the StreamLeaseStore.
+type mockLeaseLogClient struct {
+	MockConsumerClient
+	records   []interface{}
+	iterators map[uuid.UUID]int // position of the iterators
+	logMu     sync.Mutex
+}
+
+func (m *mockLeaseLogClient) PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*PutRecordsResponse, *http.Response, *APIError) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	for _, record := range records {
+		// the records are read back as json objects
+		r := record.(leaseLogRecord)
+		msg := map[string]interface{}{"op": r.Operation, "key": r.Key, "owner": r.Owner, "ttlMs": float64(r.TTL), "nonce": r.Nonce}
+		m.records = append(m.records, map[string]interface{}{
+			"i": float64(len(m.records) + 1),
+			"d": time.Now().Format(time.RFC3339Nano),
+			"m": msg,
+		})
+	}
+	return &PutRecordsResponse{Status: StatusSuccess}, nil, nil
+}
+
+func (m *mockLeaseLogClient) CreateRecordsIterator(ctx context.Context, streamUUID uuid.UUID, p *RecordsIteratorParams) (*CreateRecordsIteratorResponse, *APIError) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	position := 0
+	if p.IteratorType == IteratorTypeAfterMessageId {
+		position = int(*p.MessageId)
+	}
+	iteratorUUID := uuid.New()
+	m.iterators[iteratorUUID] = position
+	return &CreateRecordsIteratorResponse{Status: StatusSuccess, StreamUUID: streamUUID, StreamIteratorUUID: iteratorUUID}, nil
+}
+
+func (m *mockLeaseLogClient) GetRecords(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+
+	position := m.iterators[streamIteratorUUID]
+	records := append([]interface{}{}, m.records[position:]...)
+	m.iterators[streamIteratorUUID] = len(m.records)
+	return &GetStreamRecordsResponse{Status: StatusSuccess, Count: len(records), Records: records}, nil, nil
+}
+
+func newMockLeaseLogClient() *mockLeaseLogClient {
+	return &mockLeaseLogClient{iterators: make(map[uuid.UUID]int)}
+}
+
+func TestLeaseStores(t *testing.T) {
+	logClient := newMockLeaseLogClient()
+	streamUUID := uuid.New()
+	newStreamLeaseStore := func() LeaseStore {
+		store := NewStreamLeaseStore(logClient, streamUUID)
+		store.PollInterval = time.Millisecond
+		return store
+	}
+	fileStore, err := NewFileLeaseStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileLeaseStore() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		// two instances of the store (members of the group)
+		first  LeaseStore
+		second LeaseStore
+	}{
+		{name: "memory", first: NewMemoryLeaseStore()},
+		{name: "file", first: fileStore},
+		{name: "stream", first: newStreamLeaseStore(), second: newStreamLeaseStore()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			first, second := tt.first, tt.second
+			if second == nil {
+				second = first
+			}
+
+			acquire := func(store LeaseStore, key string, owner string, ttl time.Duration, expected bool) {
+				t.Helper()
+				acquired, err := store.AcquireLease(ctx, key, owner, ttl)
+				if err != nil || acquired != expected {
+					t.Fatalf("AcquireLease(%s, %s) = %v, %v, want %v", key, owner, acquired, err, expected)
+				}
+			}
+
+			acquire(first, "group/a", "member-1", time.Minute, true)
+			acquire(second, "group/a", "member-2", time.Minute, false)
+			// renew
+			acquire(first, "group/a", "member-1", time.Minute, true)
+			acquire(second, "group/b", "member-2", time.Minute, true)
+			acquire(second, "other/c", "member-2", time.Minute, true)
+
+			leases, err := second.ListLeases(ctx, "group/")
+			if err != nil {
+				t.Fatalf("ListLeases() error = %v", err)
+			}
+			owners := make([]string, len(leases))
+			for idx, lease := range leases {
+				owners[idx] = lease.Key + "=" + lease.Owner
+			}
+			if expected := []string{"group/a=member-1", "group/b=member-2"}; !reflect.DeepEqual(owners, expected) {
+				t.Errorf("ListLeases() = %v, want %v", owners, expected)
+			}
+
+			// release
+			if err := second.ReleaseLease(ctx, "group/a", "member-2"); err != nil {
+				t.Fatalf("ReleaseLease() error = %v", err)
+			}
+			acquire(second, "group/a", "member-2", time.Minute, false)
+			if err := first.ReleaseLease(ctx, "group/a", "member-1"); err != nil {
+				t.Fatalf("ReleaseLease() error = %v", err)
+			}
+			acquire(second, "group/a", "member-2", 50*time.Millisecond, true)
+
+			// expiration
+			time.Sleep(100 * time.Millisecond)
+			acquire(first, "group/a", "member-1", time.Minute, true)
+		})
+	}
+}
+
+func TestFileLeaseStoreConcurrentAcquire(t *testing.T) {
+	// the processes sharing the directory find a stale lock file, a single one must get the lease
+	const members = 16
+	directory := t.TempDir()
+	stores := make([]*FileLeaseStore, members)
+	for idx := range stores {
+		store, err := NewFileLeaseStore(directory)
+		if err != nil {
+			t.Fatalf("NewFileLeaseStore() error = %v", err)
+		}
+		stores[idx] = store
+	}
+
+	for round := 0; round < 20; round++ {
+		lockFilePath := stores[0].lockFilePath()
+		if err := os.WriteFile(lockFilePath, []byte("crashed"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		staleTime := time.Now().Add(-2 * FileLockStaleAfter)
+		if err := os.Chtimes(lockFilePath, staleTime, staleTime); err != nil {
+			t.Fatalf("Chtimes() error = %v", err)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		owners := make([]string, 0)
+		for idx, store := range stores {
+			wg.Add(1)
+			go func(store *FileLeaseStore, owner string) {
+				defer wg.Done()
+				acquired, err := store.AcquireLease(context.Background(), fmt.Sprintf("group/%d", round), owner, time.Minute)
+				if err != nil {
+					t.Errorf("AcquireLease() error = %v", err)
+				}
+				if acquired {
+					mu.Lock()
+					owners = append(owners, owner)
+					mu.Unlock()
+				}
+			}(store, fmt.Sprintf("member-%d", idx))
+		}
+		wg.Wait()
+		if len(owners) != 1 {
+			t.Fatalf("round %d: owners = %v, want a single owner", round, owners)
+		}
+	}
+
+	// the lock and the temporary files are removed
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "leases.json" {
+		names := make([]string, len(entries))
+		for idx, entry := range entries {
+			names[idx] = entry.Name()
+		}
+		t.Errorf("files = %v, want %v", names, []string{"leases.json"})
+	}
+}
+
+func TestFileLeaseStoreStaleLockTakeover(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	first, _ := NewFileLeaseStore(directory)
+	second, _ := NewFileLeaseStore(directory)
+
+	firstToken, err := first.lock(ctx)
+	if err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+	// a fresh lock is not taken over
+	if second.removeStaleLock() {
+		t.Fatalf("removeStaleLock() = true, want false for a fresh lock")
+	}
+
+	// the first process looks crashed, the second one takes the lock over
+	staleTime := time.Now().Add(-2 * FileLockStaleAfter)
+	if err := os.Chtimes(first.lockFilePath(), staleTime, staleTime); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+	secondToken, err := second.lock(ctx)
+	if err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+
+	// the first process must not remove the lock of the second one
+	first.unlock(firstToken)
+	if data, err := os.ReadFile(second.lockFilePath()); err != nil || string(data) != secondToken {
+		t.Fatalf("lock file = %q, %v, want %q", data, err, secondToken)
+	}
+	second.unlock(secondToken)
+	if _, err := os.Stat(second.lockFilePath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file error = %v, want %v", err, os.ErrNotExist)
+	}
+}
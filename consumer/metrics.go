@@ -0,0 +1,67 @@
+package ministreamconsumer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConsumerMetrics shows where the consumer spends its time.
+type ConsumerMetrics struct {
+	FetchCount          int64         // number of GetRecords calls
+	FetchDuration       time.Duration // total time spent in GetRecords calls
+	ProcessCount        int64         // number of responses processed by the handler
+	ProcessDuration     time.Duration // total time spent processing the responses
+	WaitForPageTime     time.Duration // total time the handler waited for the next page (prefetch buffer empty)
+	WaitForBufferTime   time.Duration // total time the prefetcher waited for a free slot (prefetch buffer full)
+	BufferedPages       int           // responses currently waiting in the prefetch buffer
+	RecordsCount        int64         // number of records received
+	FetchErrorsCount    int64         // number of GetRecords calls which failed
+	LastFetchDuration   time.Duration
+	LastProcessDuration time.Duration
+}
+
+type consumerMetrics struct {
+	fetchCount          atomic.Int64
+	fetchDuration       atomic.Int64
+	processCount        atomic.Int64
+	processDuration     atomic.Int64
+	waitForPageTime     atomic.Int64
+	waitForBufferTime   atomic.Int64
+	recordsCount        atomic.Int64
+	fetchErrorsCount    atomic.Int64
+	lastFetchDuration   atomic.Int64
+	lastProcessDuration atomic.Int64
+	bufferedPages       atomic.Int64
+}
+
+func (m *consumerMetrics) addFetch(duration time.Duration, cptRecords int, failed bool) {
+	m.fetchCount.Add(1)
+	m.fetchDuration.Add(int64(duration))
+	m.lastFetchDuration.Store(int64(duration))
+	m.recordsCount.Add(int64(cptRecords))
+	if failed {
+		m.fetchErrorsCount.Add(1)
+	}
+}
+
+func (m *consumerMetrics) addProcess(duration time.Duration) {
+	m.processCount.Add(1)
+	m.processDuration.Add(int64(duration))
+	m.lastProcessDuration.Store(int64(duration))
+}
+
+func (m *consumerMetrics) snapshot() ConsumerMetrics {
+	return ConsumerMetrics{
+		FetchCount:          m.fetchCount.Load(),
+		FetchDuration:       time.Duration(m.fetchDuration.Load()),
+		ProcessCount:        m.processCount.Load(),
+		ProcessDuration:     time.Duration(m.processDuration.Load()),
+		WaitForPageTime:     time.Duration(m.waitForPageTime.Load()),
+		WaitForBufferTime:   time.Duration(m.waitForBufferTime.Load()),
+		BufferedPages:       int(m.bufferedPages.Load()),
+		RecordsCount:        m.recordsCount.Load(),
+		FetchErrorsCount:    m.fetchErrorsCount.Load(),
+		LastFetchDuration:   time.Duration(m.lastFetchDuration.Load()),
+		LastProcessDuration: time.Duration(m.lastProcessDuration.Load()),
+	}
+}
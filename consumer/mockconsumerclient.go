@@ -0,0 +1,159 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// MockGetRecordsResult is a scripted result of MockConsumerClient.GetRecords.
+type MockGetRecordsResult struct {
+	Response     *GetStreamRecordsResponse
+	HttpResponse *http.Response
+	Error        *APIError
+}
+
+type MockConsumerClient struct {
+	// implements interface IConsumerClient
+	// the scripted results are consumed in order, once a script is exhausted the calls succeed
+	// (GetRecords returns an empty response)
+	AuthenticateErrors          []*APIError
+	CreateRecordsIteratorErrors []*APIError
+	GetRecordsResults           []MockGetRecordsResult
+	GetRecordsResultsByStream   map[uuid.UUID][]MockGetRecordsResult // scripts of a given stream (instead of GetRecordsResults)
+	CloseRecordsIteratorErrors  []*APIError
+	StreamInformation           *StreamInformation      // result of GetStreamInformation (error if nil)
+	Calls                       []string                // names of the methods called, in order
+	IteratorParams              []RecordsIteratorParams // parameters of the CreateRecordsIterator calls
+	CptDisconnect               int
+	mu                          sync.Mutex
+}
+
+func (m *MockConsumerClient) Disconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "Disconnect")
+	m.CptDisconnect++
+}
+
+func (m *MockConsumerClient) Authenticate(ctx context.Context) *APIError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "Authenticate")
+	return popMockError(&m.AuthenticateErrors)
+}
+
+func (m *MockConsumerClient) CreateRecordsIterator(ctx context.Context, streamUUID uuid.UUID, p *RecordsIteratorParams) (*CreateRecordsIteratorResponse, *APIError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "CreateRecordsIterator")
+	m.IteratorParams = append(m.IteratorParams, *p)
+	if apiError := popMockError(&m.CreateRecordsIteratorErrors); apiError != nil {
+		return nil, apiError
+	}
+
+	return &CreateRecordsIteratorResponse{Status: StatusSuccess, StreamUUID: streamUUID, StreamIteratorUUID: uuid.New()}, nil
+}
+
+func (m *MockConsumerClient) GetRecords(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "GetRecords")
+	results := &m.GetRecordsResults
+	if streamResults, found := m.GetRecordsResultsByStream[streamUUID]; found {
+		results = &streamResults
+		defer func() { m.GetRecordsResultsByStream[streamUUID] = streamResults }()
+	}
+	if len(*results) == 0 {
+		response := GetStreamRecordsResponse{Status: StatusSuccess, StreamUUID: streamUUID, StreamIteratorUUID: streamIteratorUUID, Records: []interface{}{}}
+		return &response, nil, nil
+	}
+
+	result := (*results)[0]
+	*results = (*results)[1:]
+	if result.Response != nil {
+		result.Response.StreamUUID = streamUUID
+		result.Response.StreamIteratorUUID = streamIteratorUUID
+	}
+	return result.Response, result.HttpResponse, result.Error
+}
+
+func (m *MockConsumerClient) CloseRecordsIterator(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID) *APIError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "CloseRecordsIterator")
+	return popMockError(&m.CloseRecordsIteratorErrors)
+}
+
+func (m *MockConsumerClient) GetStreamInformation(ctx context.Context, streamUUID uuid.UUID) (*StreamInformation, *APIError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Calls = append(m.Calls, "GetStreamInformation")
+	if m.StreamInformation == nil {
+		return nil, &APIError{Message: "stream not found", StreamUUID: streamUUID}
+	}
+	stream := *m.StreamInformation
+	return &stream, nil
+}
+
+// SetStreamInformation changes the result of GetStreamInformation.
+func (m *MockConsumerClient) SetStreamInformation(stream *StreamInformation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.StreamInformation = stream
+}
+
+// CountCalls returns the number of calls of the method.
+func (m *MockConsumerClient) CountCalls(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cpt := 0
+	for _, call := range m.Calls {
+		if call == method {
+			cpt++
+		}
+	}
+	return cpt
+}
+
+func popMockError(errors *[]*APIError) *APIError {
+	if len(*errors) == 0 {
+		return nil
+	}
+	apiError := (*errors)[0]
+	*errors = (*errors)[1:]
+	return apiError
+}
+
+// NewMockGetRecordsResponse builds a response with count records, numbered from firstMessageId,
+// the records have the same shape as the ones decoded from the server json response.
+func NewMockGetRecordsResponse(firstMessageId MessageId, count int, remain bool) *GetStreamRecordsResponse {
+	records := make([]interface{}, count)
+	creationDate := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for idx := range records {
+		messageId := firstMessageId + MessageId(idx)
+		records[idx] = map[string]interface{}{
+			"i": float64(messageId),
+			"d": creationDate.Add(time.Duration(messageId) * time.Second).Format(time.RFC3339Nano),
+			"m": map[string]interface{}{"msg": "hello world"},
+		}
+	}
+	return &GetStreamRecordsResponse{Status: StatusSuccess, Count: count, Remain: remain, Records: records}
+}
+
+func NewMockConsumerClient() *MockConsumerClient {
+	return &MockConsumerClient{
+		Calls: make([]string, 0),
+	}
+}
@@ -0,0 +1,135 @@
+package ministreamconsumer
+
+import (
+	"io"
+	"log"
+	"sync"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+type MockConsumerHandler struct {
+	// implements interface StreamConsumerHandler
+	Client            IConsumerClient
+	Logger            *log.Logger
+	Params            RecordsIteratorParams
+	Events            []string // names of the events received, in order
+	MessageIds        []MessageId
+	StopOnCptRecords  int  // stop the consumption once this number of records is processed (0 to disable)
+	ContinueOnFailure bool // value returned by the failure events
+	mu                sync.Mutex
+}
+
+func (h *MockConsumerHandler) GetLogger() *log.Logger {
+	if h.Logger == nil {
+		h.Logger = log.New(io.Discard, "MockConsumerHandler ", log.LstdFlags)
+	}
+	return h.Logger
+}
+
+func (h *MockConsumerHandler) GetClient() IConsumerClient {
+	return h.Client
+}
+
+func (h *MockConsumerHandler) GetRecordsIteratorParams() *RecordsIteratorParams {
+	return &h.Params
+}
+
+func (h *MockConsumerHandler) OnAuthenticationSuccess() {
+	h.addEvent("OnAuthenticationSuccess")
+}
+
+func (h *MockConsumerHandler) OnAuthenticationFailure(e *APIError) bool {
+	h.addEvent("OnAuthenticationFailure")
+	return h.ContinueOnFailure
+}
+
+func (h *MockConsumerHandler) OnCreateRecordsIteratorSuccess() {
+	h.addEvent("OnCreateRecordsIteratorSuccess")
+}
+
+func (h *MockConsumerHandler) OnCreateRecordsIteratorFailure(e *APIError) bool {
+	h.addEvent("OnCreateRecordsIteratorFailure")
+	return h.ContinueOnFailure
+}
+
+func (h *MockConsumerHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	h.addEvent("OnGetRecordsSuccess")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, record := range response.Records {
+		if envelope, err := ParseRecordEnvelope(record); err == nil {
+			h.MessageIds = append(h.MessageIds, envelope.Id)
+		}
+	}
+	return h.StopOnCptRecords == 0 || len(h.MessageIds) < h.StopOnCptRecords
+}
+
+func (h *MockConsumerHandler) OnGetRecordsFailure(apiError *APIError) bool {
+	h.addEvent("OnGetRecordsFailure")
+	return h.ContinueOnFailure
+}
+
+func (h *MockConsumerHandler) OnUnexpectedError(apiError *APIError) bool {
+	h.addEvent("OnUnexpectedError")
+	return h.ContinueOnFailure
+}
+
+func (h *MockConsumerHandler) OnStart() {
+	h.addEvent("OnStart")
+}
+
+func (h *MockConsumerHandler) OnPause() {
+	h.addEvent("OnPause")
+}
+
+func (h *MockConsumerHandler) OnResume() {
+	h.addEvent("OnResume")
+}
+
+func (h *MockConsumerHandler) OnClose() {
+	h.addEvent("OnClose")
+}
+
+func (h *MockConsumerHandler) OnFatalError(apiError *APIError) {
+	h.addEvent("OnFatalError")
+}
+
+func (h *MockConsumerHandler) OnLagThresholdExceeded(lag ConsumerLag) {
+	h.addEvent("OnLagThresholdExceeded")
+}
+
+func (h *MockConsumerHandler) addEvent(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.Events = append(h.Events, event)
+}
+
+// GetEvents returns a copy of the events received.
+func (h *MockConsumerHandler) GetEvents() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]string{}, h.Events...)
+}
+
+// GetMessageIds returns a copy of the message ids processed.
+func (h *MockConsumerHandler) GetMessageIds() []MessageId {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]MessageId{}, h.MessageIds...)
+}
+
+func NewMockConsumerHandler(client IConsumerClient, stopOnCptRecords int) *MockConsumerHandler {
+	return &MockConsumerHandler{
+		Client:            client,
+		Params:            RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage},
+		Events:            make([]string, 0),
+		MessageIds:        make([]MessageId, 0),
+		StopOnCptRecords:  stopOnCptRecords,
+		ContinueOnFailure: true,
+	}
+}
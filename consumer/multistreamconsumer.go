@@ -0,0 +1,450 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// StreamStoppedHandler is an optional interface of the handlers of a MultiStreamConsumer,
+// it is notified when the consumption of a stream stops (apiError is nil if the stream has been removed or the consumer stopped).
+type StreamStoppedHandler interface {
+	OnStreamStopped(streamUUID StreamUUID, apiError *APIError)
+}
+
+// MultiStreamConsumer consumes several streams with one StreamConsumer (and one iterator) per stream.
+// The client and its authentication are shared by the streams.
+//
+// The records are given either to the shared handler (fan-in) or to the handler of the stream.
+// The handlers are called by a single goroutine, one page per stream and per round,
+// so that a stream with a lot of records can't starve the others.
+// The lifecycle events (OnStart, OnClose, ...) are sent once to the shared handler,
+// and per stream to the handlers of the streams.
+// Empty responses are not given to the handlers.
+type MultiStreamConsumer struct {
+	client           *sharedAuthClient
+	handler          StreamConsumerHandler // shared handler, may be nil if every stream has its own handler
+	handlerMu        sync.Mutex            // the shared handler is called by the streams goroutines
+	getRecordsChunks int
+	streams          map[StreamUUID]*multiStreamMember
+	order            []*multiStreamMember // round robin order
+	next             int
+	notify           chan struct{}
+	ctx              context.Context
+	cancel           context.CancelFunc
+	running          bool
+	wg               sync.WaitGroup
+	mu               sync.Mutex
+	// ConfigureConsumer is called before the consumer of a stream is started (optional),
+	// for instance to set a checkpoint store; ctx is the context of the stream.
+	ConfigureConsumer func(ctx context.Context, c *StreamConsumer)
+}
+
+type multiStreamMember struct {
+	streamUUID StreamUUID
+	handler    *multiStreamHandler
+	consumer   *StreamConsumer
+	pending    chan *pendingPage // at most one page waiting to be processed
+	cancel     context.CancelFunc
+}
+
+// pendingPage is a response waiting for the scheduler, the result is true if the consumption must go on.
+type pendingPage struct {
+	response *GetStreamRecordsResponse
+	ack      *RecordsAck
+	result   chan bool
+}
+
+type multiStreamHandler struct {
+	// implements interface StreamConsumerHandler and StreamConsumerAckHandler
+	multi  *MultiStreamConsumer
+	member *multiStreamMember
+	target StreamConsumerHandler
+	shared bool
+	ctx    context.Context
+	err    *APIError // error which has stopped the stream
+}
+
+func (h *multiStreamHandler) GetLogger() *log.Logger {
+	return h.target.GetLogger()
+}
+
+func (h *multiStreamHandler) GetClient() IConsumerClient {
+	return h.multi.client
+}
+
+func (h *multiStreamHandler) GetRecordsIteratorParams() *RecordsIteratorParams {
+	var p *RecordsIteratorParams
+	h.call(func() { p = h.target.GetRecordsIteratorParams() })
+	return p
+}
+
+func (h *multiStreamHandler) OnAuthenticationSuccess() {
+	h.forward(h.target.OnAuthenticationSuccess)
+}
+
+func (h *multiStreamHandler) OnAuthenticationFailure(e *APIError) bool {
+	return h.decide(e, h.target.OnAuthenticationFailure)
+}
+
+func (h *multiStreamHandler) OnCreateRecordsIteratorSuccess() {
+	h.forward(h.target.OnCreateRecordsIteratorSuccess)
+}
+
+func (h *multiStreamHandler) OnCreateRecordsIteratorFailure(e *APIError) bool {
+	return h.decide(e, h.target.OnCreateRecordsIteratorFailure)
+}
+
+func (h *multiStreamHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	// not called: the records are acknowledged by OnGetRecordsToAck
+	return true
+}
+
+func (h *multiStreamHandler) OnGetRecordsToAck(response *GetStreamRecordsResponse, ack *RecordsAck) bool {
+	if len(ack.Envelopes()) == 0 {
+		return true
+	}
+
+	page := &pendingPage{response: response, ack: ack, result: make(chan bool, 1)}
+	select {
+	case <-h.ctx.Done():
+		return false
+	case h.member.pending <- page:
+		h.multi.notifyScheduler()
+	}
+
+	select {
+	case mustContinue := <-page.result:
+		return mustContinue
+	case <-h.ctx.Done():
+		select {
+		case <-h.member.pending:
+			// the page has not been processed
+			return false
+		default:
+			// the page is being processed
+			return <-page.result
+		}
+	}
+}
+
+func (h *multiStreamHandler) OnGetRecordsFailure(e *APIError) bool {
+	return h.decide(e, h.target.OnGetRecordsFailure)
+}
+
+func (h *multiStreamHandler) OnUnexpectedError(e *APIError) bool {
+	return h.decide(e, h.target.OnUnexpectedError)
+}
+
+func (h *multiStreamHandler) OnStart() {
+	h.err = nil
+	h.forward(h.target.OnStart)
+}
+
+func (h *multiStreamHandler) OnPause() {
+	h.forward(h.target.OnPause)
+}
+
+func (h *multiStreamHandler) OnResume() {
+	h.forward(h.target.OnResume)
+}
+
+func (h *multiStreamHandler) OnClose() {
+	h.forward(h.target.OnClose)
+}
+
+func (h *multiStreamHandler) OnFatalError(apiError *APIError) {
+	h.err = apiError
+	if fatalErrorHandler, ok := h.target.(StreamConsumerFatalErrorHandler); ok {
+		h.call(func() { fatalErrorHandler.OnFatalError(apiError) })
+	}
+}
+
+// forward sends a lifecycle event to the handler of the stream (not to the shared handler).
+func (h *multiStreamHandler) forward(event func()) {
+	if !h.shared {
+		event()
+	}
+}
+
+// decide asks the handler what to do about an error, the stream stops if the answer is false.
+func (h *multiStreamHandler) decide(e *APIError, event func(e *APIError) bool) bool {
+	mustContinue := false
+	h.call(func() { mustContinue = event(e) })
+	if !mustContinue {
+		h.err = e
+	}
+	return mustContinue
+}
+
+// call runs f, calls to the shared handler are serialized.
+func (h *multiStreamHandler) call(f func()) {
+	if h.shared {
+		h.multi.handlerMu.Lock()
+		defer h.multi.handlerMu.Unlock()
+	}
+	f()
+}
+
+// process gives a page to the handler, the records are acknowledged unless the handler does it itself.
+func (h *multiStreamHandler) process(page *pendingPage) {
+	mustContinue := false
+	defer func() {
+		// a panic of the handler stops the stream, not the host process
+		if r := recover(); r != nil {
+			h.err = &APIError{Message: "consumer panic", Details: fmt.Sprint(r), StreamUUID: h.member.streamUUID}
+			page.result <- false
+		}
+	}()
+
+	h.call(func() {
+		if ackHandler, ok := h.target.(StreamConsumerAckHandler); ok {
+			mustContinue = ackHandler.OnGetRecordsToAck(page.response, page.ack)
+		} else {
+			mustContinue = h.target.OnGetRecordsSuccess(page.response)
+			// the records have been processed, even if the handler has decided to stop the consumption
+			page.ack.AckAll()
+		}
+	})
+
+	if !mustContinue && h.shared {
+		// the shared handler has decided to stop the consumption of all the streams
+		h.multi.Stop()
+	}
+	page.result <- mustContinue
+}
+
+func (h *multiStreamHandler) onStreamStopped(apiError *APIError) {
+	if stoppedHandler, ok := h.target.(StreamStoppedHandler); ok {
+		h.call(func() { stoppedHandler.OnStreamStopped(h.member.streamUUID, apiError) })
+	}
+}
+
+// AddStream adds a stream to consume, handler is the handler of the stream (nil to use the shared handler).
+// The stream is started immediately if the consumer is running.
+func (m *MultiStreamConsumer) AddStream(streamUUID StreamUUID, handler StreamConsumerHandler) *APIError {
+	shared := handler == nil
+	if shared {
+		if m.handler == nil {
+			return &APIError{Message: "the stream must have a handler (there is no shared handler)", StreamUUID: streamUUID}
+		}
+		handler = m.handler
+	}
+
+	m.mu.Lock()
+	if _, found := m.streams[streamUUID]; found {
+		m.mu.Unlock()
+		return &APIError{Message: "the stream is already consumed", StreamUUID: streamUUID}
+	}
+
+	member := &multiStreamMember{streamUUID: streamUUID, pending: make(chan *pendingPage, 1)}
+	member.handler = &multiStreamHandler{multi: m, member: member, target: handler, shared: shared}
+	m.streams[streamUUID] = member
+	m.order = append(m.order, member)
+	running := m.running
+	if running {
+		m.startStream(member)
+	}
+	m.mu.Unlock()
+
+	if running {
+		m.launchStream(member)
+	}
+	return nil
+}
+
+// RemoveStream stops the consumption of a stream, the iterator is closed in the background.
+func (m *MultiStreamConsumer) RemoveStream(streamUUID StreamUUID) *APIError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, found := m.streams[streamUUID]
+	if !found {
+		return &APIError{Message: "the stream is not consumed", StreamUUID: streamUUID}
+	}
+
+	m.removeMember(member)
+	if member.cancel != nil {
+		member.cancel()
+	}
+	return nil
+}
+
+// GetStreams returns the streams of the consumer, they are kept until they are removed
+// (a stream stopped by an error is started again by the next Run).
+func (m *MultiStreamConsumer) GetStreams() []StreamUUID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	streams := make([]StreamUUID, len(m.order))
+	for idx, member := range m.order {
+		streams[idx] = member.streamUUID
+	}
+	return streams
+}
+
+// Run consumes the streams until ctx is canceled or Stop is called.
+func (m *MultiStreamConsumer) Run(ctx context.Context) *APIError {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return &APIError{Message: "the consumer is already running"}
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.running = true
+	members := append([]*multiStreamMember{}, m.order...)
+	for _, member := range members {
+		m.startStream(member)
+	}
+	m.mu.Unlock()
+
+	for _, member := range members {
+		m.launchStream(member)
+	}
+
+	if m.handler != nil {
+		m.callSharedHandler(m.handler.OnStart)
+	}
+
+	m.schedule()
+
+	// wait for the streams to stop (the iterators are closed)
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+
+	if m.handler != nil {
+		m.callSharedHandler(m.handler.OnClose)
+	}
+	m.client.client.Disconnect()
+	return nil
+}
+
+// Stop stops the consumption of all the streams.
+func (m *MultiStreamConsumer) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// schedule gives the pages to the handlers, one page per stream and per round.
+func (m *MultiStreamConsumer) schedule() {
+	for {
+		processed := false
+		for _, member := range m.nextRound() {
+			select {
+			case page := <-member.pending:
+				member.handler.process(page)
+				processed = true
+			default:
+			}
+		}
+
+		if processed {
+			continue
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.notify:
+		}
+	}
+}
+
+// nextRound returns the streams in round robin order, the first stream changes at every round.
+func (m *MultiStreamConsumer) nextRound() []*multiStreamMember {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	round := make([]*multiStreamMember, 0, len(m.order))
+	if len(m.order) == 0 {
+		return round
+	}
+	m.next = (m.next + 1) % len(m.order)
+	round = append(round, m.order[m.next:]...)
+	return append(round, m.order[:m.next]...)
+}
+
+func (m *MultiStreamConsumer) notifyScheduler() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// startStream creates the consumer of the stream (m.mu must be held), it must be followed by launchStream.
+func (m *MultiStreamConsumer) startStream(member *multiStreamMember) {
+	ctxStream, cancel := context.WithCancel(m.ctx)
+	member.cancel = cancel
+	member.handler.ctx = ctxStream
+	member.consumer = CreateConsumer(ctxStream, member.streamUUID, member.handler, m.getRecordsChunks)
+	// Run waits for the stream, even if it is not launched yet
+	m.wg.Add(1)
+}
+
+// launchStream configures the consumer of the stream then runs it in a goroutine (m.mu must not be held,
+// ConfigureConsumer may call the methods of the consumer).
+func (m *MultiStreamConsumer) launchStream(member *multiStreamMember) {
+	ctxStream := member.handler.ctx
+	consumer := member.consumer
+	if m.ConfigureConsumer != nil {
+		m.ConfigureConsumer(ctxStream, consumer)
+	}
+
+	go func() {
+		defer m.wg.Done()
+		defer member.cancel()
+
+		apiError := consumer.Run(ctxStream)
+		if member.handler.err != nil {
+			apiError = member.handler.err
+		} else if ctxStream.Err() != nil {
+			apiError = nil
+		}
+
+		// the stream is kept (it is started again by the next Run), only RemoveStream removes it
+		member.handler.onStreamStopped(apiError)
+	}()
+}
+
+// removeMember removes the stream from the consumer (m.mu must be held).
+func (m *MultiStreamConsumer) removeMember(member *multiStreamMember) {
+	delete(m.streams, member.streamUUID)
+	for idx, other := range m.order {
+		if other == member {
+			m.order = append(m.order[:idx], m.order[idx+1:]...)
+			break
+		}
+	}
+}
+
+func (m *MultiStreamConsumer) callSharedHandler(event func()) {
+	m.handlerMu.Lock()
+	defer m.handlerMu.Unlock()
+	event()
+}
+
+// NewMultiStreamConsumer creates a consumer of several streams sharing the client,
+// handler is the shared handler of the streams (it may be nil if every stream is added with its own handler).
+func NewMultiStreamConsumer(client IConsumerClient, handler StreamConsumerHandler, getRecordsChunks int) *MultiStreamConsumer {
+	return &MultiStreamConsumer{
+		client:           newSharedAuthClient(client),
+		handler:          handler,
+		getRecordsChunks: getRecordsChunks,
+		streams:          make(map[StreamUUID]*multiStreamMember),
+		order:            make([]*multiStreamMember, 0),
+		notify:           make(chan struct{}, 1),
+	}
+}
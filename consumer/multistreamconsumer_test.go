@@ -0,0 +1,285 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+	"github.com/nbigot/ministream-client-go/ministreamtest"
+)
+
+// mockMultiStreamHandler records the streams of the pages and the stopped streams.
+type mockMultiStreamHandler struct {
+	*MockConsumerHandler
+	ProcessingTime time.Duration
+	Streams        []StreamUUID // stream of each page, in order
+	Stopped        chan StreamUUID
+	mu             sync.Mutex
+}
+
+func (h *mockMultiStreamHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	time.Sleep(h.ProcessingTime)
+	h.mu.Lock()
+	h.Streams = append(h.Streams, response.StreamUUID)
+	h.mu.Unlock()
+	return h.MockConsumerHandler.OnGetRecordsSuccess(response)
+}
+
+func (h *mockMultiStreamHandler) OnStreamStopped(streamUUID StreamUUID, apiError *APIError) {
+	h.Stopped <- streamUUID
+}
+
+func (h *mockMultiStreamHandler) GetStreams() []StreamUUID {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]StreamUUID{}, h.Streams...)
+}
+
+func newMockMultiStreamHandler(client *MockConsumerClient, stopOnCptRecords int) *mockMultiStreamHandler {
+	return &mockMultiStreamHandler{
+		MockConsumerHandler: NewMockConsumerHandler(client, stopOnCptRecords),
+		Stopped:             make(chan StreamUUID, 10),
+	}
+}
+
+func newTestMultiStreamConsumer(client *MockConsumerClient, handler StreamConsumerHandler) *MultiStreamConsumer {
+	m := NewMultiStreamConsumer(client, handler, 100)
+	m.ConfigureConsumer = func(ctx context.Context, c *StreamConsumer) {
+		c.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+	}
+	return m
+}
+
+func waitStreamStopped(t *testing.T, handler *mockMultiStreamHandler, expected StreamUUID) {
+	select {
+	case streamUUID := <-handler.Stopped:
+		if streamUUID != expected {
+			t.Fatalf("OnStreamStopped(%v), want %v", streamUUID, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnStreamStopped(%v) not called", expected)
+	}
+}
+
+func TestMultiStreamConsumerFanIn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	streams := []StreamUUID{uuid.New(), uuid.New(), uuid.New()}
+	client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+		streams[0]: {{Response: NewMockGetRecordsResponse(1, 5, false)}},
+		streams[1]: {{Response: NewMockGetRecordsResponse(1, 5, true)}, {Response: NewMockGetRecordsResponse(6, 5, false)}},
+		streams[2]: {{Response: NewMockGetRecordsResponse(1, 5, false)}},
+	}}
+	handler := newMockMultiStreamHandler(client, 20)
+	multi := newTestMultiStreamConsumer(client, handler)
+	for _, streamUUID := range streams {
+		if err := multi.AddStream(streamUUID, nil); err != nil {
+			t.Fatalf("AddStream() = %v", err)
+		}
+	}
+
+	if err := multi.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatalf("the shared handler must stop the consumer")
+	}
+	if cpt := len(handler.GetMessageIds()); cpt != 20 {
+		t.Errorf("records received = %d, want %d", cpt, 20)
+	}
+	if cpt := client.CountCalls("Authenticate"); cpt != 1 {
+		t.Errorf("Authenticate calls = %d, want %d", cpt, 1)
+	}
+	if cpt := client.CountCalls("CloseRecordsIterator"); cpt != len(streams) {
+		t.Errorf("CloseRecordsIterator calls = %d, want %d", cpt, len(streams))
+	}
+	if client.CptDisconnect != 1 {
+		t.Errorf("Disconnect calls = %d, want %d", client.CptDisconnect, 1)
+	}
+	// the lifecycle events are sent once to the shared handler
+	expectedEvents := []string{"OnStart", "OnGetRecordsSuccess", "OnGetRecordsSuccess", "OnGetRecordsSuccess", "OnGetRecordsSuccess", "OnClose"}
+	if events := handler.GetEvents(); !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events = %v, want %v", events, expectedEvents)
+	}
+}
+
+func TestMultiStreamConsumerFairScheduling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hot := uuid.New()
+	cold := uuid.New()
+	hotResults := make([]MockGetRecordsResult, 0)
+	for idx := 0; idx < 20; idx++ {
+		hotResults = append(hotResults, MockGetRecordsResult{Response: NewMockGetRecordsResponse(MessageId(1+idx*10), 10, true)})
+	}
+	client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+		hot: hotResults,
+		cold: {
+			{Response: NewMockGetRecordsResponse(1, 1, true)},
+			{Response: NewMockGetRecordsResponse(2, 1, true)},
+			{Response: NewMockGetRecordsResponse(3, 1, false)},
+		},
+	}}
+	handler := newMockMultiStreamHandler(client, 203)
+	handler.ProcessingTime = 5 * time.Millisecond
+	multi := newTestMultiStreamConsumer(client, handler)
+	_ = multi.AddStream(hot, nil)
+	_ = multi.AddStream(cold, nil)
+
+	if err := multi.Run(ctx); err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	// the pages of the streams are interleaved: the cold stream is served at every round
+	pages := handler.GetStreams()
+	lastColdPage := -1
+	for idx, streamUUID := range pages {
+		if streamUUID == cold {
+			lastColdPage = idx
+		}
+	}
+	if lastColdPage < 0 || lastColdPage > 6 {
+		t.Errorf("last page of the cold stream = %d, want <= %d (pages: %d)", lastColdPage, 6, len(pages))
+	}
+}
+
+func TestMultiStreamConsumerPerStreamHandlers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := uuid.New()
+	second := uuid.New()
+	removed := uuid.New()
+	client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+		first:   {{Response: NewMockGetRecordsResponse(1, 3, false)}},
+		second:  {{Response: NewMockGetRecordsResponse(100, 2, true)}, {Response: NewMockGetRecordsResponse(102, 2, false)}},
+		removed: {},
+	}}
+	firstHandler := newMockMultiStreamHandler(client, 3)
+	secondHandler := newMockMultiStreamHandler(client, 4)
+	removedHandler := newMockMultiStreamHandler(client, 0)
+	multi := newTestMultiStreamConsumer(client, nil)
+	if err := multi.AddStream(first, nil); err == nil {
+		t.Fatalf("AddStream() must fail without handler")
+	}
+	_ = multi.AddStream(first, firstHandler)
+	if err := multi.AddStream(first, firstHandler); err == nil {
+		t.Fatalf("AddStream() must fail when the stream is already consumed")
+	}
+	_ = multi.AddStream(removed, removedHandler)
+
+	done := make(chan *APIError)
+	go func() { done <- multi.Run(ctx) }()
+
+	// streams are added and removed at runtime
+	waitStreamStopped(t, firstHandler, first)
+	if err := multi.AddStream(second, secondHandler); err != nil {
+		t.Fatalf("AddStream() = %v", err)
+	}
+	waitStreamStopped(t, secondHandler, second)
+	if err := multi.RemoveStream(removed); err != nil {
+		t.Fatalf("RemoveStream() = %v", err)
+	}
+	waitStreamStopped(t, removedHandler, removed)
+	// the streams stopped by their handler are kept, the removed one is not
+	if streams := multi.GetStreams(); !reflect.DeepEqual(streams, []StreamUUID{first, second}) {
+		t.Errorf("GetStreams() = %v, want %v", streams, []StreamUUID{first, second})
+	}
+
+	multi.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+
+	if ids := firstHandler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 3)) {
+		t.Errorf("first stream message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 3))
+	}
+	if ids := secondHandler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(100, 103)) {
+		t.Errorf("second stream message ids = %v, want %v", ids, ministreamtest.MessageIds(100, 103))
+	}
+	// the lifecycle events are sent to the handlers of the streams
+	for _, handler := range []*mockMultiStreamHandler{firstHandler, secondHandler, removedHandler} {
+		events := handler.GetEvents()
+		if len(events) < 2 || events[0] != "OnStart" || events[len(events)-1] != "OnClose" {
+			t.Errorf("events = %v, want OnStart ... OnClose", events)
+		}
+	}
+	if cpt := client.CountCalls("Authenticate"); cpt != 1 {
+		t.Errorf("Authenticate calls = %d, want %d", cpt, 1)
+	}
+}
+
+func TestMultiStreamConsumerRunAgain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	streamUUID := uuid.New()
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 3, true)},
+		{Response: NewMockGetRecordsResponse(4, 3, true)},
+	}}
+	handler := newMockMultiStreamHandler(client, 3)
+	multi := newTestMultiStreamConsumer(client, handler)
+	configured := make([][]StreamUUID, 0)
+	multi.ConfigureConsumer = func(ctx context.Context, c *StreamConsumer) {
+		c.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+		// the consumer is configured without holding the lock of the multi-stream consumer
+		configured = append(configured, multi.GetStreams())
+	}
+	_ = multi.AddStream(streamUUID, nil)
+
+	for run, expected := range [][]MessageId{ministreamtest.MessageIds(1, 3), ministreamtest.MessageIds(1, 6)} {
+		done := make(chan *APIError, 1)
+		go func() { done <- multi.Run(ctx) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Run() = %v, want %v", err, nil)
+			}
+		case <-ctx.Done():
+			t.Fatalf("run %d: Run() has not returned", run)
+		}
+
+		if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("run %d: message ids = %v, want %v", run, ids, expected)
+		}
+		if streams := multi.GetStreams(); !reflect.DeepEqual(streams, []StreamUUID{streamUUID}) {
+			t.Errorf("run %d: GetStreams() = %v, want %v", run, streams, []StreamUUID{streamUUID})
+		}
+	}
+	if !reflect.DeepEqual(configured, [][]StreamUUID{{streamUUID}, {streamUUID}}) {
+		t.Errorf("GetStreams() from ConfigureConsumer = %v, want the stream at each run", configured)
+	}
+}
+
+func TestSharedAuthClientReauthenticates(t *testing.T) {
+	ctx := context.Background()
+	client := &MockConsumerClient{CreateRecordsIteratorErrors: []*APIError{{Code: ErrorJWTInvalidOrExpired}}}
+	shared := newSharedAuthClient(client)
+
+	_ = shared.Authenticate(ctx)
+	_ = shared.Authenticate(ctx)
+	if cpt := client.CountCalls("Authenticate"); cpt != 1 {
+		t.Errorf("Authenticate calls = %d, want %d", cpt, 1)
+	}
+
+	// the token has expired
+	_, _ = shared.CreateRecordsIterator(ctx, uuid.New(), &RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage})
+	_ = shared.Authenticate(ctx)
+	if cpt := client.CountCalls("Authenticate"); cpt != 2 {
+		t.Errorf("Authenticate calls = %d, want %d", cpt, 2)
+	}
+
+	shared.Disconnect()
+	if client.CptDisconnect != 0 {
+		t.Errorf("Disconnect calls = %d, want %d", client.CptDisconnect, 0)
+	}
+}
@@ -0,0 +1,337 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// OrderedMergeConsumer merges several streams into a single feed ordered by record creation date.
+// Records with the same creation date are ordered by stream (in the order of the streams given).
+//
+// A record is emitted once every other stream has a more recent record buffered,
+// or has not received any record for Lateness (the stream is considered idle).
+// A record received after a more recent record has been emitted is late,
+// it is emitted out of order unless DropLateRecords is set.
+//
+// Each stream is consumed by a PullConsumer, the client and its authentication are shared by the streams.
+type OrderedMergeConsumer struct {
+	client          *sharedAuthClient
+	Streams         []StreamUUID
+	Consumers       []*PullConsumer // consumer of each stream, in the order of Streams
+	Lateness        time.Duration
+	DropLateRecords bool
+	cptLateRecords  int64
+	running         bool
+	err             error
+	mu              sync.Mutex
+}
+
+// mergeInput is the state of a stream during the merge.
+type mergeInput struct {
+	records   <-chan Envelope
+	taken     chan bool // tells the consumer if the record received has been handed to the caller (see PullConsumer.start)
+	head      *Envelope // next record of the stream, it is not committed yet
+	lastSeen  time.Time // creation date of the last record received
+	idleSince time.Time // time of the last record received
+	closed    bool
+}
+
+// Records starts the consumers and returns the merged records in a channel,
+// the channel is closed when ctx is canceled or on error (see Err).
+func (m *OrderedMergeConsumer) Records(ctx context.Context) <-chan Envelope {
+	return m.start(ctx, nil)
+}
+
+// start starts the consumers, when taken is not nil the reader must send on taken for each record received from the channel
+// (see PullConsumer.start).
+func (m *OrderedMergeConsumer) start(ctx context.Context, taken <-chan bool) <-chan Envelope {
+	records := make(chan Envelope)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running {
+		close(records)
+		return records
+	}
+	m.running = true
+	m.err = nil
+
+	ctxMerge, cancel := context.WithCancel(ctx)
+	inputs := make([]*mergeInput, len(m.Consumers))
+	now := time.Now()
+	for idx, consumer := range m.Consumers {
+		// the records of the streams are committed once they are merged, not once they are buffered
+		input := mergeInput{taken: make(chan bool), idleSince: now}
+		input.records = consumer.start(ctxMerge, input.taken)
+		inputs[idx] = &input
+	}
+
+	go func() {
+		defer close(records)
+		err := m.merge(ctxMerge, inputs, records, taken)
+		cancel()
+		// wait for the consumers to stop (the iterators are closed),
+		// the records which have not been merged are not committed
+		for _, input := range inputs {
+			if input.head != nil {
+				input.taken <- false
+			}
+			for range input.records {
+				input.taken <- false
+			}
+		}
+		m.client.client.Disconnect()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.running = false
+		m.err = err
+	}()
+
+	return records
+}
+
+// All starts the consumers and returns an iterator over the merged records.
+// Stopping the iteration stops the consumers, the records are committed once they are yielded.
+func (m *OrderedMergeConsumer) All(ctx context.Context) RecordsSeq {
+	return func(yield func(Envelope, error) bool) {
+		ctxAll, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		taken := make(chan bool)
+		records := m.start(ctxAll, taken)
+		for envelope := range records {
+			taken <- true
+			if !yield(envelope, nil) {
+				cancel()
+				// wait for the consumers to stop (the records received meanwhile are not committed)
+				for range records {
+					taken <- false
+				}
+				return
+			}
+		}
+
+		if err := m.Err(); err != nil {
+			yield(Envelope{}, err)
+		}
+	}
+}
+
+// Err returns the error which has stopped the merge, nil if it has been stopped by the context.
+func (m *OrderedMergeConsumer) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// CountLateRecords returns the number of records received after a more recent record had been emitted.
+func (m *OrderedMergeConsumer) CountLateRecords() int64 {
+	return atomic.LoadInt64(&m.cptLateRecords)
+}
+
+func (m *OrderedMergeConsumer) merge(ctx context.Context, inputs []*mergeInput, records chan<- Envelope, taken <-chan bool) error {
+	var lastEmitted time.Time
+	for {
+		if err := m.receiveAvailable(inputs); err != nil {
+			return err
+		}
+
+		next := nextMergeInput(inputs)
+		if next < 0 && allMergeInputsClosed(inputs) {
+			return nil
+		}
+
+		if next >= 0 {
+			deadline, ready := m.canEmit(inputs, next)
+			if ready {
+				envelope := *inputs[next].head
+				late := envelope.CreationDate.Before(lastEmitted)
+				if late {
+					atomic.AddInt64(&m.cptLateRecords, 1)
+				} else {
+					lastEmitted = envelope.CreationDate
+				}
+				if late && m.DropLateRecords {
+					// dropped on purpose, the record is committed
+					commitMergeInput(inputs[next], true)
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case records <- envelope:
+				}
+				handed := taken == nil || <-taken
+				commitMergeInput(inputs[next], handed)
+				if !handed {
+					return nil
+				}
+				continue
+			}
+
+			if err := m.waitForRecord(ctx, inputs, &deadline); err != nil {
+				return err
+			}
+		} else if err := m.waitForRecord(ctx, inputs, nil); err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// commitMergeInput tells the consumer of the input if its head has been handed to the caller (it is then committed).
+func commitMergeInput(input *mergeInput, handed bool) {
+	input.head = nil
+	input.taken <- handed
+}
+
+// receiveAvailable gets the next record of the streams which have one ready.
+func (m *OrderedMergeConsumer) receiveAvailable(inputs []*mergeInput) error {
+	for idx, input := range inputs {
+		if input.head != nil || input.closed {
+			continue
+		}
+		select {
+		case envelope, ok := <-input.records:
+			if err := m.setHead(idx, input, envelope, ok); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// waitForRecord waits for a record of a stream without buffered record, until the deadline (if any).
+func (m *OrderedMergeConsumer) waitForRecord(ctx context.Context, inputs []*mergeInput, deadline *time.Time) error {
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+	if deadline != nil {
+		timer := time.NewTimer(time.Until(*deadline))
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+	indexes := make([]int, 0, len(inputs))
+	for idx, input := range inputs {
+		if input.head == nil && !input.closed {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(input.records)})
+			indexes = append(indexes, idx)
+		}
+	}
+
+	chosen, value, ok := reflect.Select(cases)
+	firstInput := len(cases) - len(indexes)
+	if chosen < firstInput {
+		// canceled or deadline reached
+		return nil
+	}
+
+	idx := indexes[chosen-firstInput]
+	var envelope Envelope
+	if ok {
+		envelope = value.Interface().(Envelope)
+	}
+	return m.setHead(idx, inputs[idx], envelope, ok)
+}
+
+func (m *OrderedMergeConsumer) setHead(idx int, input *mergeInput, envelope Envelope, ok bool) error {
+	if !ok {
+		input.closed = true
+		return m.Consumers[idx].Err()
+	}
+
+	input.head = &envelope
+	input.idleSince = time.Now()
+	if envelope.CreationDate.After(input.lastSeen) {
+		input.lastSeen = envelope.CreationDate
+	}
+	return nil
+}
+
+// canEmit returns true if the next record of the input can be emitted,
+// otherwise it returns the time at which the streams blocking the record will be considered idle.
+func (m *OrderedMergeConsumer) canEmit(inputs []*mergeInput, next int) (time.Time, bool) {
+	creationDate := inputs[next].head.CreationDate
+	now := time.Now()
+	var deadline time.Time
+	ready := true
+	for idx, input := range inputs {
+		if idx == next || input.head != nil || input.closed || !input.lastSeen.Before(creationDate) {
+			continue
+		}
+
+		idleAt := input.idleSince.Add(m.Lateness)
+		if idleAt.After(now) {
+			// the stream may still receive an older record
+			if ready || idleAt.Before(deadline) {
+				deadline = idleAt
+			}
+			ready = false
+		}
+	}
+	return deadline, ready
+}
+
+// nextMergeInput returns the index of the input which has the oldest record (-1 if none).
+func nextMergeInput(inputs []*mergeInput) int {
+	next := -1
+	for idx, input := range inputs {
+		if input.head == nil {
+			continue
+		}
+		if next < 0 {
+			next = idx
+			continue
+		}
+
+		head := input.head
+		best := inputs[next].head
+		// ties are broken by stream order (the first stream wins)
+		if head.CreationDate.Before(best.CreationDate) {
+			next = idx
+		}
+	}
+	return next
+}
+
+func allMergeInputsClosed(inputs []*mergeInput) bool {
+	for _, input := range inputs {
+		if !input.closed || input.head != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// NewOrderedMergeConsumer creates a consumer merging the streams in creation date order,
+// lateness is how long to wait for an idle stream before emitting the records of the other streams.
+func NewOrderedMergeConsumer(ctx context.Context, client IConsumerClient, streams []StreamUUID, params *RecordsIteratorParams, getRecordsChunks int, lateness time.Duration, logger *log.Logger) *OrderedMergeConsumer {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	shared := newSharedAuthClient(client)
+	consumers := make([]*PullConsumer, len(streams))
+	for idx, streamUUID := range streams {
+		consumers[idx] = NewPullConsumer(ctx, shared, streamUUID, params, getRecordsChunks, logger)
+	}
+
+	return &OrderedMergeConsumer{
+		client:    shared,
+		Streams:   append([]StreamUUID{}, streams...),
+		Consumers: consumers,
+		Lateness:  lateness,
+	}
+}
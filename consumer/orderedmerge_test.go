@@ -0,0 +1,141 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// newMockRecordsResult returns a page with the given records, the creation date depends on the message id (see NewMockGetRecordsResponse).
+func newMockRecordsResult(ids ...MessageId) MockGetRecordsResult {
+	response := &GetStreamRecordsResponse{Status: StatusSuccess, Count: len(ids), Remain: true, Records: make([]interface{}, 0)}
+	for _, id := range ids {
+		response.Records = append(response.Records, NewMockGetRecordsResponse(id, 1, true).Records...)
+	}
+	return MockGetRecordsResult{Response: response}
+}
+
+type mergedRecord struct {
+	StreamUUID StreamUUID
+	Id         MessageId
+}
+
+func collectMergedRecords(t *testing.T, ctx context.Context, merge *OrderedMergeConsumer, count int) []mergedRecord {
+	records := make([]mergedRecord, 0)
+	merge.All(ctx)(func(envelope Envelope, err error) bool {
+		if err != nil {
+			t.Fatalf("All() error = %v", err)
+		}
+		records = append(records, mergedRecord{StreamUUID: envelope.StreamUUID, Id: envelope.Id})
+		return len(records) < count
+	})
+	return records
+}
+
+func newTestOrderedMergeConsumer(ctx context.Context, client *MockConsumerClient, streams []StreamUUID, lateness time.Duration) *OrderedMergeConsumer {
+	merge := NewOrderedMergeConsumer(ctx, client, streams, nil, 100, lateness, nil)
+	for _, consumer := range merge.Consumers {
+		consumer.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+	}
+	return merge
+}
+
+func TestOrderedMergeConsumer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+		a: {newMockRecordsResult(1, 4), newMockRecordsResult(7, 10)},
+		b: {newMockRecordsResult(2, 5, 8)},
+		c: {newMockRecordsResult(3, 5), newMockRecordsResult(9)},
+	}}
+	merge := newTestOrderedMergeConsumer(ctx, client, []StreamUUID{a, b, c}, 100*time.Millisecond)
+
+	expected := []mergedRecord{{a, 1}, {b, 2}, {c, 3}, {a, 4}, {b, 5}, {c, 5}, {a, 7}, {b, 8}, {c, 9}, {a, 10}}
+	if records := collectMergedRecords(t, ctx, merge, len(expected)); !reflect.DeepEqual(records, expected) {
+		t.Errorf("records = %v, want %v", records, expected)
+	}
+	if cpt := client.CountCalls("Authenticate"); cpt != 1 {
+		t.Errorf("Authenticate calls = %d, want %d", cpt, 1)
+	}
+	if cpt := client.CountCalls("CloseRecordsIterator"); cpt != 3 {
+		t.Errorf("CloseRecordsIterator calls = %d, want %d", cpt, 3)
+	}
+	if client.CptDisconnect != 1 {
+		t.Errorf("Disconnect calls = %d, want %d", client.CptDisconnect, 1)
+	}
+}
+
+func TestOrderedMergeConsumerLateRecords(t *testing.T) {
+	tests := []struct {
+		name            string
+		dropLateRecords bool
+		expected        func(a, b StreamUUID) []mergedRecord
+	}{
+		{
+			name:     "late records are emitted",
+			expected: func(a, b StreamUUID) []mergedRecord { return []mergedRecord{{a, 1}, {a, 3}, {b, 2}, {a, 4}} },
+		},
+		{
+			name:            "late records are dropped",
+			dropLateRecords: true,
+			expected:        func(a, b StreamUUID) []mergedRecord { return []mergedRecord{{a, 1}, {a, 3}, {a, 4}, {a, 5}} },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			a, b := uuid.New(), uuid.New()
+			client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+				a: {newMockRecordsResult(1, 3), {Response: NewMockGetRecordsResponse(0, 0, false)}, newMockRecordsResult(4, 5)},
+				// the stream is idle then receives an older record
+				b: {{Response: NewMockGetRecordsResponse(0, 0, false)}, newMockRecordsResult(2)},
+			}}
+			merge := newTestOrderedMergeConsumer(ctx, client, []StreamUUID{a, b}, 20*time.Millisecond)
+			merge.DropLateRecords = tt.dropLateRecords
+			merge.Consumers[0].BackPressure = NewExponentialBackoff(400*time.Millisecond, time.Second)
+			merge.Consumers[1].BackPressure = NewExponentialBackoff(200*time.Millisecond, time.Second)
+
+			expected := tt.expected(a, b)
+			if records := collectMergedRecords(t, ctx, merge, len(expected)); !reflect.DeepEqual(records, expected) {
+				t.Errorf("records = %v, want %v", records, expected)
+			}
+			if cpt := merge.CountLateRecords(); cpt != 1 {
+				t.Errorf("CountLateRecords() = %d, want %d", cpt, 1)
+			}
+		})
+	}
+}
+
+func TestOrderedMergeConsumerCommitsYieldedRecords(t *testing.T) {
+	// the buffered heads of the streams are not committed when the iteration stops
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		a, b := uuid.New(), uuid.New()
+		client := &MockConsumerClient{GetRecordsResultsByStream: map[uuid.UUID][]MockGetRecordsResult{
+			a: {newMockRecordsResult(1, 3, 5, 7)},
+			b: {newMockRecordsResult(2, 4, 6, 8)},
+		}}
+		merge := newTestOrderedMergeConsumer(ctx, client, []StreamUUID{a, b}, 100*time.Millisecond)
+
+		expected := []mergedRecord{{a, 1}, {b, 2}, {a, 3}}
+		if records := collectMergedRecords(t, ctx, merge, len(expected)); !reflect.DeepEqual(records, expected) {
+			t.Fatalf("records = %v, want %v", records, expected)
+		}
+		for idx, expectedId := range []MessageId{3, 2} {
+			if position, ok := merge.Consumers[idx].GetPosition(); !ok || position.MessageId != expectedId {
+				t.Fatalf("Consumers[%d].GetPosition() = %v, %v, want message id %d", idx, position.MessageId, ok, expectedId)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+type fetchResult struct {
+	response     *GetStreamRecordsResponse
+	httpResponse *http.Response
+	apiError     *APIError
+}
+
+// prefetcher calls GetRecords in the background and buffers the responses,
+// so that the next page is fetched while the current one is processed.
+// It stops after the first error (the error is delivered as the last result),
+// and it does not fetch while the consumer is paused.
+type prefetcher struct {
+	results chan *fetchResult
+	cancel  context.CancelFunc
+	done    chan struct{}
+	fetched int // number of GetRecords calls, written by the prefetching goroutine
+	taken   int // number of responses given to the consumer
+}
+
+func (c *StreamConsumer) startPrefetcher(ctx context.Context, depth int) *prefetcher {
+	if depth < 1 {
+		depth = 1
+	}
+	ctxPrefetch, cancel := context.WithCancel(ctx)
+	pf := prefetcher{results: make(chan *fetchResult, depth), cancel: cancel, done: make(chan struct{})}
+	streamUUID, streamIteratorUUID, maxPullRecords := c.streamUUID, c.streamIteratorUUID, c.GetRecordsChunks
+
+	go func() {
+		defer close(pf.done)
+		// the prefetcher has its own back pressure, it is canceled when the prefetcher stops
+		backPressure := NewBackoff(c.BackPressure.GetStrategy())
+		defer backPressure.Stop()
+		waitForBackPressure := false
+		for {
+			if waitForBackPressure && backPressure.Wait(ctxPrefetch) != nil {
+				// a cancel event occurred during the wait
+				return
+			}
+			if !c.waitForResume(ctxPrefetch) {
+				return
+			}
+
+			fetchStartTime := time.Now()
+			pf.fetched++
+			response, httpResponse, apiError := c.fetchRecords(ctxPrefetch, streamUUID, streamIteratorUUID, maxPullRecords)
+			if ctxPrefetch.Err() != nil {
+				return
+			}
+			c.metrics.addFetch(time.Since(fetchStartTime), countRecords(response), apiError != nil)
+
+			// back pressure: block while the buffer is full
+			waitStartTime := time.Now()
+			select {
+			case pf.results <- &fetchResult{response: response, httpResponse: httpResponse, apiError: apiError}:
+				c.metrics.bufferedPages.Add(1)
+			case <-ctxPrefetch.Done():
+				return
+			}
+			c.metrics.waitForBufferTime.Add(int64(time.Since(waitStartTime)))
+
+			if apiError != nil {
+				return
+			}
+
+			waitForBackPressure = mustWaitForBackPressure(response, httpResponse)
+			if !waitForBackPressure {
+				backPressure.Reset()
+			}
+		}
+	}()
+
+	return &pf
+}
+
+// next waits for the next response.
+func (pf *prefetcher) next(ctx context.Context, metrics *consumerMetrics) (*fetchResult, bool) {
+	waitStartTime := time.Now()
+	defer func() { metrics.waitForPageTime.Add(int64(time.Since(waitStartTime))) }()
+
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case result := <-pf.results:
+		metrics.bufferedPages.Add(-1)
+		pf.taken++
+		return result, true
+	}
+}
+
+// stop cancels the prefetching, the buffered responses are dropped.
+// return true if the iterator has moved past records which have not been given to the consumer
+// (buffered responses, or a GetRecords call canceled while the server may have answered)
+func (pf *prefetcher) stop(metrics *consumerMetrics) bool {
+	pf.cancel()
+	<-pf.done
+	metrics.bufferedPages.Add(-int64(len(pf.results)))
+	return pf.fetched > pf.taken
+}
+
+func countRecords(response *GetStreamRecordsResponse) int {
+	if response == nil {
+		return 0
+	}
+	return len(response.Records)
+}
@@ -0,0 +1,183 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/backoff"
+	. "github.com/nbigot/ministream-client-go/client/types"
+	"github.com/nbigot/ministream-client-go/ministreamtest"
+)
+
+// mockBlockingHandler blocks on the first response until it is released.
+type mockBlockingHandler struct {
+	*MockConsumerHandler
+	blocked  chan struct{}
+	released chan struct{}
+	calls    int
+}
+
+func (h *mockBlockingHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	h.calls++
+	if h.calls == 1 {
+		close(h.blocked)
+		<-h.released
+	}
+	return h.MockConsumerHandler.OnGetRecordsSuccess(response)
+}
+
+// waitForCalls waits until the method has been called cpt times.
+func waitForCalls(t *testing.T, client *MockConsumerClient, method string, cpt int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.CountCalls(method) < cpt {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s calls = %d, want %d", method, client.CountCalls(method), cpt)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSetPrefetch(t *testing.T) {
+	tests := []struct {
+		pages    int
+		expected int
+	}{
+		{pages: 3, expected: 3},
+		{pages: 0, expected: 0},
+		{pages: -1, expected: 0},
+	}
+	for _, tt := range tests {
+		consumer := newTestConsumer(context.Background(), NewMockConsumerHandler(NewMockConsumerClient(), 0))
+		consumer.SetPrefetch(tt.pages)
+		if consumer.PrefetchPages != tt.expected {
+			t.Errorf("SetPrefetch(%d): PrefetchPages = %d, want %d", tt.pages, consumer.PrefetchPages, tt.expected)
+		}
+	}
+}
+
+func TestPrefetchDepth(t *testing.T) {
+	for _, depth := range []int{1, 3} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client := &MockConsumerClient{}
+		for page := 0; page < 10; page++ {
+			client.GetRecordsResults = append(client.GetRecordsResults, MockGetRecordsResult{Response: NewMockGetRecordsResponse(MessageId(page*10+1), 10, true)})
+		}
+		handler := &mockBlockingHandler{MockConsumerHandler: NewMockConsumerHandler(client, 100), blocked: make(chan struct{}), released: make(chan struct{})}
+		consumer := newTestConsumer(ctx, handler)
+		consumer.SetPrefetch(depth)
+
+		chRun := make(chan *APIError, 1)
+		go func() { chRun <- consumer.Run(ctx) }()
+
+		// the first page is processed, depth pages are buffered and the next one waits for a free slot
+		<-handler.blocked
+		waitForCalls(t, client, "GetRecords", depth+2)
+		time.Sleep(50 * time.Millisecond)
+		if cpt := client.CountCalls("GetRecords"); cpt != depth+2 {
+			t.Errorf("depth %d: GetRecords calls = %d, want %d", depth, cpt, depth+2)
+		}
+		if metrics := consumer.Metrics(); metrics.BufferedPages != depth {
+			t.Errorf("depth %d: BufferedPages = %d, want %d", depth, metrics.BufferedPages, depth)
+		}
+
+		close(handler.released)
+		if err := <-chRun; err != nil {
+			t.Fatalf("depth %d: Run() = %v, want %v", depth, err, nil)
+		}
+		if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 100)) {
+			t.Errorf("depth %d: message ids = %v, want %v", depth, ids, ministreamtest.MessageIds(1, 100))
+		}
+
+		metrics := consumer.Metrics()
+		if metrics.ProcessCount != 10 || metrics.RecordsCount < 100 || metrics.FetchCount < 10 || metrics.FetchErrorsCount != 0 {
+			t.Errorf("depth %d: Metrics() = %+v", depth, metrics)
+		}
+		if metrics.WaitForBufferTime < 50*time.Millisecond {
+			t.Errorf("depth %d: WaitForBufferTime = %s, want at least the time the handler was blocked", depth, metrics.WaitForBufferTime)
+		}
+		if metrics.BufferedPages != 0 {
+			t.Errorf("depth %d: BufferedPages = %d once stopped, want %d", depth, metrics.BufferedPages, 0)
+		}
+	}
+}
+
+func TestPrefetchWhilePaused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := &MockConsumerClient{GetRecordsResults: []MockGetRecordsResult{
+		{Response: NewMockGetRecordsResponse(1, 5, true)},
+		{Response: NewMockGetRecordsResponse(6, 5, true)},
+	}}
+	handler := NewMockConsumerHandler(client, 10)
+	consumer := newTestConsumer(ctx, handler)
+	consumer.SetPrefetch(2)
+	consumer.Pause()
+
+	chRun := make(chan *APIError, 1)
+	go func() { chRun <- consumer.Run(ctx) }()
+
+	waitForCalls(t, client, "CreateRecordsIterator", 1)
+	time.Sleep(50 * time.Millisecond)
+	if cpt := client.CountCalls("GetRecords"); cpt != 0 {
+		t.Errorf("GetRecords calls while paused = %d, want %d", cpt, 0)
+	}
+
+	consumer.Resume()
+	if err := <-chRun; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 10)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 10))
+	}
+}
+
+func TestPrefetchStopKeepsBufferedRecords(t *testing.T) {
+	// the consumer stops using the iterator while pages are buffered, the records must be fetched again
+	const depth = 3
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server := ministreamtest.NewTestServer(t, ministreamtest.ServerSettings{})
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+	if _, err := server.AppendRecords(streamUUID, ministreamtest.NewRecords(50)); err != nil {
+		t.Fatalf("AppendRecords() error = %v", err)
+	}
+	// the second page can't be read, the consumer moves on with a new iterator
+	server.InjectFaults(ministreamtest.RouteGetRecords, ministreamtest.Fault{}, ministreamtest.Fault{MalformedRecords: true})
+
+	handler := &mockBlockingHandler{MockConsumerHandler: NewMockConsumerHandler(client, 0), blocked: make(chan struct{}), released: make(chan struct{})}
+	consumer := CreateConsumer(ctx, streamUUID, handler, 10)
+	consumer.BackPressure = NewExponentialBackoff(time.Millisecond, 10*time.Millisecond)
+	consumer.SetPrefetch(depth)
+	if apiError := consumer.SetReplayRange(NewMessageIdReplayRange(1, 50)); apiError != nil {
+		t.Fatalf("SetReplayRange() = %v, want %v", apiError, nil)
+	}
+
+	chRun := make(chan *APIError, 1)
+	go func() { chRun <- consumer.Run(ctx) }()
+
+	// the first page is processed while the buffer fills up
+	<-handler.blocked
+	deadline := time.Now().Add(5 * time.Second)
+	for consumer.Metrics().BufferedPages < depth && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if buffered := consumer.Metrics().BufferedPages; buffered != depth {
+		t.Fatalf("BufferedPages = %d, want %d", buffered, depth)
+	}
+
+	close(handler.released)
+	if err := <-chRun; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, ministreamtest.MessageIds(1, 50)) {
+		t.Errorf("message ids = %v, want %v", ids, ministreamtest.MessageIds(1, 50))
+	}
+}
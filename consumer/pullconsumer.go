@@ -0,0 +1,219 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+const MaxRetryCounterPullConsumer = 10
+
+// Envelope is a record received by a PullConsumer.
+type Envelope struct {
+	ResponseRecordEnvelope
+	StreamUUID StreamUUID
+}
+
+// RecordsSeq has the same signature as iter.Seq2[Envelope, error],
+// with go >= 1.23 it can be used in a range loop:
+//
+//	for envelope, err := range consumer.All(ctx) { ... }
+//
+// The sequence ends after an error.
+type RecordsSeq func(yield func(Envelope, error) bool)
+
+// PullConsumer is a StreamConsumer with a built-in handler,
+// the records are pulled with a channel or an iterator instead of implementing StreamConsumerHandler.
+type PullConsumer struct {
+	*StreamConsumer
+	handler *pullConsumerHandler
+	running bool
+	err     error
+	mu      sync.Mutex
+}
+
+type pullConsumerHandler struct {
+	// implements interface StreamConsumerHandler and StreamConsumerAckHandler
+	client       IConsumerClient
+	logger       *log.Logger
+	params       RecordsIteratorParams
+	ctx          context.Context
+	records      chan<- Envelope
+	taken        <-chan bool // optional, the reader tells if it has taken each record it has received
+	retryCounter int
+	err          *APIError
+}
+
+func (h *pullConsumerHandler) GetLogger() *log.Logger {
+	return h.logger
+}
+
+func (h *pullConsumerHandler) GetClient() IConsumerClient {
+	return h.client
+}
+
+func (h *pullConsumerHandler) GetRecordsIteratorParams() *RecordsIteratorParams {
+	return &h.params
+}
+
+func (h *pullConsumerHandler) OnAuthenticationSuccess() {
+	h.retryCounter = 0
+}
+
+func (h *pullConsumerHandler) OnAuthenticationFailure(e *APIError) bool {
+	return h.canRetry(e)
+}
+
+func (h *pullConsumerHandler) OnCreateRecordsIteratorSuccess() {
+	h.retryCounter = 0
+}
+
+func (h *pullConsumerHandler) OnCreateRecordsIteratorFailure(e *APIError) bool {
+	return h.canRetry(e)
+}
+
+func (h *pullConsumerHandler) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
+	// not called: the records are acknowledged by OnGetRecordsToAck
+	return true
+}
+
+func (h *pullConsumerHandler) OnGetRecordsToAck(response *GetStreamRecordsResponse, ack *RecordsAck) bool {
+	for _, envelope := range ack.Envelopes() {
+		// back pressure: wait until the record is taken by the reader
+		select {
+		case <-h.ctx.Done():
+			return false
+		case h.records <- Envelope{ResponseRecordEnvelope: *envelope, StreamUUID: response.StreamUUID}:
+			if h.taken != nil && !<-h.taken {
+				// received but not handed to the caller, the record is not committed
+				return false
+			}
+			ack.Ack(envelope.Id)
+		}
+	}
+	return true
+}
+
+func (h *pullConsumerHandler) OnGetRecordsFailure(e *APIError) bool {
+	// the consumer handles the known errors (authentication, iterator not found, ...)
+	return true
+}
+
+func (h *pullConsumerHandler) OnUnexpectedError(e *APIError) bool {
+	h.err = e
+	return false
+}
+
+func (h *pullConsumerHandler) OnStart() {
+	h.retryCounter = 0
+	h.err = nil
+}
+
+func (h *pullConsumerHandler) OnPause() {}
+
+func (h *pullConsumerHandler) OnResume() {}
+
+func (h *pullConsumerHandler) OnClose() {}
+
+func (h *pullConsumerHandler) canRetry(e *APIError) bool {
+	h.retryCounter++
+	if h.ctx.Err() == nil && (e.CanRetry() || e.Code == ErrorTooManyRequests) && h.retryCounter <= MaxRetryCounterPullConsumer {
+		return true
+	}
+	h.err = e
+	return false
+}
+
+// Records starts the consumer and returns the records in a channel,
+// the channel is closed when ctx is canceled or on error (see Err).
+// The records are committed (see SetCheckpointStore) once they are received from the channel.
+func (p *PullConsumer) Records(ctx context.Context) <-chan Envelope {
+	return p.start(ctx, nil)
+}
+
+// start starts the consumer, when taken is not nil the reader must send on taken for each record received from the channel:
+// true if the record has been handed to the caller (it is committed), false otherwise (it will be delivered again).
+func (p *PullConsumer) start(ctx context.Context, taken <-chan bool) <-chan Envelope {
+	records := make(chan Envelope)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		close(records)
+		return records
+	}
+	p.running = true
+	p.err = nil
+	p.handler.ctx = ctx
+	p.handler.records = records
+	p.handler.taken = taken
+
+	go func() {
+		defer close(records)
+		apiError := p.Run(ctx)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.running = false
+		if p.handler.err != nil {
+			p.err = p.handler.err
+		} else if apiError != nil && ctx.Err() == nil {
+			p.err = apiError
+		}
+	}()
+
+	return records
+}
+
+// All starts the consumer and returns an iterator over the records.
+// Stopping the iteration stops the consumer, the records are committed once they are yielded.
+func (p *PullConsumer) All(ctx context.Context) RecordsSeq {
+	return func(yield func(Envelope, error) bool) {
+		ctxAll, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		taken := make(chan bool)
+		records := p.start(ctxAll, taken)
+		for envelope := range records {
+			taken <- true
+			if !yield(envelope, nil) {
+				cancel()
+				// wait for the consumer to stop (the records received meanwhile are not committed)
+				for range records {
+					taken <- false
+				}
+				return
+			}
+		}
+
+		if err := p.Err(); err != nil {
+			yield(Envelope{}, err)
+		}
+	}
+}
+
+// Err returns the error which has stopped the consumer, nil if it has been stopped by the context.
+func (p *PullConsumer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+func NewPullConsumer(ctx context.Context, client IConsumerClient, streamUUID StreamUUID, params *RecordsIteratorParams, getRecordsChunks int, logger *log.Logger) *PullConsumer {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	if params == nil {
+		params = &RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage}
+	}
+
+	handler := pullConsumerHandler{client: client, logger: logger, params: *params}
+	return &PullConsumer{
+		StreamConsumer: CreateConsumer(ctx, streamUUID, &handler, getRecordsChunks),
+		handler:        &handler,
+	}
+}
@@ -0,0 +1,129 @@
+package ministreamconsumer
+
+import (
+	"time"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// ReplayRange bounds the consumption, the consumer stops once the end point is reached (inclusive)
+// or once there are no more records in the stream (the records created during the replay may be skipped).
+// The start point is optional, it replaces the start point of the handler iterator params.
+// The checkpoints are neither loaded nor saved during a replay (the position of the live consumer is kept).
+type ReplayRange struct {
+	StartTimestamp *time.Time
+	StartMessageId *MessageId
+	EndTimestamp   *time.Time
+	EndMessageId   *MessageId
+}
+
+func NewTimeReplayRange(start time.Time, end time.Time) *ReplayRange {
+	return &ReplayRange{StartTimestamp: &start, EndTimestamp: &end}
+}
+
+func NewMessageIdReplayRange(start MessageId, end MessageId) *ReplayRange {
+	return &ReplayRange{StartMessageId: &start, EndMessageId: &end}
+}
+
+func (r *ReplayRange) Validate() *APIError {
+	if r.StartTimestamp != nil && r.StartMessageId != nil {
+		return &APIError{Message: "replay range can't start at both a timestamp and a message id"}
+	}
+	if r.EndTimestamp == nil && r.EndMessageId == nil {
+		return &APIError{Message: "replay range must have an end timestamp or an end message id"}
+	}
+	if r.StartTimestamp != nil && r.EndTimestamp != nil && r.EndTimestamp.Before(*r.StartTimestamp) {
+		return &APIError{Message: "replay range end timestamp is before the start timestamp"}
+	}
+	if r.StartMessageId != nil && r.EndMessageId != nil && *r.EndMessageId < *r.StartMessageId {
+		return &APIError{Message: "replay range end message id is before the start message id"}
+	}
+	return nil
+}
+
+// isAfterEnd returns true if the record is after the end of the range.
+func (r *ReplayRange) isAfterEnd(envelope *ResponseRecordEnvelope) bool {
+	if r.EndMessageId != nil && envelope.Id > *r.EndMessageId {
+		return true
+	}
+	if r.EndTimestamp != nil && envelope.CreationDate.After(*r.EndTimestamp) {
+		return true
+	}
+	return false
+}
+
+// isEndReached returns true if the record is the last one of the range.
+func (r *ReplayRange) isEndReached(envelope *ResponseRecordEnvelope) bool {
+	return r.EndMessageId != nil && envelope.Id >= *r.EndMessageId
+}
+
+// applyRecordsIteratorParams sets the start point of the range.
+func (r *ReplayRange) applyRecordsIteratorParams(p *RecordsIteratorParams) {
+	if r.StartTimestamp != nil {
+		timestamp := *r.StartTimestamp
+		p.IteratorType = IteratorTypeAtTimestamp
+		p.Timestamp = &timestamp
+		p.MessageId = nil
+	} else if r.StartMessageId != nil {
+		messageId := *r.StartMessageId
+		p.IteratorType = IteratorTypeAtMessageId
+		p.MessageId = &messageId
+		p.Timestamp = nil
+	}
+}
+
+// SetReplayRange bounds the consumption (nil to disable), Run returns once the end of the range is reached.
+func (c *StreamConsumer) SetReplayRange(r *ReplayRange) *APIError {
+	if r != nil {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+
+	c.Replay = r
+	c.replayEndReached = false
+	return nil
+}
+
+// ReplayEndReached returns true if the consumer has stopped because the end of the replay range was reached.
+func (c *StreamConsumer) ReplayEndReached() bool {
+	return c.replayEndReached
+}
+
+// applyReplayRange removes the records after the end of the replay range.
+// return the response to process and true if the end of the range is reached
+func (c *StreamConsumer) applyReplayRange(response *GetStreamRecordsResponse) (*GetStreamRecordsResponse, bool, *APIError) {
+	if c.Replay == nil {
+		return response, false, nil
+	}
+
+	for idx, record := range response.Records {
+		envelope, err := ParseRecordEnvelope(record)
+		if err != nil {
+			return nil, false, &APIError{Message: "can't read record envelope", Details: err.Error(), StreamUUID: c.streamUUID}
+		}
+
+		if c.Replay.isAfterEnd(envelope) {
+			truncated := *response
+			truncated.Records = response.Records[:idx]
+			truncated.Count = idx
+			truncated.Remain = false
+			return &truncated, true, nil
+		}
+
+		if c.Replay.isEndReached(envelope) {
+			truncated := *response
+			truncated.Records = response.Records[:idx+1]
+			truncated.Count = idx + 1
+			truncated.Remain = false
+			return &truncated, true, nil
+		}
+	}
+
+	if len(response.Records) == 0 && !response.Remain {
+		// the stream has no more records, the end of the range is past the last record
+		return response, true, nil
+	}
+
+	return response, false, nil
+}
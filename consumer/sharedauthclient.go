@@ -0,0 +1,90 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// sharedAuthClient shares one client (and its authentication) between several consumers.
+// Authenticate is only called on the wrapped client when no consumer is authenticated yet
+// or when the token has expired, Disconnect is left to the owner of the client.
+type sharedAuthClient struct {
+	// implements interface IConsumerClient
+	client        IConsumerClient
+	authenticated bool
+	mu            sync.Mutex
+}
+
+func newSharedAuthClient(client IConsumerClient) *sharedAuthClient {
+	return &sharedAuthClient{client: client}
+}
+
+func (s *sharedAuthClient) Disconnect() {
+	// the client is shared, it is disconnected by its owner
+}
+
+func (s *sharedAuthClient) Authenticate(ctx context.Context) *APIError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.authenticated {
+		return nil
+	}
+
+	if apiError := s.client.Authenticate(ctx); apiError != nil {
+		return apiError
+	}
+	s.authenticated = true
+	return nil
+}
+
+func (s *sharedAuthClient) CreateRecordsIterator(ctx context.Context, streamUUID uuid.UUID, p *RecordsIteratorParams) (*CreateRecordsIteratorResponse, *APIError) {
+	response, apiError := s.client.CreateRecordsIterator(ctx, streamUUID, p)
+	s.checkAuthentication(apiError)
+	return response, apiError
+}
+
+func (s *sharedAuthClient) GetRecords(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID, maxPullRecords int) (*GetStreamRecordsResponse, *http.Response, *APIError) {
+	response, httpResponse, apiError := s.client.GetRecords(ctx, streamUUID, streamIteratorUUID, maxPullRecords)
+	s.checkAuthentication(apiError)
+	return response, httpResponse, apiError
+}
+
+func (s *sharedAuthClient) CloseRecordsIterator(ctx context.Context, streamUUID uuid.UUID, streamIteratorUUID uuid.UUID) *APIError {
+	apiError := s.client.CloseRecordsIterator(ctx, streamUUID, streamIteratorUUID)
+	s.checkAuthentication(apiError)
+	return apiError
+}
+
+func (s *sharedAuthClient) GetStreamInformation(ctx context.Context, streamUUID uuid.UUID) (*StreamInformation, *APIError) {
+	client, ok := s.client.(IStreamInformationClient)
+	if !ok {
+		return nil, &APIError{Message: "stream information not supported by the client", StreamUUID: streamUUID}
+	}
+
+	response, apiError := client.GetStreamInformation(ctx, streamUUID)
+	s.checkAuthentication(apiError)
+	return response, apiError
+}
+
+func (s *sharedAuthClient) SubscribeCircuitBreaker(listener func(change CircuitBreakerStateChange)) (unsubscribe func()) {
+	if client, ok := s.client.(ICircuitBreakerClient); ok {
+		return client.SubscribeCircuitBreaker(listener)
+	}
+	return func() {}
+}
+
+func (s *sharedAuthClient) checkAuthentication(apiError *APIError) {
+	if apiError == nil || apiError.Code != ErrorJWTInvalidOrExpired {
+		return
+	}
+
+	// the next call to Authenticate will get a new token
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticated = false
+}
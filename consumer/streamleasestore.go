@@ -0,0 +1,227 @@
+package ministreamconsumer
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// LeaseLogClient is the client of a StreamLeaseStore, it reads and writes the coordination stream.
+type LeaseLogClient interface {
+	IConsumerClient
+	PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*PutRecordsResponse, *http.Response, *APIError)
+}
+
+// leaseLogRecord is a record of the coordination stream.
+type leaseLogRecord struct {
+	Operation string `json:"op"` // "acquire" or "release"
+	Key       string `json:"key"`
+	Owner     string `json:"owner"`
+	TTL       int64  `json:"ttlMs"`
+	Nonce     string `json:"nonce"`
+}
+
+const (
+	leaseOperationAcquire = "acquire"
+	leaseOperationRelease = "release"
+)
+
+type StreamLeaseStore struct {
+	// implements interface LeaseStore
+	// the leases are operations appended to a stream used as a coordination log,
+	// every member replays the log in the same order so they agree on the owners:
+	// an acquisition is granted if the key is free (or expired) at the creation date of the record.
+	// limits:
+	// - the expiration dates come from the server clock but AcquireLease and ListLeases compare them
+	//   with the local clock, the clock skew between the members and the server must be small compared to the ttl
+	// - the log is never compacted (every heartbeat appends records) and a new store replays it from the start,
+	//   the stream must be replaced from time to time (for instance when the whole group is restarted)
+	client             LeaseLogClient
+	streamUUID         StreamUUID
+	streamIteratorUUID StreamIteratorUUID
+	isAuthenticated    bool
+	lastMessageId      *MessageId
+	leases             leaseTable
+	acquisitions       map[string]*bool // result of the acquisitions of this store by nonce (nil until the record is read)
+	batchId            int
+	PollInterval       time.Duration // wait between two reads while waiting for an acquisition record
+	mu                 sync.Mutex
+}
+
+func (s *StreamLeaseStore) AcquireLease(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.sync(ctx); err != nil {
+		return false, err
+	}
+	if lease, found := s.leases[key]; found && lease.Owner != owner && !lease.isExpired(time.Now()) {
+		return false, nil
+	}
+
+	nonce := uuid.NewString()
+	s.acquisitions[nonce] = nil
+	defer delete(s.acquisitions, nonce)
+	if err := s.append(ctx, leaseLogRecord{Operation: leaseOperationAcquire, Key: key, Owner: owner, TTL: ttl.Milliseconds(), Nonce: nonce}); err != nil {
+		return false, err
+	}
+
+	// read the log until the record is found
+	for {
+		if err := s.sync(ctx); err != nil {
+			return false, err
+		}
+		if granted := s.acquisitions[nonce]; granted != nil {
+			return *granted, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+func (s *StreamLeaseStore) ReleaseLease(ctx context.Context, key string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(ctx, leaseLogRecord{Operation: leaseOperationRelease, Key: key, Owner: owner}); err != nil {
+		return err
+	}
+	// the release is applied when the log is read
+	if lease, found := s.leases[key]; found && lease.Owner == owner {
+		delete(s.leases, key)
+	}
+	return nil
+}
+
+func (s *StreamLeaseStore) ListLeases(ctx context.Context, prefix string) ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.sync(ctx); err != nil {
+		return nil, err
+	}
+	return s.leases.list(prefix, time.Now()), nil
+}
+
+func (s *StreamLeaseStore) authenticate(ctx context.Context) *APIError {
+	if s.isAuthenticated {
+		return nil
+	}
+	if apiError := s.client.Authenticate(ctx); apiError != nil {
+		return apiError
+	}
+	s.isAuthenticated = true
+	return nil
+}
+
+// checkError forgets the authentication or the iterator when they are no longer valid.
+func (s *StreamLeaseStore) checkError(apiError *APIError) {
+	switch apiError.Code {
+	case ErrorJWTInvalidOrExpired:
+		s.isAuthenticated = false
+	case ErrorStreamIteratorNotFound:
+		s.streamIteratorUUID = uuid.Nil
+	}
+}
+
+func (s *StreamLeaseStore) append(ctx context.Context, record leaseLogRecord) error {
+	if apiError := s.authenticate(ctx); apiError != nil {
+		return apiError
+	}
+
+	s.batchId++
+	if _, _, apiError := s.client.PutRecords(ctx, s.streamUUID, s.batchId, []interface{}{record}); apiError != nil {
+		s.checkError(apiError)
+		return apiError
+	}
+	return nil
+}
+
+// sync reads the new records of the coordination log and applies them.
+func (s *StreamLeaseStore) sync(ctx context.Context) error {
+	if apiError := s.authenticate(ctx); apiError != nil {
+		return apiError
+	}
+
+	if s.streamIteratorUUID == uuid.Nil {
+		p := RecordsIteratorParams{IteratorType: IteratorTypeFirstMessage}
+		if s.lastMessageId != nil {
+			messageId := *s.lastMessageId
+			p.IteratorType = IteratorTypeAfterMessageId
+			p.MessageId = &messageId
+		}
+		response, apiError := s.client.CreateRecordsIterator(ctx, s.streamUUID, &p)
+		if apiError != nil {
+			s.checkError(apiError)
+			return apiError
+		}
+		s.streamIteratorUUID = response.StreamIteratorUUID
+	}
+
+	for {
+		response, _, apiError := s.client.GetRecords(ctx, s.streamUUID, s.streamIteratorUUID, MaxPullRecordsByCall)
+		if apiError != nil {
+			s.checkError(apiError)
+			return apiError
+		}
+
+		for _, record := range response.Records {
+			envelope, err := ParseRecordEnvelope(record)
+			if err != nil {
+				return err
+			}
+			s.apply(envelope)
+			messageId := envelope.Id
+			s.lastMessageId = &messageId
+		}
+
+		if !response.Remain || len(response.Records) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *StreamLeaseStore) apply(envelope *ResponseRecordEnvelope) {
+	msg, ok := envelope.Msg.(map[string]interface{})
+	if !ok {
+		// not a lease record
+		return
+	}
+
+	operation, _ := msg["op"].(string)
+	key, _ := msg["key"].(string)
+	owner, _ := msg["owner"].(string)
+	switch operation {
+	case leaseOperationAcquire:
+		ttl, _ := msg["ttlMs"].(float64)
+		granted := s.leases.acquire(key, owner, time.Duration(ttl)*time.Millisecond, envelope.CreationDate)
+		nonce, _ := msg["nonce"].(string)
+		if _, found := s.acquisitions[nonce]; found {
+			s.acquisitions[nonce] = &granted
+		}
+	case leaseOperationRelease:
+		s.leases.release(key, owner)
+	}
+}
+
+// NewStreamLeaseStore creates a lease store using the stream as a coordination log,
+// the stream must be dedicated to the leases of the group.
+func NewStreamLeaseStore(client LeaseLogClient, streamUUID StreamUUID) *StreamLeaseStore {
+	return &StreamLeaseStore{
+		client:       client,
+		streamUUID:   streamUUID,
+		leases:       make(leaseTable),
+		acquisitions: make(map[string]*bool),
+		batchId:      rand.Intn(1 << 30),
+		PollInterval: 100 * time.Millisecond,
+	}
+}
@@ -0,0 +1,122 @@
+package ministreamconsumer
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// ErrStopConsuming can be returned by OnRecord to stop the consumption (the record is not acknowledged).
+var ErrStopConsuming = errors.New("stop consuming")
+
+// StreamConsumerRecordHandler is implemented by the handlers which process the records one by one in a worker pool.
+// OnRecord is called concurrently from several goroutines,
+// records which share the same partition key are processed sequentially in stream order.
+// The record is acknowledged when OnRecord returns nil, otherwise it is delivered again.
+type StreamConsumerRecordHandler interface {
+	OnRecord(envelope *ResponseRecordEnvelope) error
+}
+
+// PartitionKeyExtractor returns the key used to dispatch a record to a worker.
+type PartitionKeyExtractor func(envelope *ResponseRecordEnvelope) string
+
+type workerJob struct {
+	envelopes []*ResponseRecordEnvelope
+	ack       *RecordsAck
+	done      *sync.WaitGroup
+}
+
+type workerPool struct {
+	handler      StreamConsumerRecordHandler
+	partitionKey PartitionKeyExtractor
+	jobs         []chan workerJob
+	wg           sync.WaitGroup
+	stopping     bool
+	mu           sync.Mutex
+}
+
+func newWorkerPool(workers int, handler StreamConsumerRecordHandler, partitionKey PartitionKeyExtractor) *workerPool {
+	p := workerPool{handler: handler, partitionKey: partitionKey, jobs: make([]chan workerJob, workers)}
+	for idx := range p.jobs {
+		p.jobs[idx] = make(chan workerJob)
+		p.wg.Add(1)
+		go p.work(p.jobs[idx])
+	}
+	return &p
+}
+
+func (p *workerPool) work(jobs <-chan workerJob) {
+	defer p.wg.Done()
+	for job := range jobs {
+		for _, envelope := range job.envelopes {
+			err := p.onRecord(envelope)
+			if err != nil {
+				job.ack.Nack(envelope.Id)
+				if errors.Is(err, ErrStopConsuming) {
+					p.mu.Lock()
+					p.stopping = true
+					p.mu.Unlock()
+				}
+				// skip the next records of the partition, they will be delivered again (keep the order)
+				break
+			}
+			job.ack.Ack(envelope.Id)
+		}
+		job.done.Done()
+	}
+}
+
+// onRecord gives the record to the handler, a panic of the handler is a failure of the record.
+func (p *workerPool) onRecord(envelope *ResponseRecordEnvelope) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("record handler panic: %v", r)
+		}
+	}()
+	return p.handler.OnRecord(envelope)
+}
+
+// partitionOf returns the partition of the key, between 0 and partitions-1.
+func partitionOf(key string, partitions int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(partitions))
+}
+
+// process dispatches the records to the workers and waits until all of them are processed.
+// return false if a worker has asked to stop the consumption
+func (p *workerPool) process(ack *RecordsAck) bool {
+	envelopes := ack.Envelopes()
+	partitions := make([][]*ResponseRecordEnvelope, len(p.jobs))
+	for idx, envelope := range envelopes {
+		worker := idx % len(p.jobs)
+		if p.partitionKey != nil {
+			worker = partitionOf(p.partitionKey(envelope), len(p.jobs))
+		}
+		partitions[worker] = append(partitions[worker], envelope)
+	}
+
+	var done sync.WaitGroup
+	for worker, partition := range partitions {
+		if len(partition) == 0 {
+			continue
+		}
+		done.Add(1)
+		p.jobs[worker] <- workerJob{envelopes: partition, ack: ack, done: &done}
+	}
+	done.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.stopping
+}
+
+func (p *workerPool) stop() {
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+	p.wg.Wait()
+}
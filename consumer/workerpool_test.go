@@ -0,0 +1,81 @@
+package ministreamconsumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+type recordHandlerFunc func(envelope *ResponseRecordEnvelope) error
+
+func (f recordHandlerFunc) OnRecord(envelope *ResponseRecordEnvelope) error {
+	return f(envelope)
+}
+
+func TestWorkerPoolKeepsPartitionOrder(t *testing.T) {
+	const cptRecords = 1000
+	const cptPartitions = 7
+	envelopes := make([]*ResponseRecordEnvelope, cptRecords)
+	for idx := range envelopes {
+		envelopes[idx] = &ResponseRecordEnvelope{Id: MessageId(idx + 1), Msg: fmt.Sprintf("key-%d", idx%cptPartitions)}
+	}
+
+	var mu sync.Mutex
+	lastIdByKey := make(map[string]MessageId)
+	handler := recordHandlerFunc(func(envelope *ResponseRecordEnvelope) error {
+		mu.Lock()
+		defer mu.Unlock()
+		key := envelope.Msg.(string)
+		if envelope.Id <= lastIdByKey[key] {
+			t.Errorf("record %d of partition %s processed after record %d", envelope.Id, key, lastIdByKey[key])
+		}
+		lastIdByKey[key] = envelope.Id
+		return nil
+	})
+
+	pool := newWorkerPool(4, handler, func(envelope *ResponseRecordEnvelope) string { return envelope.Msg.(string) })
+	defer pool.stop()
+
+	ack := NewRecordsAck(envelopes)
+	if !pool.process(ack) {
+		t.Fatalf("process() = false, want true")
+	}
+	if !ack.IsFullyAcked() {
+		t.Errorf("CountCommitted() = %v, want %v", ack.CountCommitted(), cptRecords)
+	}
+}
+
+func TestWorkerPoolCommitsInStreamOrder(t *testing.T) {
+	envelopes := make([]*ResponseRecordEnvelope, 100)
+	for idx := range envelopes {
+		envelopes[idx] = &ResponseRecordEnvelope{Id: MessageId(idx + 1)}
+	}
+
+	handler := recordHandlerFunc(func(envelope *ResponseRecordEnvelope) error {
+		if envelope.Id == 42 {
+			return errors.New("can't process record")
+		}
+		return nil
+	})
+
+	pool := newWorkerPool(8, handler, nil)
+	defer pool.stop()
+
+	ack := NewRecordsAck(envelopes)
+	if !pool.process(ack) {
+		t.Fatalf("process() = false, want true")
+	}
+	if got := ack.CountCommitted(); got != 41 {
+		t.Errorf("CountCommitted() = %v, want %v", got, 41)
+	}
+
+	stopHandler := recordHandlerFunc(func(envelope *ResponseRecordEnvelope) error { return ErrStopConsuming })
+	stopPool := newWorkerPool(2, stopHandler, nil)
+	defer stopPool.stop()
+	if stopPool.process(NewRecordsAck(envelopes)) {
+		t.Errorf("process() = true, want false")
+	}
+}
@@ -37,7 +37,7 @@ func (h *ConsumerHandlerDemo) GetLogger() *log.Logger {
 	return h.Logger
 }
 
-func (h *ConsumerHandlerDemo) GetClient() *MinistreamClient {
+func (h *ConsumerHandlerDemo) GetClient() IConsumerClient {
 	return h.Client
 }
 
@@ -117,6 +117,10 @@ func (h *ConsumerHandlerDemo) OnClose() {
 	h.Logger.Printf("OnClose: total records processed: %d", h.CptRecordsProcessed)
 }
 
+func (h *ConsumerHandlerDemo) OnFatalError(apiError *APIError) {
+	h.Logger.Printf("consumer: OnFatalError: %s\n", apiError.ToJson())
+}
+
 func (h *ConsumerHandlerDemo) OnGetRecordsSuccess(response *GetStreamRecordsResponse) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
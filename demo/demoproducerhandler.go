@@ -20,6 +20,7 @@ type ProducerEventHandlerDemo struct {
 	cptRecordsEnqueued                   int64
 	lastStartSendHttpRequest             time.Time
 	lastHttpRequestDuration              time.Duration
+	ctx                                  context.Context
 	backPressure                         *ExpBackoff
 	numberOfSuccessiveBufferingErrors    int
 	maxNumberOfSuccessiveBufferingErrors int
@@ -127,7 +128,7 @@ func (h *ProducerEventHandlerDemo) OnRecordsEnqueued(cptRecords int, index int,
 	}
 
 	// wait a little before trying again later
-	h.backPressure.Wait()
+	_ = h.backPressure.Wait(h.ctx)
 	return nil // try again to push records into the buffer
 }
 
@@ -152,7 +153,8 @@ func NewProducerEventHandlerDemo(ctx context.Context, cptRecordsToSend int64, se
 		maxNumberOfSuccessiveBufferingErrors: 1000,
 		firstBufferingErrorDate:              time.Time{},
 		maxBufferingErrorDuration:            time.Duration(60) * time.Second * 5, // 5 minutes
-		backPressure:                         NewExpBackoff(ctx.Done(), time.Duration(10)*time.Millisecond, time.Duration(1)*time.Second),
+		ctx:                                  ctx,
+		backPressure:                         NewExponentialBackoff(time.Duration(10)*time.Millisecond, time.Duration(1)*time.Second),
 		Logger:                               nil,
 		producer:                             nil,
 		cptRecordsToSend:                     cptRecordsToSend,
@@ -2,4 +2,9 @@ module github.com/nbigot/ministream-client-go
 
 go 1.20
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/google/uuid v1.3.0
+	github.com/itchyny/gojq v0.12.16
+)
+
+require github.com/itchyny/timefmt-go v0.1.6 // indirect
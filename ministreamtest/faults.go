@@ -0,0 +1,178 @@
+package ministreamtest
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// Route is an endpoint of the http api of the server.
+type Route string
+
+// Enum values for Route
+const (
+	RouteLogin                 Route = "Login"
+	RoutePing                  Route = "Ping"
+	RouteListStreams           Route = "ListStreams"
+	RouteCreateStream          Route = "CreateStream"
+	RouteGetStreamInformation  Route = "GetStreamInformation"
+	RoutePutRecords            Route = "PutRecords"
+	RouteCreateRecordsIterator Route = "CreateRecordsIterator"
+	RouteCloseRecordsIterator  Route = "CloseRecordsIterator"
+	RouteGetRecords            Route = "GetRecords"
+)
+
+// Fault is an error injected by the server in the response of a request, the zero value lets the request through.
+type Fault struct {
+	Latency time.Duration // the request is processed then the response is delayed (e.g. longer than the client timeout)
+	// the request is processed then the connection is closed without response,
+	// note: the client transport may send an idempotent request (GET) again on its own
+	DropAfterCommit bool
+	RetryAfter      time.Duration // answers 429 with this Retry-After delay (rounded up to the second), the request is not processed
+	ExpireToken     bool          // the jwt of the request is revoked, answers 401 with ErrorJWTInvalidOrExpired
+	EvictIterator   bool          // the iterator of the request is deleted before the request is processed
+	// the request is processed then the message ids of the records of the response are removed (GetRecords only),
+	// the records can't be read by the client but the iterator has moved past them
+	MalformedRecords bool
+}
+
+func (f Fault) isZero() bool {
+	return f == Fault{}
+}
+
+// InjectFaults appends faults to the script of the route: each request of the route takes the next fault.
+func (s *Server) InjectFaults(route Route, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[route] = append(s.faults[route], faults...)
+}
+
+// SetFaultFunc sets the function returning the fault of a request when the script of its route is empty (nil to disable),
+// it is called with the lock of the server held: it must not call the server.
+func (s *Server) SetFaultFunc(f func(route Route) Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faultFunc = f
+}
+
+// PendingFaults returns the number of faults of the script of the route which are not injected yet.
+func (s *Server) PendingFaults(route Route) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.faults[route])
+}
+
+// EvictIterators deletes all the iterators (as the server does with the idle iterators).
+func (s *Server) EvictIterators() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iterators = make(map[StreamIteratorUUID]*iterator)
+}
+
+// ExpireTokens revokes all the jwt, the clients must authenticate again.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]time.Time)
+}
+
+func (s *Server) nextFault(route Route) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if faults := s.faults[route]; len(faults) > 0 {
+		s.faults[route] = faults[1:]
+		return faults[0]
+	}
+	if s.faultFunc != nil {
+		return s.faultFunc(route)
+	}
+	return Fault{}
+}
+
+func (s *Server) serveWithFault(w http.ResponseWriter, r *http.Request, route Route, parts []string, fault Fault) {
+	if fault.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(fault.RetryAfter.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, &APIError{Message: "too many requests", Code: ErrorTooManyRequests})
+		return
+	}
+
+	if fault.ExpireToken {
+		s.mu.Lock()
+		delete(s.tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		s.mu.Unlock()
+		writeError(w, http.StatusUnauthorized, &APIError{Message: "invalid or expired jwt", Code: ErrorJWTInvalidOrExpired})
+		return
+	}
+
+	if fault.EvictIterator && len(parts) >= 4 && parts[2] == "iterator" {
+		if iteratorUUID, err := uuid.Parse(parts[3]); err == nil {
+			s.mu.Lock()
+			delete(s.iterators, iteratorUUID)
+			s.mu.Unlock()
+		}
+	}
+
+	if fault.Latency == 0 && !fault.DropAfterCommit && !fault.MalformedRecords {
+		s.serve(w, r, route, parts)
+		return
+	}
+
+	// the request is processed (committed), then the response is delayed or dropped
+	recorder := httptest.NewRecorder()
+	s.serve(recorder, r, route, parts)
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+
+	if fault.DropAfterCommit {
+		// the server closes the connection without writing the response
+		panic(http.ErrAbortHandler)
+	}
+
+	for key, values := range recorder.Header() {
+		w.Header()[key] = values
+	}
+	body := recorder.Body.Bytes()
+	if fault.MalformedRecords {
+		body = malformRecords(body)
+	}
+	w.WriteHeader(recorder.Code)
+	_, _ = w.Write(body)
+}
+
+// malformRecords removes the message ids of the records of a GetRecords response body.
+func malformRecords(body []byte) []byte {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	if records, ok := response["records"].([]interface{}); ok {
+		for _, record := range records {
+			if envelope, ok := record.(map[string]interface{}); ok {
+				delete(envelope, "i")
+			}
+		}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return data
+}
@@ -0,0 +1,144 @@
+package ministreamtest
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	ministreamclient "github.com/nbigot/ministream-client-go/client"
+	"github.com/nbigot/ministream-client-go/client/types"
+)
+
+// clientTimeout is shorter than the latency faults.
+const clientTimeout = 200 * time.Millisecond
+
+func newFaultClient(server *Server) *ministreamclient.MinistreamClient {
+	return ministreamclient.CreateClient(server.URL, "test", testCredentials, false, clientTimeout, nil)
+}
+
+// checkRecords checks that the stream holds the records 1 to cptRecords once and in order.
+func checkRecords(t *testing.T, server *Server, streamUUID types.StreamUUID, cptRecords int) {
+	t.Helper()
+	records := server.Records(streamUUID)
+	if len(records) != cptRecords {
+		t.Fatalf("len(Records()) = %d, want %d", len(records), cptRecords)
+	}
+	for idx, record := range records {
+		if n := record.Msg.(map[string]interface{})["n"]; n != float64(idx+1) {
+			t.Fatalf("record %d = %v, want %d", idx, n, idx+1)
+		}
+	}
+}
+
+func TestProducerFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults []Fault
+	}{
+		{"latency longer than the client timeout", []Fault{{}, {Latency: 2 * clientTimeout}}},
+		{"dropped connection after commit", []Fault{{}, {DropAfterCommit: true}, {DropAfterCommit: true}}},
+		{"too many requests", []Fault{{}, {RetryAfter: time.Second}}},
+		{"token expiry", []Fault{{}, {ExpireToken: true}}},
+		{"all", []Fault{{Latency: 2 * clientTimeout}, {DropAfterCommit: true}, {ExpireToken: true}, {}, {RetryAfter: time.Second}, {DropAfterCommit: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewTestServer(t, ServerSettings{Credentials: testCredentials})
+			streamUUID := server.CreateStream(nil)
+			server.InjectFaults(RoutePutRecords, tt.faults...)
+
+			client := newFaultClient(server)
+			if apiError := client.Authenticate(context.Background()); apiError != nil {
+				t.Fatalf("Authenticate() = %v, want %v", apiError, nil)
+			}
+			handler := produce(t, server, client, streamUUID, NewRecords(1000), 100)
+
+			checkRecords(t, server, streamUUID, 1000)
+			if pending := server.PendingFaults(RoutePutRecords); pending != 0 {
+				t.Errorf("PendingFaults() = %d, want %d", pending, 0)
+			}
+			if handler.CountFailedBatches() == 0 {
+				t.Errorf("no failed batch, want the faults to be handled")
+			}
+		})
+	}
+}
+
+func TestConsumerFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  Route
+		faults []Fault
+	}{
+		{"latency longer than the client timeout", RouteGetRecords, []Fault{{}, {Latency: 2 * clientTimeout}}},
+		{"too many requests", RouteGetRecords, []Fault{{}, {RetryAfter: time.Second}}},
+		{"token expiry", RouteGetRecords, []Fault{{}, {ExpireToken: true}, {}, {ExpireToken: true}}},
+		{"iterator eviction", RouteGetRecords, []Fault{{}, {EvictIterator: true}, {}, {EvictIterator: true}}},
+		{"dropped iterator creation", RouteCreateRecordsIterator, []Fault{{DropAfterCommit: true}}},
+		{"all", RouteGetRecords, []Fault{{EvictIterator: true}, {Latency: 2 * clientTimeout}, {}, {ExpireToken: true}, {RetryAfter: time.Second}, {EvictIterator: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// short long polling, the client timeout is short
+			server := NewTestServer(t, ServerSettings{Credentials: testCredentials, MaxWaitTime: 50 * time.Millisecond})
+			streamUUID := server.CreateStream(nil)
+			putRecords(t, newAuthenticatedClient(t, server), streamUUID, 0, 1, 500)
+			server.InjectFaults(tt.route, tt.faults...)
+
+			handler := consume(t, newFaultClient(server), streamUUID, 500)
+
+			if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, MessageIds(1, 500)) {
+				t.Errorf("consumed %d records, want the ids 1 to 500 once and in order", len(ids))
+			}
+			if pending := server.PendingFaults(tt.route); pending != 0 {
+				t.Errorf("PendingFaults() = %d, want %d", pending, 0)
+			}
+		})
+	}
+}
+
+func TestRandomFaults(t *testing.T) {
+	server := NewTestServer(t, ServerSettings{Credentials: testCredentials, MaxWaitTime: 50 * time.Millisecond})
+	streamUUID := server.CreateStream(nil)
+
+	// 1 request out of 5 fails (the GetRecords responses are not dropped: the client transport may send them again)
+	random := rand.New(rand.NewSource(1))
+	server.SetFaultFunc(func(route Route) Fault {
+		if random.Intn(5) != 0 {
+			return Fault{}
+		}
+		switch route {
+		case RoutePutRecords:
+			return []Fault{{Latency: 2 * clientTimeout}, {DropAfterCommit: true}, {ExpireToken: true}}[random.Intn(3)]
+		case RouteGetRecords:
+			return []Fault{{Latency: 2 * clientTimeout}, {EvictIterator: true}, {ExpireToken: true}}[random.Intn(3)]
+		case RouteCreateRecordsIterator:
+			return Fault{DropAfterCommit: true}
+		default:
+			return Fault{}
+		}
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var consumedIds []types.MessageId
+	go func() {
+		defer wg.Done()
+		consumedIds = consume(t, newFaultClient(server), streamUUID, 2000).GetMessageIds()
+	}()
+
+	client := newFaultClient(server)
+	if apiError := client.Authenticate(context.Background()); apiError != nil {
+		t.Fatalf("Authenticate() = %v, want %v", apiError, nil)
+	}
+	produce(t, server, client, streamUUID, NewRecords(2000), 50)
+	wg.Wait()
+
+	checkRecords(t, server, streamUUID, 2000)
+	if !reflect.DeepEqual(consumedIds, MessageIds(1, 2000)) {
+		t.Errorf("consumed %d records, want the ids 1 to 2000 once and in order", len(consumedIds))
+	}
+}
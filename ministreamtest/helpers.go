@@ -0,0 +1,23 @@
+package ministreamtest
+
+import (
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+// NewRecords returns count records {"n": 1} to {"n": count}.
+func NewRecords(count int) []interface{} {
+	records := make([]interface{}, count)
+	for idx := range records {
+		records[idx] = map[string]interface{}{"n": idx + 1}
+	}
+	return records
+}
+
+// MessageIds returns the message ids from first to last (inclusive), e.g. the ids expected by a consumer.
+func MessageIds(first MessageId, last MessageId) []MessageId {
+	ids := make([]MessageId, 0)
+	for id := first; id <= last; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,697 @@
+// Package ministreamtest provides an in-process fake Ministream server for the integration tests
+// of the producers and consumers. It implements the http api used by the client with an in-memory storage:
+// login, stream create/list/information, iterator create/close, records put/get with long polling,
+// batch id deduplication, busy iterators (425) and rate limiting (429).
+// Faults can be injected in the responses to exercise the retry paths (see Fault), and the helpers
+// (NewTestServer, Requests, AppendRecords, NewRecords, MessageIds) are shared by the tests of the module.
+package ministreamtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/itchyny/gojq"
+	ministreamclient "github.com/nbigot/ministream-client-go/client"
+	. "github.com/nbigot/ministream-client-go/client/types"
+)
+
+const headerBatchId = "x-ministream-batch-id"
+
+type ServerSettings struct {
+	Credentials          *ministreamclient.Credentials // account allowed to login, nil disables the authentication
+	TokenTTL             time.Duration                 // lifetime of the jwt (0 for no expiry)
+	MaxRequestsPerSecond int                           // over this rate the server answers 429 (0 to disable)
+	MaxWaitTime          time.Duration                 // caps the long polling duration of GetRecords (0 for no cap)
+}
+
+// Server is a fake Ministream server listening on a local address (see URL), it is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+	settings  ServerSettings
+	streams   map[StreamUUID]*stream
+	iterators map[StreamIteratorUUID]*iterator
+	tokens    map[string]time.Time // jwt => expiration date (zero for no expiry)
+	rate      rateWindow
+	faults    map[Route][]Fault       // faults injected in the next requests of each route
+	faultFunc func(route Route) Fault // faults injected when the script of the route is empty
+	requests  map[Route]int           // number of requests of each route
+	closed    chan struct{}           // closed on Close, ends the long polling requests
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+type stream struct {
+	info     StreamInformation
+	records  []ResponseRecordEnvelope
+	batchIds map[int]struct{}
+	changed  chan struct{} // closed (and replaced) when records are added
+}
+
+type iterator struct {
+	streamUUID StreamUUID
+	next       int // index of the next record to read
+	filter     *gojq.Code
+	maxWait    time.Duration
+	busy       bool
+}
+
+// rateWindow counts the requests of the current second.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// NewServer starts a server, it must be closed with Close.
+func NewServer(settings ServerSettings) *Server {
+	s := &Server{
+		settings:  settings,
+		streams:   make(map[StreamUUID]*stream),
+		iterators: make(map[StreamIteratorUUID]*iterator),
+		tokens:    make(map[string]time.Time),
+		faults:    make(map[Route][]Fault),
+		requests:  make(map[Route]int),
+		closed:    make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// NewTestServer starts a server which is closed at the end of the test.
+func NewTestServer(tb testing.TB, settings ServerSettings) *Server {
+	tb.Helper()
+	s := NewServer(settings)
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Close stops the server, the pending long polling requests return immediately.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.Server.Close()
+}
+
+// NewClient returns a client of the server with the credentials of the settings.
+func (s *Server) NewClient() *ministreamclient.MinistreamClient {
+	return ministreamclient.CreateClient(s.URL, "ministreamtest", s.settings.Credentials, false, 10*time.Second, nil)
+}
+
+// CreateStream creates a stream without an http call.
+func (s *Server) CreateStream(properties StreamProperties) StreamUUID {
+	return s.CreateStreamWithUUID(uuid.New(), properties)
+}
+
+// CreateStreamWithUUID creates a stream with the given uuid without an http call
+// (e.g. the same stream on the servers of a client with several endpoints).
+func (s *Server) CreateStreamWithUUID(streamUUID StreamUUID, properties StreamProperties) StreamUUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createStream(streamUUID, properties).info.UUID
+}
+
+// AppendRecords saves the records in the stream without an http call, it returns their message ids
+// (the records are stored as they are read back from json, like the records sent by a client).
+func (s *Server) AppendRecords(streamUUID StreamUUID, records []interface{}) ([]MessageId, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, found := s.streams[streamUUID]
+	if !found {
+		return nil, fmt.Errorf("stream %s not found", streamUUID)
+	}
+	return st.append(decoded, int64(len(data))), nil
+}
+
+// Requests returns the number of requests received on the route.
+func (s *Server) Requests(route Route) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
+
+// Records returns a copy of the records of the stream.
+func (s *Server) Records(streamUUID StreamUUID) []ResponseRecordEnvelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, found := s.streams[streamUUID]
+	if !found {
+		return nil
+	}
+	return append([]ResponseRecordEnvelope{}, st.records...)
+}
+
+func (s *Server) createStream(streamUUID StreamUUID, properties StreamProperties) *stream {
+	now := time.Now()
+	if properties == nil {
+		properties = StreamProperties{}
+	}
+	st := &stream{
+		info:     StreamInformation{UUID: streamUUID, CreationDate: now, LastUpdate: now, Properties: properties},
+		records:  make([]ResponseRecordEnvelope, 0),
+		batchIds: make(map[int]struct{}),
+		changed:  make(chan struct{}),
+	}
+	s.streams[st.info.UUID] = st
+	return st
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	route := routeOf(r, parts)
+	if route == "" {
+		writeError(w, http.StatusNotFound, &APIError{Message: "not found", Details: r.Method + " " + r.URL.Path})
+		return
+	}
+	s.mu.Lock()
+	s.requests[route]++
+	s.mu.Unlock()
+
+	if retryAfter, limited := s.limitRate(w); limited {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, &APIError{Message: "too many requests", Code: ErrorTooManyRequests})
+		return
+	}
+
+	fault := s.nextFault(route)
+	if fault.isZero() {
+		s.serve(w, r, route, parts)
+		return
+	}
+	s.serveWithFault(w, r, route, parts, fault)
+}
+
+// routeOf returns the route of the request, or an empty string if the path is unknown.
+func routeOf(r *http.Request, parts []string) Route {
+	if !strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		return ""
+	}
+	switch {
+	case r.Method == "GET" && match(parts, "user", "login"):
+		return RouteLogin
+	case r.Method == "GET" && match(parts, "utils", "ping"):
+		return RoutePing
+	case r.Method == "GET" && match(parts, "streams"):
+		return RouteListStreams
+	case r.Method == "POST" && (match(parts, "stream") || match(parts, "stream", "")):
+		return RouteCreateStream
+	case r.Method == "GET" && match(parts, "stream", "*"):
+		return RouteGetStreamInformation
+	case r.Method == "PUT" && match(parts, "stream", "*", "records"):
+		return RoutePutRecords
+	case r.Method == "POST" && match(parts, "stream", "*", "iterator"):
+		return RouteCreateRecordsIterator
+	case r.Method == "DELETE" && match(parts, "stream", "*", "iterator", "*"):
+		return RouteCloseRecordsIterator
+	case r.Method == "GET" && match(parts, "stream", "*", "iterator", "*", "records"):
+		return RouteGetRecords
+	default:
+		return ""
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, route Route, parts []string) {
+	switch route {
+	case RouteLogin:
+		s.login(w, r)
+		return
+	case RoutePing:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !s.authorize(w, r) {
+		return
+	}
+	switch route {
+	case RouteListStreams:
+		s.listStreams(w)
+	case RouteCreateStream:
+		s.createStreamHandler(w, r)
+	case RouteGetStreamInformation:
+		s.getStreamInformation(w, parts[1])
+	case RoutePutRecords:
+		s.putRecords(w, r, parts[1])
+	case RouteCreateRecordsIterator:
+		s.createRecordsIterator(w, r, parts[1])
+	case RouteCloseRecordsIterator:
+		s.closeRecordsIterator(w, parts[1], parts[3])
+	case RouteGetRecords:
+		s.getRecords(w, r, parts[1], parts[3])
+	}
+}
+
+// match returns true if the parts of the path equal the pattern ("*" matches any part).
+func match(parts []string, pattern ...string) bool {
+	if len(parts) != len(pattern) {
+		return false
+	}
+	for idx, part := range pattern {
+		if part != "*" && part != parts[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// limitRate counts the request, it returns the number of seconds to wait if the rate is exceeded.
+func (s *Server) limitRate(w http.ResponseWriter) (int, bool) {
+	if s.settings.MaxRequestsPerSecond <= 0 {
+		return 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.rate.start) >= time.Second {
+		s.rate = rateWindow{start: now}
+	}
+	s.rate.count++
+	reset := int(math.Ceil(s.rate.start.Add(time.Second).Sub(now).Seconds()))
+	remaining := s.settings.MaxRequestsPerSecond - s.rate.count
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.settings.MaxRequestsPerSecond))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(reset))
+	return reset, s.rate.count > s.settings.MaxRequestsPerSecond
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	creds := s.settings.Credentials
+	if creds == nil {
+		writeError(w, http.StatusBadRequest, &APIError{Message: "jwt is not enabled", Code: ErrorJWTNotEnabled})
+		return
+	}
+	if r.Header.Get("ACCESS-KEY-ID") != creds.Login || r.Header.Get("SECRET-ACCESS-KEY") != creds.Password {
+		writeError(w, http.StatusUnauthorized, &APIError{Message: "wrong credentials", Code: ErrorWrongCredentials})
+		return
+	}
+
+	token := uuid.NewString()
+	var expiresAt time.Time
+	if s.settings.TokenTTL > 0 {
+		expiresAt = time.Now().Add(s.settings.TokenTTL)
+	}
+	s.mu.Lock()
+	s.tokens[token] = expiresAt
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, LoginUserResponse{Status: StatusSuccess, Message: "logged in", JWT: token})
+}
+
+// authorize checks the jwt of the request, it writes the error response and returns false if it is invalid.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if s.settings.Credentials == nil {
+		return true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		writeError(w, http.StatusUnauthorized, &APIError{Message: "missing or malformed jwt", Code: ErrorJWTMissingOrMalformed})
+		return false
+	}
+
+	s.mu.Lock()
+	expiresAt, found := s.tokens[token]
+	s.mu.Unlock()
+	if !found || (!expiresAt.IsZero() && time.Now().After(expiresAt)) {
+		writeError(w, http.StatusUnauthorized, &APIError{Message: "invalid or expired jwt", Code: ErrorJWTInvalidOrExpired})
+		return false
+	}
+	return true
+}
+
+func (s *Server) listStreams(w http.ResponseWriter) {
+	s.mu.Lock()
+	streams := make([]StreamUUID, 0, len(s.streams))
+	for streamUUID := range s.streams {
+		streams = append(streams, streamUUID)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].String() < streams[j].String() })
+	writeJSON(w, http.StatusOK, streams)
+}
+
+func (s *Server) createStreamHandler(w http.ResponseWriter, r *http.Request) {
+	payload := struct {
+		Properties StreamProperties `json:"properties"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, &APIError{Message: ErrorCannotUnmarshalJson, Details: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	info := s.createStream(uuid.New(), payload.Properties).info
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) getStreamInformation(w http.ResponseWriter, streamId string) {
+	s.mu.Lock()
+	st, apiError := s.getStream(streamId)
+	var info StreamInformation
+	if st != nil {
+		info = st.info
+	}
+	s.mu.Unlock()
+
+	if apiError != nil {
+		writeError(w, http.StatusNotFound, apiError)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// getStream returns the stream, s.mu must be locked.
+func (s *Server) getStream(streamId string) (*stream, *APIError) {
+	streamUUID, err := uuid.Parse(streamId)
+	if err != nil {
+		return nil, &APIError{Message: "invalid stream uuid", Details: streamId}
+	}
+	st, found := s.streams[streamUUID]
+	if !found {
+		return nil, &APIError{Message: "stream not found", StreamUUID: streamUUID}
+	}
+	return st, nil
+}
+
+func (s *Server) putRecords(w http.ResponseWriter, r *http.Request, streamId string) {
+	startTime := time.Now()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, APIErrorFromError(err))
+		return
+	}
+	var records []interface{}
+	if err := json.Unmarshal(body, &records); err != nil {
+		writeError(w, http.StatusBadRequest, &APIError{Message: ErrorCannotUnmarshalJson, Details: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, apiError := s.getStream(streamId)
+	if apiError != nil {
+		writeError(w, http.StatusNotFound, apiError)
+		return
+	}
+
+	if value := r.Header.Get(headerBatchId); value != "" {
+		batchId, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, &APIError{Message: "invalid batch id", Details: value, StreamUUID: st.info.UUID})
+			return
+		}
+		if _, found := st.batchIds[batchId]; found {
+			// the batch has already been saved (the producer sends it again after a timeout)
+			writeError(w, http.StatusConflict, &APIError{Message: "duplicated batch id", Details: value, Code: ErrorDuplicatedBatchId, StreamUUID: st.info.UUID})
+			return
+		}
+		st.batchIds[batchId] = struct{}{}
+	}
+
+	messageIds := st.append(records, int64(len(body)))
+	writeJSON(w, http.StatusAccepted, PutRecordsResponse{
+		Status:     StatusSuccess,
+		Duration:   time.Since(startTime),
+		Count:      int64(len(records)),
+		StreamUUID: st.info.UUID,
+		MessageIds: messageIds,
+	})
+}
+
+// append saves the records and wakes up the long polling requests, the mutex of the server must be locked.
+func (st *stream) append(records []interface{}, sizeInBytes int64) []MessageId {
+	now := time.Now()
+	messageIds := make([]MessageId, len(records))
+	for idx, record := range records {
+		st.info.LastMsgId++
+		messageIds[idx] = st.info.LastMsgId
+		st.records = append(st.records, ResponseRecordEnvelope{Id: st.info.LastMsgId, CreationDate: now, Msg: record})
+	}
+	if len(records) > 0 {
+		st.info.CptMessages += Size64(len(records))
+		st.info.SizeInBytes += Size64(sizeInBytes)
+		st.info.LastUpdate = now
+		close(st.changed)
+		st.changed = make(chan struct{})
+	}
+	return messageIds
+}
+
+func (s *Server) createRecordsIterator(w http.ResponseWriter, r *http.Request, streamId string) {
+	var p RecordsIteratorParams
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, &APIError{Message: ErrorCannotUnmarshalJson, Details: err.Error()})
+		return
+	}
+	if apiError := p.Validate(); apiError != nil {
+		writeError(w, http.StatusBadRequest, apiError)
+		return
+	}
+
+	it := iterator{}
+	if p.JqFilter != nil && *p.JqFilter != "" {
+		query, err := gojq.Parse(*p.JqFilter)
+		if err == nil {
+			it.filter, err = gojq.Compile(query)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, &APIError{Message: "invalid jq filter", Details: err.Error()})
+			return
+		}
+	}
+	if p.MaxWaitTimeSeconds != nil && *p.MaxWaitTimeSeconds > 0 {
+		it.maxWait = time.Duration(*p.MaxWaitTimeSeconds) * time.Second
+		if s.settings.MaxWaitTime > 0 && it.maxWait > s.settings.MaxWaitTime {
+			it.maxWait = s.settings.MaxWaitTime
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, apiError := s.getStream(streamId)
+	if apiError != nil {
+		writeError(w, http.StatusNotFound, apiError)
+		return
+	}
+	it.streamUUID = st.info.UUID
+	it.next = st.position(&p)
+
+	iteratorUUID := uuid.New()
+	s.iterators[iteratorUUID] = &it
+	writeJSON(w, http.StatusOK, CreateRecordsIteratorResponse{
+		Status:             StatusSuccess,
+		Message:            "iterator created",
+		StreamUUID:         st.info.UUID,
+		StreamIteratorUUID: iteratorUUID,
+	})
+}
+
+// position returns the index of the first record of a new iterator, the mutex of the server must be locked.
+func (st *stream) position(p *RecordsIteratorParams) int {
+	// the message ids are contiguous: the record of id n is at the index n-1
+	switch p.IteratorType {
+	case IteratorTypeLastMessage:
+		if len(st.records) > 0 {
+			return len(st.records) - 1
+		}
+		return 0
+	case IteratorTypeAfterLastMessage:
+		return len(st.records)
+	case IteratorTypeAtMessageId:
+		return clampIndex(int(*p.MessageId)-1, len(st.records))
+	case IteratorTypeAfterMessageId:
+		return clampIndex(int(*p.MessageId), len(st.records))
+	case IteratorTypeAtTimestamp:
+		return sort.Search(len(st.records), func(idx int) bool {
+			return !st.records[idx].CreationDate.Before(*p.Timestamp)
+		})
+	default:
+		return 0
+	}
+}
+
+func clampIndex(idx int, length int) int {
+	if idx < 0 {
+		return 0
+	}
+	if idx > length {
+		return length
+	}
+	return idx
+}
+
+func (s *Server) closeRecordsIterator(w http.ResponseWriter, streamId string, iteratorId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streamUUID, iteratorUUID, _, apiError := s.getIterator(streamId, iteratorId)
+	if apiError != nil {
+		writeError(w, http.StatusNotFound, apiError)
+		return
+	}
+	delete(s.iterators, iteratorUUID)
+	writeJSON(w, http.StatusOK, CloseRecordsIteratorResponse{
+		Status:             StatusSuccess,
+		Message:            "iterator closed",
+		StreamUUID:         streamUUID,
+		StreamIteratorUUID: iteratorUUID,
+	})
+}
+
+// getIterator returns the iterator of the stream, s.mu must be locked.
+func (s *Server) getIterator(streamId string, iteratorId string) (StreamUUID, StreamIteratorUUID, *iterator, *APIError) {
+	streamUUID, err1 := uuid.Parse(streamId)
+	iteratorUUID, err2 := uuid.Parse(iteratorId)
+	if err1 != nil || err2 != nil {
+		return streamUUID, iteratorUUID, nil, &APIError{Message: "stream iterator not found", Code: ErrorStreamIteratorNotFound}
+	}
+	it, found := s.iterators[iteratorUUID]
+	if !found || it.streamUUID != streamUUID {
+		return streamUUID, iteratorUUID, nil, &APIError{Message: "stream iterator not found", Code: ErrorStreamIteratorNotFound, StreamUUID: streamUUID}
+	}
+	return streamUUID, iteratorUUID, it, nil
+}
+
+func (s *Server) getRecords(w http.ResponseWriter, r *http.Request, streamId string, iteratorId string) {
+	startTime := time.Now()
+	maxRecords := MaxPullRecordsByCall
+	if value := r.URL.Query().Get("maxRecords"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n < maxRecords {
+			maxRecords = n
+		}
+	}
+
+	s.mu.Lock()
+	streamUUID, iteratorUUID, it, apiError := s.getIterator(streamId, iteratorId)
+	if apiError != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, apiError)
+		return
+	}
+	if it.busy {
+		// a single GetRecords call at a time per iterator
+		s.mu.Unlock()
+		writeError(w, http.StatusTooEarly, &APIError{Message: "stream iterator is busy", Code: ErrorStreamIteratorIsBusy, StreamUUID: streamUUID})
+		return
+	}
+	it.busy = true
+	s.mu.Unlock()
+
+	// the long polling ends when records are available or after maxWait
+	longPolling := it.maxWait > 0
+	deadline := time.NewTimer(it.maxWait)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		if s.iterators[iteratorUUID] != it {
+			// the iterator has been closed during the long polling
+			s.mu.Unlock()
+			writeError(w, http.StatusNotFound, &APIError{Message: "stream iterator not found", Code: ErrorStreamIteratorNotFound, StreamUUID: streamUUID})
+			return
+		}
+		st := s.streams[streamUUID]
+		response := it.read(st, maxRecords)
+		changed := st.changed
+		if len(response.Records) > 0 || !longPolling {
+			it.busy = false
+			s.mu.Unlock()
+			response.Duration = time.Since(startTime)
+			response.StreamIteratorUUID = iteratorUUID
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+		s.mu.Unlock()
+
+		// long polling: wait for new records
+		select {
+		case <-changed:
+			continue
+		case <-deadline.C:
+			longPolling = false
+			continue
+		case <-r.Context().Done():
+		case <-s.closed:
+		}
+		s.mu.Lock()
+		it.busy = false
+		s.mu.Unlock()
+		return
+	}
+}
+
+// read returns the next records of the iterator, the mutex of the server must be locked.
+func (it *iterator) read(st *stream, maxRecords int) GetStreamRecordsResponse {
+	response := GetStreamRecordsResponse{Status: StatusSuccess, StreamUUID: st.info.UUID, Records: make([]interface{}, 0)}
+	for it.next < len(st.records) && len(response.Records) < maxRecords {
+		record := st.records[it.next]
+		it.next++
+		matched, err := it.match(record.Msg)
+		switch {
+		case err != nil:
+			response.CountErrors++
+		case !matched:
+			response.CountSkipped++
+		default:
+			response.Records = append(response.Records, record)
+		}
+	}
+	response.Count = len(response.Records)
+	response.Remain = it.next < len(st.records)
+	return response
+}
+
+// match returns true if the jq filter of the iterator outputs a value other than false or null.
+func (it *iterator) match(msg interface{}) (bool, error) {
+	if it.filter == nil {
+		return true, nil
+	}
+	iter := it.filter.Run(msg)
+	for {
+		value, ok := iter.Next()
+		if !ok {
+			return false, nil
+		}
+		if err, isError := value.(error); isError {
+			return false, err
+		}
+		if value != nil && value != false {
+			return true, nil
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, apiError *APIError) {
+	writeJSON(w, status, apiError)
+}
@@ -0,0 +1,398 @@
+package ministreamtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	ministreamclient "github.com/nbigot/ministream-client-go/client"
+	"github.com/nbigot/ministream-client-go/client/backoff"
+	"github.com/nbigot/ministream-client-go/client/jqfilter"
+	"github.com/nbigot/ministream-client-go/client/types"
+	ministreamconsumer "github.com/nbigot/ministream-client-go/consumer"
+	ministreamproducer "github.com/nbigot/ministream-client-go/producer"
+)
+
+var testCredentials = &ministreamclient.Credentials{Login: "test", Password: "secret"}
+
+func newAuthenticatedClient(t *testing.T, server *Server) *ministreamclient.MinistreamClient {
+	t.Helper()
+	client := server.NewClient()
+	if apiError := client.Authenticate(context.Background()); apiError != nil {
+		t.Fatalf("Authenticate() = %v, want %v", apiError, nil)
+	}
+	return client
+}
+
+func putRecords(t *testing.T, client *ministreamclient.MinistreamClient, streamUUID uuid.UUID, batchId int, first int, count int) {
+	t.Helper()
+	records := make([]interface{}, count)
+	for idx := range records {
+		records[idx] = map[string]interface{}{"n": first + idx}
+	}
+	if _, _, apiError := client.PutRecords(context.Background(), streamUUID, batchId, records); apiError != nil {
+		t.Fatalf("PutRecords() = %v, want %v", apiError, nil)
+	}
+}
+
+// produce sends the records with a producer, it returns once the server has saved all the records.
+func produce(t *testing.T, server *Server, client types.IProducerClient, streamUUID uuid.UUID, records []interface{}, batchSize int) *ministreamproducer.MockRetryProducerEventHandler {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	handler := ministreamproducer.NewMockRetryProducerEventHandler()
+	producer := ministreamproducer.NewStreamProducer(ctx, nil, 0, client, streamUUID, handler)
+	producer.Batch = ministreamproducer.NewBatchRecords(batchSize)
+	producer.BackPressure = backoff.NewExponentialBackoff(time.Millisecond, 50*time.Millisecond)
+	handler.Init(producer)
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- producer.Run(runCtx) }()
+
+	select {
+	case <-handler.Running:
+	case <-ctx.Done():
+		t.Fatal("the producer is not running")
+	}
+	if _, err := producer.EnqueueRecords(records); err != nil {
+		t.Fatalf("EnqueueRecords() = %v, want %v", err, nil)
+	}
+	for len(server.Records(streamUUID)) < len(records) {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("%d records saved, want %d", len(server.Records(streamUUID)), len(records))
+		}
+	}
+
+	stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+	return handler
+}
+
+// consume reads cptRecords records with a consumer.
+func consume(t *testing.T, client types.IConsumerClient, streamUUID uuid.UUID, cptRecords int) *ministreamconsumer.MockConsumerHandler {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	maxWaitTimeSeconds := 1
+	handler := ministreamconsumer.NewMockConsumerHandler(client, cptRecords)
+	handler.Params.MaxWaitTimeSeconds = &maxWaitTimeSeconds
+	consumer := ministreamconsumer.CreateConsumer(ctx, streamUUID, handler, 100)
+	consumer.BackPressure = backoff.NewExponentialBackoff(time.Millisecond, 50*time.Millisecond)
+	if apiError := consumer.Run(ctx); apiError != nil {
+		t.Fatalf("Run() = %v, want %v", apiError, nil)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("%d records consumed, want %d", len(handler.GetMessageIds()), cptRecords)
+	}
+	return handler
+}
+
+func TestProduceAndConsume(t *testing.T) {
+	server := NewTestServer(t, ServerSettings{Credentials: testCredentials})
+	streamUUID := server.CreateStream(nil)
+
+	produce(t, server, newAuthenticatedClient(t, server), streamUUID, NewRecords(2500), 300)
+	handler := consume(t, server.NewClient(), streamUUID, 2500)
+
+	if ids := handler.GetMessageIds(); !reflect.DeepEqual(ids, MessageIds(1, 2500)) {
+		t.Errorf("consumed %d records, want the ids 1 to 2500", len(ids))
+	}
+	for idx, record := range server.Records(streamUUID) {
+		if n := record.Msg.(map[string]interface{})["n"]; n != float64(idx+1) {
+			t.Fatalf("record %d = %v, want %d", idx, n, idx+1)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	server := NewTestServer(t, ServerSettings{})
+	client := server.NewClient()
+	ctx := context.Background()
+
+	created, err := client.CreateStream(ctx, &types.StreamProperties{"name": "test"})
+	if err != nil {
+		t.Fatalf("CreateStream() = %v, want %v", err, nil)
+	}
+	putRecords(t, client, created.UUID, 0, 1, 3)
+
+	info, apiError := client.GetStreamInformation(ctx, created.UUID)
+	if apiError != nil {
+		t.Fatalf("GetStreamInformation() = %v, want %v", apiError, nil)
+	}
+	if info.CptMessages != 3 || info.LastMsgId != 3 || info.Properties["name"] != "test" {
+		t.Errorf("GetStreamInformation() = %+v, want 3 messages", info)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/streams")
+	if err != nil {
+		t.Fatalf("list streams: %v", err)
+	}
+	defer resp.Body.Close()
+	var streams []uuid.UUID
+	if err := json.NewDecoder(resp.Body).Decode(&streams); err != nil {
+		t.Fatalf("list streams: %v", err)
+	}
+	if !reflect.DeepEqual(streams, []uuid.UUID{created.UUID}) {
+		t.Errorf("streams = %v, want %v", streams, []uuid.UUID{created.UUID})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx := context.Background()
+	server := NewTestServer(t, ServerSettings{Credentials: testCredentials})
+	streamUUID := server.CreateStream(nil)
+
+	wrong := ministreamclient.CreateClient(server.URL, "test", &ministreamclient.Credentials{Login: "test", Password: "wrong"}, false, time.Second, nil)
+	if apiError := wrong.Authenticate(ctx); apiError == nil || apiError.Code != types.ErrorWrongCredentials {
+		t.Errorf("Authenticate() = %v, want code %d", apiError, types.ErrorWrongCredentials)
+	}
+
+	anonymous := ministreamclient.CreateClient(server.URL, "test", nil, false, time.Second, nil)
+	if _, _, apiError := anonymous.PutRecords(ctx, streamUUID, 0, NewRecords(1)); apiError == nil || apiError.Code != types.ErrorJWTMissingOrMalformed {
+		t.Errorf("PutRecords() = %v, want code %d", apiError, types.ErrorJWTMissingOrMalformed)
+	}
+
+	// the authentication is disabled on the server
+	noAuthServer := NewTestServer(t, ServerSettings{})
+	client := ministreamclient.CreateClient(noAuthServer.URL, "test", testCredentials, false, time.Second, nil)
+	if apiError := client.Authenticate(ctx); apiError != nil {
+		t.Errorf("Authenticate() = %v, want %v", apiError, nil)
+	}
+}
+
+func TestOrderedMergeWithAuthentication(t *testing.T) {
+	// the token expires while the streams are consumed, the streams share it (run with -race)
+	server := NewTestServer(t, ServerSettings{Credentials: testCredentials, TokenTTL: 50 * time.Millisecond})
+	streams := make([]uuid.UUID, 3)
+	for idx := range streams {
+		streams[idx] = server.CreateStream(nil)
+		putRecords(t, newAuthenticatedClient(t, server), streams[idx], 0, 1, 200)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	params := types.RecordsIteratorParams{IteratorType: types.IteratorTypeFirstMessage}
+	merge := ministreamconsumer.NewOrderedMergeConsumer(ctx, server.NewClient(), streams, &params, 10, 10*time.Millisecond, nil)
+	for _, consumer := range merge.Consumers {
+		consumer.BackPressure = backoff.NewExponentialBackoff(time.Millisecond, 50*time.Millisecond)
+	}
+
+	cptRecords := make(map[uuid.UUID]int)
+	total := 0
+	merge.All(ctx)(func(envelope ministreamconsumer.Envelope, err error) bool {
+		if err != nil {
+			t.Errorf("All() error = %v", err)
+			return false
+		}
+		cptRecords[envelope.StreamUUID]++
+		total++
+		return total < 3*200
+	})
+	for _, streamUUID := range streams {
+		if cptRecords[streamUUID] != 200 {
+			t.Errorf("%d records consumed from stream %v, want %d", cptRecords[streamUUID], streamUUID, 200)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use (output of a logger).
+type syncBuffer struct {
+	buffer bytes.Buffer
+	mu     sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func TestConsumerLagWithAuthentication(t *testing.T) {
+	// the lag is refreshed with the token of the consumer, once it is authenticated (run with -race)
+	server := NewTestServer(t, ServerSettings{Credentials: testCredentials})
+	streamUUID := server.CreateStream(nil)
+	putRecords(t, newAuthenticatedClient(t, server), streamUUID, 0, 1, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var logs syncBuffer
+	handler := ministreamconsumer.NewMockConsumerHandler(server.NewClient(), 10)
+	handler.Logger = log.New(&logs, "", 0)
+	consumer := ministreamconsumer.CreateConsumer(ctx, streamUUID, handler, 5)
+	consumer.BackPressure = backoff.NewExponentialBackoff(time.Millisecond, 50*time.Millisecond)
+	consumer.LagRefreshInterval = time.Millisecond
+	if apiError := consumer.Run(ctx); apiError != nil {
+		t.Fatalf("Run() = %v, want %v", apiError, nil)
+	}
+
+	if strings.Contains(logs.String(), "can't refresh lag") {
+		t.Errorf("logs = %q, want no lag refresh error", logs.String())
+	}
+	if lag, ok := consumer.Lag(); !ok || lag.LastMsgId != 10 {
+		t.Errorf("Lag() = %+v, %v, want the last message id %d", lag, ok, 10)
+	}
+}
+
+func TestRecordsIteratorTypes(t *testing.T) {
+	server := NewTestServer(t, ServerSettings{})
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+	putRecords(t, client, streamUUID, 0, 1, 5)
+	middle := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	putRecords(t, client, streamUUID, 1, 6, 5)
+
+	messageId := types.MessageId(7)
+	filter, err := jqfilter.Select(jqfilter.Gte(".n", 9))
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		params   types.RecordsIteratorParams
+		expected []types.MessageId
+	}{
+		{"first message", types.RecordsIteratorParams{IteratorType: types.IteratorTypeFirstMessage}, MessageIds(1, 10)},
+		{"last message", types.RecordsIteratorParams{IteratorType: types.IteratorTypeLastMessage}, MessageIds(10, 10)},
+		{"after last message", types.RecordsIteratorParams{IteratorType: types.IteratorTypeAfterLastMessage}, MessageIds(1, 0)},
+		{"at message id", types.RecordsIteratorParams{IteratorType: types.IteratorTypeAtMessageId, MessageId: &messageId}, MessageIds(7, 10)},
+		{"after message id", types.RecordsIteratorParams{IteratorType: types.IteratorTypeAfterMessageId, MessageId: &messageId}, MessageIds(8, 10)},
+		{"at timestamp", types.RecordsIteratorParams{IteratorType: types.IteratorTypeAtTimestamp, Timestamp: &middle}, MessageIds(6, 10)},
+		{"jq filter", types.RecordsIteratorParams{IteratorType: types.IteratorTypeFirstMessage, JqFilter: &filter}, MessageIds(9, 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			iterator, apiError := client.CreateRecordsIterator(ctx, streamUUID, &tt.params)
+			if apiError != nil {
+				t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+			}
+			defer client.CloseRecordsIterator(ctx, streamUUID, iterator.StreamIteratorUUID)
+
+			response, _, apiError := client.GetRecords(ctx, streamUUID, iterator.StreamIteratorUUID, 100)
+			if apiError != nil {
+				t.Fatalf("GetRecords() = %v, want %v", apiError, nil)
+			}
+			ids := make([]types.MessageId, 0)
+			for _, record := range response.Records {
+				envelope, err := ministreamconsumer.ParseRecordEnvelope(record)
+				if err != nil {
+					t.Fatalf("ParseRecordEnvelope() = %v", err)
+				}
+				ids = append(ids, envelope.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.expected) || response.Remain {
+				t.Errorf("GetRecords() = %v (remain %v), want %v", ids, response.Remain, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetRecordsLongPolling(t *testing.T) {
+	ctx := context.Background()
+	server := NewTestServer(t, ServerSettings{})
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+
+	maxWaitTimeSeconds := 10
+	iterator, apiError := client.CreateRecordsIterator(ctx, streamUUID, &types.RecordsIteratorParams{IteratorType: types.IteratorTypeFirstMessage, MaxWaitTimeSeconds: &maxWaitTimeSeconds})
+	if apiError != nil {
+		t.Fatalf("CreateRecordsIterator() = %v, want %v", apiError, nil)
+	}
+
+	type result struct {
+		response *types.GetStreamRecordsResponse
+		apiError *types.APIError
+	}
+	results := make(chan result, 1)
+	startTime := time.Now()
+	go func() {
+		response, _, apiError := client.GetRecords(ctx, streamUUID, iterator.StreamIteratorUUID, 100)
+		results <- result{response, apiError}
+	}()
+
+	// a single call at a time per iterator
+	time.Sleep(50 * time.Millisecond)
+	if _, _, apiError := client.GetRecords(ctx, streamUUID, iterator.StreamIteratorUUID, 100); apiError == nil || apiError.Code != types.ErrorStreamIteratorIsBusy {
+		t.Errorf("GetRecords() = %v, want code %d", apiError, types.ErrorStreamIteratorIsBusy)
+	}
+
+	putRecords(t, client, streamUUID, 0, 1, 2)
+	r := <-results
+	if r.apiError != nil || len(r.response.Records) != 2 {
+		t.Fatalf("GetRecords() = %+v, %v, want 2 records", r.response, r.apiError)
+	}
+	if elapsed := time.Since(startTime); elapsed >= 5*time.Second {
+		t.Errorf("GetRecords() took %s, want the records as soon as they are put", elapsed)
+	}
+}
+
+func TestPutRecordsDuplicatedBatchId(t *testing.T) {
+	ctx := context.Background()
+	server := NewTestServer(t, ServerSettings{})
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+
+	putRecords(t, client, streamUUID, 7, 1, 3)
+	if _, _, apiError := client.PutRecords(ctx, streamUUID, 7, NewRecords(3)); apiError == nil || apiError.Code != types.ErrorDuplicatedBatchId {
+		t.Errorf("PutRecords() = %v, want code %d", apiError, types.ErrorDuplicatedBatchId)
+	}
+	if records := server.Records(streamUUID); len(records) != 3 {
+		t.Errorf("len(Records()) = %d, want %d", len(records), 3)
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	ctx := context.Background()
+	server := NewTestServer(t, ServerSettings{MaxRequestsPerSecond: 2})
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+
+	var lastError *types.APIError
+	var lastResponse *http.Response
+	for i := 0; i < 3; i++ {
+		_, lastResponse, lastError = client.PutRecords(ctx, streamUUID, i, NewRecords(1))
+	}
+	if lastError == nil || lastError.Code != types.ErrorTooManyRequests {
+		t.Fatalf("PutRecords() = %v, want code %d", lastError, types.ErrorTooManyRequests)
+	}
+	if rateLimit := backoff.RateLimitFromHttpResponse(lastResponse); rateLimit.RetryAfterDuration <= 0 || rateLimit.Remaining != 0 {
+		t.Errorf("RateLimitFromHttpResponse() = %+v, want a Retry-After delay", rateLimit)
+	}
+	if records := server.Records(streamUUID); len(records) != 2 {
+		t.Errorf("len(Records()) = %d, want %d", len(records), 2)
+	}
+}
+
+func ExampleServer() {
+	server := NewServer(ServerSettings{})
+	defer server.Close()
+
+	client := server.NewClient()
+	streamUUID := server.CreateStream(nil)
+	response, _, _ := client.PutRecords(context.Background(), streamUUID, 0, []interface{}{"hello", "world"})
+	fmt.Println(response.MessageIds)
+	// Output: [1 2]
+}
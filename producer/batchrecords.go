@@ -18,12 +18,13 @@ func (b *BatchRecords) IsFull() bool {
 	return len(b.records) == cap(b.records)
 }
 
-func (b *BatchRecords) Append(record interface{}) {
+func (b *BatchRecords) Append(record interface{}) error {
 	if b.IsFull() {
-		panic("BatchRecords is full, can't append any more records")
+		return ErrBatchRecordsFull
 	}
 
 	b.records = append(b.records, record)
+	return nil
 }
 
 func (b *BatchRecords) Size() int {
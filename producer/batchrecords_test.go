@@ -1,6 +1,7 @@
 package ministreamproducer
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -69,7 +70,14 @@ func TestBatchRecords(t *testing.T) {
 
 	// Append one more record
 	record := maxCapacity - 1
-	batchRecords.Append(record)
+	if err := batchRecords.Append(record); err != nil {
+		t.Errorf("Append() error = %v, want %v", err, nil)
+	}
+
+	// Append on a full batch
+	if err := batchRecords.Append(record); !errors.Is(err, ErrBatchRecordsFull) {
+		t.Errorf("Append() error = %v, want %v", err, ErrBatchRecordsFull)
+	}
 
 	if batchRecords.IsEmpty() != false {
 		t.Errorf("IsEmpty() = %v, want %v", batchRecords.IsEmpty(), false)
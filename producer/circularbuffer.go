@@ -4,6 +4,7 @@ import (
 	"sync"
 )
 
+// CircularBuffer is a FIFO queue of fixed capacity, it is safe for concurrent use.
 type CircularBuffer struct {
 	items           []interface{}
 	capacity        int
@@ -12,48 +13,60 @@ type CircularBuffer struct {
 	mu              sync.Mutex
 }
 
-func BuildCircularBuffer(capacity int) *CircularBuffer {
+func BuildCircularBuffer(capacity int) (*CircularBuffer, error) {
 	// note: the maximum number of items in the buffer is equal to capacity - 1
 	if capacity < 2 {
-		panic("capacity must be > 1")
+		return nil, ErrInvalidCircularBufferCapacity
 	}
-	return &CircularBuffer{items: make([]interface{}, capacity), capacity: capacity, nextWriteCursor: 0, nextReadCursor: 0}
+	return &CircularBuffer{items: make([]interface{}, capacity), capacity: capacity, nextWriteCursor: 0, nextReadCursor: 0}, nil
 }
 
 func (c *CircularBuffer) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// release the references to the items
+	for idx := range c.items {
+		c.items[idx] = nil
+	}
 	c.nextWriteCursor = 0
 	c.nextReadCursor = 0
 }
 
 func (c *CircularBuffer) Capacity() int {
+	// the capacity never changes
 	return c.capacity
 }
 
 func (c *CircularBuffer) IsEmpty() bool {
-	return c.nextReadCursor == c.nextWriteCursor
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isEmpty()
 }
 
 func (c *CircularBuffer) IsFull() bool {
-	return (c.nextWriteCursor+1)%c.capacity == c.nextReadCursor
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isFull()
 }
 
 func (c *CircularBuffer) Size() int {
-	if c.nextWriteCursor >= c.nextReadCursor {
-		return c.nextWriteCursor - c.nextReadCursor
-	} else {
-		return c.capacity - c.nextReadCursor + c.nextWriteCursor
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size()
 }
 
 func (c *CircularBuffer) AvailableCapacity() int {
-	return c.Capacity() - c.Size() - 1
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.availableCapacity()
 }
 
 func (c *CircularBuffer) Push(item interface{}) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.IsFull() {
+	if c.isFull() {
 		return false
 	}
 
@@ -66,12 +79,12 @@ func (c *CircularBuffer) PushItems(items []interface{}, indexBegin int, indexEnd
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.IsFull() {
+	if c.isFull() {
 		return 0
 	}
 
 	cptItemsToPush := indexEnd - indexBegin + 1
-	availableCapacity := c.AvailableCapacity()
+	availableCapacity := c.availableCapacity()
 	if availableCapacity < cptItemsToPush {
 		cptItemsToPush = availableCapacity
 	}
@@ -88,11 +101,35 @@ func (c *CircularBuffer) Pop() (interface{}, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.IsEmpty() {
+	if c.isEmpty() {
 		return nil, false
 	}
 
 	idx := c.nextReadCursor
+	item := c.items[idx]
+	c.items[idx] = nil
 	c.nextReadCursor = (c.nextReadCursor + 1) % c.capacity
-	return c.items[idx], true
+	return item, true
+}
+
+// the following methods must be called with c.mu locked
+
+func (c *CircularBuffer) isEmpty() bool {
+	return c.nextReadCursor == c.nextWriteCursor
+}
+
+func (c *CircularBuffer) isFull() bool {
+	return (c.nextWriteCursor+1)%c.capacity == c.nextReadCursor
+}
+
+func (c *CircularBuffer) size() int {
+	if c.nextWriteCursor >= c.nextReadCursor {
+		return c.nextWriteCursor - c.nextReadCursor
+	} else {
+		return c.capacity - c.nextReadCursor + c.nextWriteCursor
+	}
+}
+
+func (c *CircularBuffer) availableCapacity() int {
+	return c.capacity - c.size() - 1
 }
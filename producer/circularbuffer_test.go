@@ -1,23 +1,42 @@
 package ministreamproducer
 
-import "testing"
+import (
+	"errors"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestCircularBuffer(t *testing.T, capacity int) *CircularBuffer {
+	t.Helper()
+	buf, err := BuildCircularBuffer(capacity)
+	if err != nil {
+		t.Fatalf("BuildCircularBuffer(%d) error = %v", capacity, err)
+	}
+	return buf
+}
 
 func TestBuildCircularBuffer(t *testing.T) {
-	buf := BuildCircularBuffer(10)
+	buf := newTestCircularBuffer(t, 10)
 	if buf == nil {
 		t.Fatalf("creation failed")
 	}
+	if _, err := BuildCircularBuffer(1); !errors.Is(err, ErrInvalidCircularBufferCapacity) {
+		t.Errorf("BuildCircularBuffer(1) error = %v, want %v", err, ErrInvalidCircularBufferCapacity)
+	}
 }
 
 func TestCapacity(t *testing.T) {
-	buf := BuildCircularBuffer(10)
+	buf := newTestCircularBuffer(t, 10)
 	if buf.capacity != 10 {
 		t.Fatalf("wrong capacity value")
 	}
 }
 
 func TestPush(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	if !buf.Push(1) {
 		t.Fatalf("push failed 1")
 	}
@@ -30,7 +49,7 @@ func TestPush(t *testing.T) {
 }
 
 func TestPop(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	if _, ok := buf.Pop(); ok {
 		t.Fatalf("must not be able to pop")
 	}
@@ -61,7 +80,7 @@ func TestPop(t *testing.T) {
 }
 
 func TestIsEmpty(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	if !buf.IsEmpty() {
 		t.Fatalf("must be empty")
 	}
@@ -80,7 +99,7 @@ func TestIsEmpty(t *testing.T) {
 }
 
 func TestIsFull(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	if buf.IsFull() {
 		t.Fatalf("must not be full")
 	}
@@ -105,7 +124,7 @@ func TestIsFull(t *testing.T) {
 }
 
 func TestSize(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	if buf.Size() != 0 {
 		t.Fatalf("invalid size value")
 	}
@@ -136,7 +155,7 @@ func TestSize(t *testing.T) {
 }
 
 func TestClear(t *testing.T) {
-	buf := BuildCircularBuffer(3)
+	buf := newTestCircularBuffer(t, 3)
 	buf.Push(1)
 	buf.Push(2)
 	if buf.IsEmpty() {
@@ -155,7 +174,7 @@ func TestFullCapacity(t *testing.T) {
 	capacity := batchSize + 1
 
 	// create a circular buffer
-	buf := BuildCircularBuffer(capacity)
+	buf := newTestCircularBuffer(t, capacity)
 	if buf.Capacity() != capacity {
 		t.Fatalf("invalid capacity value")
 	}
@@ -269,3 +288,174 @@ func TestFullCapacity(t *testing.T) {
 		}
 	}
 }
+
+// checkCircularBuffer compares the buffer with the items it should hold.
+func checkCircularBuffer(t *testing.T, buf *CircularBuffer, expected []interface{}) {
+	t.Helper()
+	if size := buf.Size(); size != len(expected) {
+		t.Fatalf("Size() = %d, want %d", size, len(expected))
+	}
+	if available := buf.AvailableCapacity(); available != buf.Capacity()-len(expected)-1 {
+		t.Fatalf("AvailableCapacity() = %d, want %d", available, buf.Capacity()-len(expected)-1)
+	}
+	if empty := buf.IsEmpty(); empty != (len(expected) == 0) {
+		t.Fatalf("IsEmpty() = %v, want %v", empty, len(expected) == 0)
+	}
+	if full := buf.IsFull(); full != (len(expected) == buf.Capacity()-1) {
+		t.Fatalf("IsFull() = %v, want %v", full, len(expected) == buf.Capacity()-1)
+	}
+}
+
+// FuzzCircularBuffer runs a sequence of operations on the buffer and on a slice and compares them.
+func FuzzCircularBuffer(f *testing.F) {
+	f.Add(uint8(2), []byte{0, 0, 2, 2, 2})
+	f.Add(uint8(5), []byte{0, 0, 0, 0, 0, 2, 0, 2, 2, 3, 0})
+	f.Add(uint8(10), []byte{1, 5, 9, 13, 2, 2, 2, 29, 2, 3, 17, 2})
+	f.Fuzz(func(t *testing.T, capacity uint8, ops []byte) {
+		buf, err := BuildCircularBuffer(int(capacity))
+		if err != nil {
+			if capacity >= 2 {
+				t.Fatalf("BuildCircularBuffer(%d) error = %v", capacity, err)
+			}
+			return
+		}
+
+		var expected []interface{}
+		next := 0
+		for _, op := range ops {
+			switch op % 4 {
+			case 0:
+				ok := buf.Push(next)
+				if ok != (len(expected) < int(capacity)-1) {
+					t.Fatalf("Push() = %v with %d items", ok, len(expected))
+				}
+				if ok {
+					expected = append(expected, next)
+				}
+				next++
+			case 1:
+				items := make([]interface{}, int(op>>2)%8+1)
+				for idx := range items {
+					items[idx] = next + idx
+				}
+				cptPushed := buf.PushItems(items, 0, len(items)-1)
+				want := len(items)
+				if available := int(capacity) - 1 - len(expected); available < want {
+					want = available
+				}
+				if cptPushed != want {
+					t.Fatalf("PushItems() = %d, want %d", cptPushed, want)
+				}
+				expected = append(expected, items[:cptPushed]...)
+				next += len(items)
+			case 2:
+				item, ok := buf.Pop()
+				if ok != (len(expected) > 0) {
+					t.Fatalf("Pop() = %v with %d items", ok, len(expected))
+				}
+				if ok {
+					if item != expected[0] {
+						t.Fatalf("Pop() = %v, want %v", item, expected[0])
+					}
+					expected = expected[1:]
+				}
+			case 3:
+				buf.Clear()
+				expected = nil
+			}
+			checkCircularBuffer(t, buf, expected)
+		}
+	})
+}
+
+type testItem struct {
+	pusher int
+	seq    int
+}
+
+// FuzzCircularBufferConcurrent pushes and pops items from several goroutines with random interleavings,
+// each item must be popped once and the items of a pusher in the order they were pushed.
+func FuzzCircularBufferConcurrent(f *testing.F) {
+	f.Add(uint8(2), uint8(1), uint8(1), int64(1))
+	f.Add(uint8(3), uint8(4), uint8(2), int64(2))
+	f.Add(uint8(16), uint8(2), uint8(4), int64(3))
+	f.Add(uint8(100), uint8(8), uint8(8), int64(4))
+	f.Fuzz(func(t *testing.T, capacity uint8, cptPushers uint8, cptPoppers uint8, seed int64) {
+		const cptItemsPerPusher = 200
+		buf, err := BuildCircularBuffer(int(capacity)%64 + 2)
+		if err != nil {
+			t.Fatalf("BuildCircularBuffer() error = %v", err)
+		}
+		nbPushers := int(cptPushers)%8 + 1
+		nbPoppers := int(cptPoppers)%8 + 1
+		total := int64(nbPushers * cptItemsPerPusher)
+
+		var wg sync.WaitGroup
+		for pusher := 0; pusher < nbPushers; pusher++ {
+			wg.Add(1)
+			go func(pusher int) {
+				defer wg.Done()
+				random := rand.New(rand.NewSource(seed + int64(pusher)))
+				for seq := 0; seq < cptItemsPerPusher; {
+					if random.Intn(2) == 0 {
+						if buf.Push(testItem{pusher, seq}) {
+							seq++
+						}
+					} else {
+						items := make([]interface{}, 0, 4)
+						for i := 0; i < random.Intn(4)+1 && seq+i < cptItemsPerPusher; i++ {
+							items = append(items, testItem{pusher, seq + i})
+						}
+						seq += buf.PushItems(items, 0, len(items)-1)
+					}
+					runtime.Gosched()
+				}
+			}(pusher)
+		}
+
+		var cptPopped atomic.Int64
+		popped := make([][]testItem, nbPoppers)
+		for popper := 0; popper < nbPoppers; popper++ {
+			wg.Add(1)
+			go func(popper int) {
+				defer wg.Done()
+				for cptPopped.Load() < total {
+					if item, ok := buf.Pop(); ok {
+						popped[popper] = append(popped[popper], item.(testItem))
+						cptPopped.Add(1)
+					}
+					// the state is read while the other goroutines change it
+					if size := buf.Size(); size < 0 || size > buf.Capacity()-1 {
+						t.Errorf("Size() = %d, want between 0 and %d", size, buf.Capacity()-1)
+					}
+					_ = buf.IsEmpty()
+					_ = buf.IsFull()
+					_ = buf.AvailableCapacity()
+					runtime.Gosched()
+				}
+			}(popper)
+		}
+		wg.Wait()
+
+		seen := make(map[testItem]bool)
+		for _, items := range popped {
+			lastSeq := make(map[int]int)
+			for _, item := range items {
+				if seen[item] {
+					t.Fatalf("item %v popped twice", item)
+				}
+				seen[item] = true
+				if last, ok := lastSeq[item.pusher]; ok && item.seq <= last {
+					t.Fatalf("item %v popped after item %d of the same pusher", item, last)
+				}
+				lastSeq[item.pusher] = item.seq
+			}
+		}
+		if int64(len(seen)) != total {
+			t.Fatalf("popped %d items, want %d", len(seen), total)
+		}
+		if !buf.IsEmpty() {
+			t.Fatalf("IsEmpty() = false, want true")
+		}
+	})
+}
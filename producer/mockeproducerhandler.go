@@ -19,6 +19,7 @@ type MockProducerEventHandler struct {
 	cptRecordsEnqueued                   int64
 	lastStartSendHttpRequest             time.Time
 	lastHttpRequestDuration              time.Duration
+	ctx                                  context.Context
 	backPressure                         *ExpBackoff
 	numberOfSuccessiveBufferingErrors    int
 	maxNumberOfSuccessiveBufferingErrors int
@@ -126,7 +127,7 @@ func (h *MockProducerEventHandler) OnRecordsEnqueued(cptRecords int, index int,
 	}
 
 	// wait a little before trying again later
-	h.backPressure.Wait()
+	_ = h.backPressure.Wait(h.ctx)
 	return nil // try again to push records into the buffer
 }
 
@@ -151,7 +152,8 @@ func NewMockProducerEventHandler(ctx context.Context, cptRecordsToSend int64, se
 		maxNumberOfSuccessiveBufferingErrors: 1000,
 		firstBufferingErrorDate:              time.Time{},
 		maxBufferingErrorDuration:            time.Duration(60) * time.Second * 5, // 5 minutes
-		backPressure:                         NewExpBackoff(ctx.Done(), time.Duration(10)*time.Millisecond, time.Duration(1)*time.Second),
+		ctx:                                  ctx,
+		backPressure:                         NewExponentialBackoff(time.Duration(10)*time.Millisecond, time.Duration(1)*time.Second),
 		Logger:                               nil,
 		producer:                             nil,
 		cptRecordsToSend:                     cptRecordsToSend,
@@ -0,0 +1,76 @@
+package ministreamproducer
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nbigot/ministream-client-go/client/types"
+)
+
+// MockRetryProducerEventHandler retries until the records are enqueued, it gives up once the producer is closed.
+// It records the states of the producer and counts the batches which have not been sent.
+type MockRetryProducerEventHandler struct {
+	// implements interface ProducerEventHandler
+	Running   chan struct{} // closed once the producer runs
+	producer  *StreamProducer
+	states    []types.ProducerState
+	cptFailed atomic.Int64
+	once      sync.Once
+	mu        sync.Mutex
+}
+
+func (h *MockRetryProducerEventHandler) Init(producer *StreamProducer) {
+	h.producer = producer
+}
+
+func (h *MockRetryProducerEventHandler) OnSendError() {}
+
+func (h *MockRetryProducerEventHandler) OnPreBatchSent(batchId int, batchSize int) {}
+
+func (h *MockRetryProducerEventHandler) OnPostBatchSent(batchId int, batchSize int) {
+	if batchSize == 0 {
+		// failed or duplicated batch
+		h.cptFailed.Add(1)
+	}
+}
+
+func (h *MockRetryProducerEventHandler) OnStateChanged(state types.ProducerState) {
+	h.mu.Lock()
+	h.states = append(h.states, state)
+	h.mu.Unlock()
+	if state == types.ProducerStateRunning {
+		h.once.Do(func() { close(h.Running) })
+	}
+}
+
+func (h *MockRetryProducerEventHandler) OnRecordsEnqueued(cptRecords int, index int, total int) error {
+	if cptRecords == 0 {
+		if h.producer.GetState() == types.ProducerStateClosed {
+			return errors.New("producer is closed")
+		}
+		// the queue is full, let the producer send the records
+		runtime.Gosched()
+	}
+	return nil
+}
+
+func (h *MockRetryProducerEventHandler) OnRecordEnqueueTimeout(records []interface{}, cptRecordsEnqueued int, cptRecordsNotEnqueued int) {
+}
+
+// GetStates returns the states of the producer in the order of the changes.
+func (h *MockRetryProducerEventHandler) GetStates() []types.ProducerState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]types.ProducerState{}, h.states...)
+}
+
+// CountFailedBatches returns the number of batches which have not been sent (failed or duplicated).
+func (h *MockRetryProducerEventHandler) CountFailedBatches() int64 {
+	return h.cptFailed.Load()
+}
+
+func NewMockRetryProducerEventHandler() *MockRetryProducerEventHandler {
+	return &MockRetryProducerEventHandler{Running: make(chan struct{})}
+}
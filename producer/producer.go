@@ -17,16 +17,20 @@ type StreamProducer struct {
 	RecordsQueue          *CircularBuffer
 	WaitForBackPressure   bool
 	BackPressure          *backoff.ExpBackoff
-	State                 types.ProducerState
+	AdaptiveLimiter       *backoff.AdaptiveLimiter // optional (nil by default), slows down before the quota of the server is exhausted
+	RateLimiter           *backoff.RateLimiter     // optional, caps the rate of the requests and records sent
+	State                 types.ProducerState      // read it with GetState once the producer runs
 	EvHandler             ProducerEventHandler
 	StreamUUID            uuid.UUID
-	Batch                 *BatchRecords
+	Batch                 *BatchRecords   // set it before Run, afterwards it is only used by the Run goroutine
+	Validator             RecordValidator // optional, records are checked before being enqueued
 	ShutdownTimeout       time.Duration
 	chEvOnStateChanged    chan types.ProducerState
 	chEvOnRecordsEnqueued chan struct{}
 	Logger                *log.Logger
 	LogLevel              int
 	mu                    sync.Mutex
+	stateMu               sync.RWMutex // guards State, p.mu is held by EnqueueRecords while reading it
 }
 
 type SimpleRecord struct {
@@ -58,17 +62,31 @@ func (p *StreamProducer) EnqueueRecords(records []interface{}) (int, error) {
 		return 0, &ProducerInvalidStateError{Message: "can't enqueue records when state is not running/pause", State: currentState}
 	}
 
+	if err := validateRecords(p.Validator, records); err != nil {
+		// reject all the records, none of them is enqueued
+		return 0, err
+	}
+
 	total := len(records)
 	indexBegin := 0
 	indexEnd := total - 1
 
 	p.Log(INFO, "EnqueueRecords: start\n")
 	for indexBegin <= indexEnd {
-		cptItemsPushed := p.RecordsQueue.PushItems(records, indexBegin, indexEnd)
+		cptItemsPushed, err := p.pushRecords(records, indexBegin, indexEnd)
+		if err != nil {
+			// the producer is closing, the remaining records are not enqueued
+			return indexBegin, err
+		}
 		p.Log(DEBUG, "EnqueueRecords: cptItemsPushed=%d\n", cptItemsPushed)
 		if cptItemsPushed > 0 {
 			indexBegin += cptItemsPushed
-			p.chEvOnRecordsEnqueued <- struct{}{}
+			// don't block while holding p.mu: the notification is only dropped when another one is pending,
+			// the run loop has not read the queue yet and it sends batches until the queue is empty
+			select {
+			case p.chEvOnRecordsEnqueued <- struct{}{}:
+			default:
+			}
 		}
 
 		// note: OnRecordEnqueue is responsible for wait/sleep for error retry
@@ -82,6 +100,59 @@ func (p *StreamProducer) EnqueueRecords(records []interface{}) (int, error) {
 	return total, nil
 }
 
+func (p *StreamProducer) ValidateRecords(records []interface{}) error {
+	// the validator may be changed concurrently by SetRecordValidator
+	p.mu.Lock()
+	validator := p.Validator
+	p.mu.Unlock()
+
+	return validateRecords(validator, records)
+}
+
+// pushRecords pushes the records into the queue unless the producer is closing,
+// the Run loop changes the state without p.mu so the state is checked again while pushing.
+func (p *StreamProducer) pushRecords(records []interface{}, indexBegin int, indexEnd int) (int, error) {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+
+	if p.State != types.ProducerStateRunning && p.State != types.ProducerStatePause {
+		return 0, &ProducerInvalidStateError{Message: "can't enqueue records when state is not running/pause", State: p.State}
+	}
+	return p.RecordsQueue.PushItems(records, indexBegin, indexEnd), nil
+}
+
+func validateRecords(validator RecordValidator, records []interface{}) error {
+	if validator == nil {
+		return nil
+	}
+
+	for idx, record := range records {
+		if validationErrors := validator.Validate(record); len(validationErrors) > 0 {
+			return &ProducerValidationError{RecordIndex: idx, ValidationErrors: validationErrors}
+		}
+	}
+
+	return nil
+}
+
+// SetBackoffStrategy changes how the delays grow while the server pushes back (e.g. with jitter).
+func (p *StreamProducer) SetBackoffStrategy(strategy backoff.Strategy) {
+	p.BackPressure.SetStrategy(strategy)
+	p.BackPressure.Reset()
+}
+
+// SetRateLimiter caps the rate of the requests and records sent by the producer (nil to disable).
+func (p *StreamProducer) SetRateLimiter(l *backoff.RateLimiter) {
+	p.RateLimiter = l
+}
+
+func (p *StreamProducer) SetRecordValidator(v RecordValidator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Validator = v
+}
+
 func (p *StreamProducer) Run(ctx context.Context) error {
 	if state := p.GetState(); state != types.ProducerStateInitialized {
 		return &ProducerInvalidStateError{
@@ -89,77 +160,126 @@ func (p *StreamProducer) Run(ctx context.Context) error {
 		}
 	}
 
-	chEvBackpressureTimeout := make(chan bool, 1)
+	// the back pressure timer is armed while the server pushes back (nil channel otherwise)
+	var chEvBackpressureTimeout <-chan time.Time
+	defer p.BackPressure.Stop()
 	chEvCheckForRecordsToSend := make(chan struct{}, 1)
+	// the check is dropped when another one is pending, the pending check sends batches until the queue is empty
+	checkForRecordsToSend := func() {
+		select {
+		case chEvCheckForRecordsToSend <- struct{}{}:
+		default:
+		}
+	}
 
-	// create context for closing
-	ctxClosing, ctxCancelClosingFunc := context.WithCancel(ctx)
+	if handler, ok := p.EvHandler.(ProducerCircuitBreakerHandler); ok {
+		if client, ok := p.Client.(types.ICircuitBreakerClient); ok {
+			defer client.SubscribeCircuitBreaker(handler.OnCircuitBreakerStateChanged)()
+		}
+	}
+
+	// create context for closing, it is canceled once the remaining records are sent or after the shutdown timeout
+	// (it does not derive from ctx: the records can still be sent while closing)
+	ctxClosing, ctxCancelClosingFunc := context.WithCancel(context.Background())
 	defer ctxCancelClosingFunc()
+	// the cancellation of ctx starts the closing once (nil channel afterwards)
+	chEvCanceled := ctx.Done()
+	// the end of the closing finalizes the producer once (nil channel afterwards)
+	chEvClosingDone := ctxClosing.Done()
+
+	// onStateChanged applies the new state to the loop, it returns true once the producer is closed
+	onStateChanged := func(newState types.ProducerState) bool {
+		switch newState {
+		case types.ProducerStateRunning:
+			// reset back pressure (also needed when resume pause)
+			p.WaitForBackPressure = false
+			p.BackPressure.Reset()
+			// the records enqueued while paused have been notified but not sent
+			checkForRecordsToSend()
+		case types.ProducerStateClosing:
+			if ctxClosing.Err() != nil {
+				// the producer is being finalized
+				return false
+			}
+			if p.RecordsQueue.IsEmpty() && p.Batch.IsEmpty() {
+				// no records left to be sent,
+				// close the producer immediately
+				ctxCancelClosingFunc()
+			} else {
+				// some records are still in the queue give them a chance to be sent
+				time.AfterFunc(p.ShutdownTimeout, func() {
+					// the deadline has been exceeded
+					ctxCancelClosingFunc()
+				})
+			}
+		case types.ProducerStateClosed:
+			// producer is closed, exit the loop
+			return true
+		}
+		return false
+	}
 
-	go p.SetState(types.ProducerStateRunning)
+	// the transitions of the loop are applied in order by the loop itself,
+	// the transitions requested with SetState are received from chEvOnStateChanged
+	p.setState(types.ProducerStateRunning)
+	onStateChanged(types.ProducerStateRunning)
 
 	for {
 		select {
-		case <-ctx.Done():
-			p.SetState(types.ProducerStateClosing)
-		case <-ctxClosing.Done():
+		case <-chEvCanceled:
+			chEvCanceled = nil
+			p.setState(types.ProducerStateClosing)
+			onStateChanged(types.ProducerStateClosing)
+		case <-chEvClosingDone:
+			chEvClosingDone = nil
+			// the loop stops using the batch and the queue from now on
 			p.FinalizeClosingState()
+			if p.GetState() == types.ProducerStateClosed {
+				return nil
+			}
 		case <-p.chEvOnRecordsEnqueued:
 			// record(s) is/are ready to be send
-			go func() { chEvCheckForRecordsToSend <- struct{}{} }()
+			checkForRecordsToSend()
 		case <-chEvBackpressureTimeout:
-			go func() { chEvCheckForRecordsToSend <- struct{}{} }()
+			chEvBackpressureTimeout = nil
+			checkForRecordsToSend()
 		case <-chEvCheckForRecordsToSend:
 			// security: check if the producer is still running nor closing
 			if p.GetState() != types.ProducerStateRunning && p.GetState() != types.ProducerStateClosing {
 				continue
 			}
+			if ctxClosing.Err() != nil {
+				// the producer is being finalized
+				continue
+			}
 
 			p.FillRecordsBufferFromQueue()
-			err := p.SendBatchRecords(ctx)
+			// the filling stops when the batch is full or when the queue is empty
+			mayRemainRecords := p.Batch.IsFull()
+			err := p.SendBatchRecords(ctxClosing)
 			if p.WaitForBackPressure {
-				p.BackPressure.WaitAndNotify(chEvBackpressureTimeout)
+				chEvBackpressureTimeout = p.BackPressure.Start()
 			} else if err != nil {
 				// error occurred while sending records
 				// try to send the records again
-				go func() { chEvCheckForRecordsToSend <- struct{}{} }()
+				checkForRecordsToSend()
+			} else if mayRemainRecords {
+				// the queue may hold more records than a batch, send the next batch
+				checkForRecordsToSend()
+			} else if p.GetState() == types.ProducerStateClosing && p.Batch.IsEmpty() {
+				// the remaining records are sent, no need to wait for the shutdown timeout
+				ctxCancelClosingFunc()
 			}
 		case newState := <-p.chEvOnStateChanged:
-			switch newState {
-			case types.ProducerStateRunning:
-				{
-					// reset back pressure (also needed when resume pause)
-					p.WaitForBackPressure = false
-					p.BackPressure.Reset()
-				}
-			case types.ProducerStatePause:
-				{
-					continue
-				}
-			case types.ProducerStateClosing:
-				{
-					if p.RecordsQueue.IsEmpty() && p.Batch.IsEmpty() {
-						// no records left to be sent,
-						// close the producer immediately
-						ctxCancelClosingFunc()
-					} else {
-						// some records are still in the queue give them a chance to be sent
-						time.AfterFunc(p.ShutdownTimeout, func() {
-							// the deadline has been exceeded
-							ctxCancelClosingFunc()
-						})
-					}
-				}
-			case types.ProducerStateClosed:
-				{
-					// producer is closed, exit the loop
-					return nil
-				}
+			if onStateChanged(newState) {
+				return nil
 			}
 		}
 	}
 }
 
+// FinalizeClosingState drops the records which have not been sent and closes the producer,
+// it is called by the Run loop once the closing is over.
 func (p *StreamProducer) FinalizeClosingState() {
 	if p.GetState() != types.ProducerStateClosing {
 		p.Log(INFO, "FinalizeClosingState: ignore: state is not ProducerStateClosing\n")
@@ -179,7 +299,7 @@ func (p *StreamProducer) FinalizeClosingState() {
 	p.Batch.Clear()
 
 	p.Client.Disconnect()
-	p.SetState(types.ProducerStateClosed)
+	p.setState(types.ProducerStateClosed)
 }
 
 func (p *StreamProducer) FillRecordsBufferFromQueue() {
@@ -191,10 +311,14 @@ func (p *StreamProducer) FillRecordsBufferFromQueue() {
 
 	// trick: records buffer might already be pre-filled,
 	// therefore it must be preserved and may be filled with new records
-	for record, hasNext := p.RecordsQueue.Pop(); hasNext; record, hasNext = p.RecordsQueue.Pop() {
-		p.Batch.Append(record)
-		if p.Batch.IsFull() {
-			// stop filling the buffer if it reaches the maximum allowed capacity
+	// stop filling the buffer if it reaches the maximum allowed capacity
+	for !p.Batch.IsFull() {
+		record, hasNext := p.RecordsQueue.Pop()
+		if !hasNext {
+			break
+		}
+		if err := p.Batch.Append(record); err != nil {
+			p.Log(ERROR, "FillRecordsBufferFromQueue: %s\n", err.Error())
 			break
 		}
 	}
@@ -210,15 +334,24 @@ func (p *StreamProducer) SendBatchRecords(ctx context.Context) error {
 	batchId := p.Batch.GetId()
 	p.EvHandler.OnPreBatchSent(batchId, cptRecords)
 
+	if err := p.waitLimiters(ctx, cptRecords); err != nil {
+		// the batch is kept, it is sent again later
+		p.EvHandler.OnPostBatchSent(batchId, 0)
+		return err
+	}
+
 	// send all the records in the buffer to the server
 	response, httpResponse, apiError := p.Client.PutRecords(ctx, p.StreamUUID, p.Batch.GetId(), p.Batch.GetRecords())
+	if p.AdaptiveLimiter != nil {
+		p.AdaptiveLimiter.Update(httpResponse)
+	}
 	if response != nil {
 		p.Log(DEBUG, "SendBatchRecords response: %v\n", response)
 	}
 	if apiError != nil {
 		switch apiError.Code {
-		case types.ErrorHTTPTimeout:
-			// error is due to timeout on client side
+		case types.ErrorHTTPTimeout, types.ErrorContextDeadlineExceeded:
+			// error is due to timeout on client side (the timeout of the http client is reported as a deadline exceeded)
 			// at this point the batch may have been sent to the server and the server may be still processing it
 			// we can't be sure if the processing was/will be successful or not
 			// we must retry the batch without changing the batch id, to avoid duplicates (server handles deduplication)
@@ -233,19 +366,24 @@ func (p *StreamProducer) SendBatchRecords(ctx context.Context) error {
 			p.BackPressure.Reset()
 			p.EvHandler.OnPostBatchSent(batchId, 0)
 			return nil // pretend it's a success
+		case types.ErrorJWTInvalidOrExpired:
+			// the token has expired, authenticate again then send the batch again (same batch id)
+			p.WaitForBackPressure = false
+			if authError := p.Client.Authenticate(ctx); authError != nil {
+				p.Log(ERROR, "SendBatchRecords: can't authenticate: %s\n", authError.Error())
+				p.WaitForBackPressure = true
+			}
 		case types.ErrorTooManyRequests:
 			// error is due to rate limiting on server side (retry later)
 			p.WaitForBackPressure = true
-			var duration uint64 = 1 // default duration (1 second)
+			duration := time.Second // default duration
 			if httpResponse != nil {
-				// try to get a rate limit from the http response
-				rateLimit := backoff.RateLimitFromHttpResponse(httpResponse)
-				if rateLimit.RetryAfter > 0 || httpResponse.StatusCode == 429 {
-					// error is due to rate limiting (retry later)
-					duration = rateLimit.RetryAfter
+				// try to get a rate limit from the http response (Retry-After in seconds or http date)
+				if rateLimit := backoff.RateLimitFromHttpResponse(httpResponse); rateLimit.RetryAfterDuration > 0 {
+					duration = rateLimit.RetryAfterDuration
 				}
 			}
-			p.BackPressure.SetDuration(time.Duration(duration) * time.Second)
+			p.BackPressure.SetDuration(duration)
 		default:
 			p.WaitForBackPressure = true
 		}
@@ -263,16 +401,43 @@ func (p *StreamProducer) SendBatchRecords(ctx context.Context) error {
 	return nil
 }
 
+// waitLimiters blocks until the limiters allow to send cptRecords records.
+func (p *StreamProducer) waitLimiters(ctx context.Context, cptRecords int) error {
+	if p.AdaptiveLimiter != nil {
+		if err := p.AdaptiveLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if p.RateLimiter != nil {
+		if err := p.RateLimiter.WaitRequest(ctx); err != nil {
+			return err
+		}
+		return p.RateLimiter.WaitRecords(ctx, cptRecords)
+	}
+	return nil
+}
+
+// SetState changes the state of the producer and notifies the Run loop (e.g. to pause, resume or close the producer).
 func (p *StreamProducer) SetState(state types.ProducerState) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	p.setState(state)
+	p.chEvOnStateChanged <- state
+}
+
+// setState changes the state without notifying the Run loop, the loop calls it for its own transitions.
+// It doesn't wait for p.mu: an enqueuer holding it may wait for the loop to make room in the queue.
+func (p *StreamProducer) setState(state types.ProducerState) {
+	p.stateMu.Lock()
 	p.State = state
+	p.stateMu.Unlock()
 	p.EvHandler.OnStateChanged(state)
-	p.chEvOnStateChanged <- state
 }
 
 func (p *StreamProducer) GetState() types.ProducerState {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
 	return p.State
 }
 
@@ -284,11 +449,13 @@ func (p *StreamProducer) Log(level int, format string, v ...interface{}) {
 }
 
 func NewStreamProducer(ctx context.Context, logger *log.Logger, logLevel int, client types.IProducerClient, streamUUID uuid.UUID, h ProducerEventHandler) *StreamProducer {
+	// the capacity is valid, it can't fail
+	recordsQueue, _ := BuildCircularBuffer(types.DefaultRecordsQueueLen + 1)
 	p := StreamProducer{
 		Client:                client,
-		RecordsQueue:          BuildCircularBuffer(types.DefaultRecordsQueueLen + 1),
+		RecordsQueue:          recordsQueue,
 		WaitForBackPressure:   false,
-		BackPressure:          backoff.NewExpBackoff(ctx.Done(), time.Duration(200)*time.Millisecond, time.Duration(10000)*time.Millisecond),
+		BackPressure:          backoff.NewExponentialBackoff(time.Duration(200)*time.Millisecond, time.Duration(10000)*time.Millisecond),
 		State:                 types.ProducerStateInitialized,
 		EvHandler:             h,
 		StreamUUID:            streamUUID,
@@ -2,7 +2,12 @@ package ministreamproducer
 
 import (
 	"context"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nbigot/ministream-client-go/client/types"
@@ -51,3 +56,355 @@ func TestNewStreamProducer(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamProducerConcurrentUse(t *testing.T) {
+	const cptEnqueuers = 8
+	const cptRecordsPerEnqueuer = 5000
+	tests := []struct {
+		name             string
+		cancelWhileUsed  bool
+		expectAllRecords bool
+	}{
+		{"cancel after enqueuing", false, true},
+		{"cancel while enqueuing", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := NewMockProducerClient()
+			handler := NewMockRetryProducerEventHandler()
+			producer := NewStreamProducer(ctx, nil, 0, client, uuid.New(), handler)
+			producer.ShutdownTimeout = 10 * time.Second
+			handler.Init(producer)
+
+			chRun := make(chan error, 1)
+			go func() { chRun <- producer.Run(ctx) }()
+			<-handler.Running
+
+			var wgEnqueuers sync.WaitGroup
+			for enqueuer := 0; enqueuer < cptEnqueuers; enqueuer++ {
+				wgEnqueuers.Add(1)
+				go func(enqueuer int) {
+					defer wgEnqueuers.Done()
+					for seq := 0; seq < cptRecordsPerEnqueuer; seq += 100 {
+						records := make([]interface{}, 100)
+						for idx := range records {
+							records[idx] = enqueuer*cptRecordsPerEnqueuer + seq + idx
+						}
+						if _, err := producer.EnqueueRecords(records); err != nil {
+							// the producer is closing
+							return
+						}
+					}
+				}(enqueuer)
+			}
+			// the state and the queue are read while the producer changes them
+			chStopReading := make(chan struct{})
+			chReaderDone := make(chan struct{})
+			go func() {
+				defer close(chReaderDone)
+				for {
+					select {
+					case <-chStopReading:
+						return
+					default:
+						_ = producer.GetState()
+						_ = producer.RecordsQueue.Size()
+						_ = producer.RecordsQueue.IsFull()
+						runtime.Gosched()
+					}
+				}
+			}()
+
+			if tt.cancelWhileUsed {
+				cancel()
+			} else {
+				// the producer closes once the queue is sent
+				wgEnqueuers.Wait()
+				cancel()
+			}
+			select {
+			case err := <-chRun:
+				if err != nil {
+					t.Fatalf("Run() = %v, want %v", err, nil)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("Run() did not return")
+			}
+			close(chStopReading)
+			<-chReaderDone
+			wgEnqueuers.Wait()
+
+			if state := producer.GetState(); state != types.ProducerStateClosed {
+				t.Errorf("GetState() = %v, want %v", state, types.ProducerStateClosed)
+			}
+			seen := make(map[int]bool)
+			lastRecords := make(map[int]int)
+			for _, record := range client.Records {
+				n := record.(int)
+				if seen[n] {
+					t.Fatalf("record %d sent twice", n)
+				}
+				seen[n] = true
+				enqueuer := n / cptRecordsPerEnqueuer
+				if last, ok := lastRecords[enqueuer]; ok && n <= last {
+					t.Fatalf("record %d sent after record %d of the same enqueuer", n, last)
+				}
+				lastRecords[enqueuer] = n
+			}
+			if tt.expectAllRecords && len(seen) != cptEnqueuers*cptRecordsPerEnqueuer {
+				t.Errorf("sent %d records, want %d", len(seen), cptEnqueuers*cptRecordsPerEnqueuer)
+			}
+		})
+	}
+}
+
+// contextProducerClient fails the calls made with a canceled context, like the http client does.
+type contextProducerClient struct {
+	MockProducerClient
+	mu sync.Mutex
+}
+
+func (c *contextProducerClient) PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*types.PutRecordsResponse, *http.Response, *types.APIError) {
+	if ctx.Err() != nil {
+		return nil, nil, &types.APIError{Message: ctx.Err().Error()}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.MockProducerClient.PutRecords(ctx, streamUUID, batchId, records)
+}
+
+func (c *contextProducerClient) countRecords() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Records)
+}
+
+func TestStreamProducerSendsRemainingRecords(t *testing.T) {
+	const cptRecords = 350
+	tests := []struct {
+		name            string
+		cancelAfterSent bool
+	}{
+		// the records of one enqueue which don't fit in a batch are sent without waiting for another enqueue
+		{name: "running", cancelAfterSent: true},
+		// the records enqueued before the cancellation are sent while closing (with a context which is not canceled),
+		// then the producer is closed without waiting for the shutdown timeout
+		{name: "closing", cancelAfterSent: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := &contextProducerClient{}
+			handler := NewMockRetryProducerEventHandler()
+			producer := NewStreamProducer(ctx, nil, 0, client, uuid.New(), handler)
+			producer.Batch = NewBatchRecords(100)
+			producer.ShutdownTimeout = 10 * time.Second
+			handler.Init(producer)
+
+			startTime := time.Now()
+			chRun := make(chan error, 1)
+			go func() { chRun <- producer.Run(ctx) }()
+			<-handler.Running
+
+			records := make([]interface{}, cptRecords)
+			for idx := range records {
+				records[idx] = idx
+			}
+			if _, err := producer.EnqueueRecords(records); err != nil {
+				t.Fatalf("EnqueueRecords() error = %v", err)
+			}
+			if tt.cancelAfterSent {
+				deadline := time.Now().Add(5 * time.Second)
+				for client.countRecords() < cptRecords && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if cpt := client.countRecords(); cpt != cptRecords {
+					t.Errorf("sent %d records while running, want %d", cpt, cptRecords)
+				}
+			}
+			cancel()
+
+			select {
+			case err := <-chRun:
+				if err != nil {
+					t.Fatalf("Run() = %v, want %v", err, nil)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("Run() did not return")
+			}
+			if elapsed := time.Since(startTime); elapsed >= producer.ShutdownTimeout {
+				t.Errorf("Run() returned after %v, want before the shutdown timeout", elapsed)
+			}
+			if cpt := client.countRecords(); cpt != cptRecords {
+				t.Errorf("sent %d records, want %d", cpt, cptRecords)
+			}
+		})
+	}
+}
+
+// failingProducerClient fails the first PutRecords call with an error, it records the batch ids sent.
+type failingProducerClient struct {
+	MockProducerClient
+	err             *types.APIError
+	batchIds        []int
+	cptAuthenticate int
+}
+
+func (c *failingProducerClient) Authenticate(ctx context.Context) *types.APIError {
+	c.cptAuthenticate++
+	return nil
+}
+
+func (c *failingProducerClient) PutRecords(ctx context.Context, streamUUID uuid.UUID, batchId int, records []interface{}) (*types.PutRecordsResponse, *http.Response, *types.APIError) {
+	c.batchIds = append(c.batchIds, batchId)
+	if err := c.err; err != nil {
+		c.err = nil
+		return nil, nil, err
+	}
+	return c.MockProducerClient.PutRecords(ctx, streamUUID, batchId, records)
+}
+
+func TestSendBatchRecordsRetries(t *testing.T) {
+	tests := []struct {
+		name                 string
+		code                 int
+		expectedBackPressure bool
+		expectedAuthenticate int
+	}{
+		// the token has expired: authenticate again, then send the batch again right away
+		{name: "token expired", code: types.ErrorJWTInvalidOrExpired, expectedAuthenticate: 1},
+		// the server may have saved the batch: send it again right away with the same batch id (deduplicated by the server)
+		{name: "http timeout", code: types.ErrorHTTPTimeout},
+		{name: "client timeout", code: types.ErrorContextDeadlineExceeded},
+		{name: "stream error", code: types.ErrorCantGetMessagesFromStream, expectedBackPressure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := &failingProducerClient{err: &types.APIError{Code: tt.code, Message: "send failed"}}
+			producer := NewStreamProducer(ctx, nil, 0, client, uuid.New(), NewMockRetryProducerEventHandler())
+			producer.Batch = NewBatchRecords(10)
+			_ = producer.Batch.Append(1)
+
+			if err := producer.SendBatchRecords(ctx); err == nil {
+				t.Fatalf("SendBatchRecords() error = nil, want an error")
+			}
+			if producer.WaitForBackPressure != tt.expectedBackPressure {
+				t.Errorf("WaitForBackPressure = %v, want %v", producer.WaitForBackPressure, tt.expectedBackPressure)
+			}
+			if client.cptAuthenticate != tt.expectedAuthenticate {
+				t.Errorf("Authenticate calls = %d, want %d", client.cptAuthenticate, tt.expectedAuthenticate)
+			}
+
+			// the batch is kept and sent again with the same id
+			if err := producer.SendBatchRecords(ctx); err != nil {
+				t.Fatalf("SendBatchRecords() error = %v, want %v", err, nil)
+			}
+			if len(client.batchIds) != 2 || client.batchIds[0] != client.batchIds[1] {
+				t.Errorf("batch ids = %v, want the same id twice", client.batchIds)
+			}
+			if len(client.Records) != 1 {
+				t.Errorf("len(client.Records) = %v, want %v", len(client.Records), 1)
+			}
+		})
+	}
+}
+
+func TestStreamProducerSendsRecordsEnqueuedWhilePaused(t *testing.T) {
+	const cptEnqueues = 50
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &contextProducerClient{}
+	handler := NewMockRetryProducerEventHandler()
+	producer := NewStreamProducer(ctx, nil, 0, client, uuid.New(), handler)
+	handler.Init(producer)
+
+	chRun := make(chan error, 1)
+	go func() { chRun <- producer.Run(ctx) }()
+	<-handler.Running
+
+	// the notifications of the enqueues are read by the loop (or dropped while one is pending), none is sent while paused
+	producer.SetState(types.ProducerStatePause)
+	for idx := 0; idx < cptEnqueues; idx++ {
+		if _, err := producer.EnqueueRecord(idx); err != nil {
+			t.Fatalf("EnqueueRecord() error = %v", err)
+		}
+	}
+	// let the loop read the notifications while paused
+	time.Sleep(50 * time.Millisecond)
+	producer.SetState(types.ProducerStateRunning)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.countRecords() < cptEnqueues && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if cpt := client.countRecords(); cpt != cptEnqueues {
+		t.Errorf("sent %d records after resuming, want %d", cpt, cptEnqueues)
+	}
+	cancel()
+	if err := <-chRun; err != nil {
+		t.Fatalf("Run() = %v, want %v", err, nil)
+	}
+}
+
+func TestStreamProducerStateTransitions(t *testing.T) {
+	tests := []struct {
+		name            string
+		cptEnqueues     int
+		cancelBeforeRun bool
+	}{
+		{name: "canceled while running", cptEnqueues: 1000},
+		{name: "canceled before running", cancelBeforeRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cptGoroutines := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := &contextProducerClient{}
+			handler := NewMockRetryProducerEventHandler()
+			producer := NewStreamProducer(ctx, nil, 0, client, uuid.New(), handler)
+			handler.Init(producer)
+
+			if tt.cancelBeforeRun {
+				cancel()
+			}
+			chRun := make(chan error, 1)
+			go func() { chRun <- producer.Run(ctx) }()
+			<-handler.Running
+			for idx := 0; idx < tt.cptEnqueues; idx++ {
+				if _, err := producer.EnqueueRecord(idx); err != nil {
+					t.Fatalf("EnqueueRecord() error = %v", err)
+				}
+			}
+			cancel()
+			select {
+			case err := <-chRun:
+				if err != nil {
+					t.Fatalf("Run() = %v, want %v", err, nil)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Run() has not returned")
+			}
+
+			// the transitions of the loop are made in order by the loop
+			states := handler.GetStates()
+			expected := []types.ProducerState{types.ProducerStateRunning, types.ProducerStateClosing, types.ProducerStateClosed}
+			if !reflect.DeepEqual(states, expected) {
+				t.Errorf("states = %v, want %v", states, expected)
+			}
+
+			// no goroutine of the producer is left once Run has returned
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > cptGoroutines && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if cpt := runtime.NumGoroutine(); cpt > cptGoroutines {
+				t.Errorf("goroutines = %d once stopped, want at most %d", cpt, cptGoroutines)
+			}
+		})
+	}
+}
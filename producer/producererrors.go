@@ -1,12 +1,19 @@
 package ministreamproducer
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/nbigot/ministream-client-go/client/types"
 )
 
+var (
+	ErrBatchRecordsFull              = errors.New("BatchRecords is full, can't append any more records")
+	ErrInvalidCircularBufferCapacity = errors.New("capacity must be > 1")
+)
+
 type ProducerInvalidStateError struct {
 	State   types.ProducerState
 	Message string
@@ -30,3 +37,16 @@ func (err *ProducerBufferingError) Error() string {
 		err.NumberOfSuccessiveBufferingErrors, err.BufferingErrorDuration,
 	)
 }
+
+type ProducerValidationError struct {
+	RecordIndex      int
+	ValidationErrors []*types.ValidationError
+}
+
+func (err *ProducerValidationError) Error() string {
+	fields := make([]string, len(err.ValidationErrors))
+	for i, e := range err.ValidationErrors {
+		fields[i] = fmt.Sprintf("%s (%s)", e.FailedField, e.Tag)
+	}
+	return fmt.Sprintf("record %d is invalid: %s", err.RecordIndex, strings.Join(fields, ", "))
+}
@@ -13,3 +13,10 @@ type ProducerEventHandler interface {
 	OnRecordsEnqueued(cptRecords int, index int, total int) error
 	OnRecordEnqueueTimeout(records []interface{}, cptRecordsEnqueued int, cptRecordsNotEnqueued int)
 }
+
+// ProducerCircuitBreakerHandler is an optional interface of the handlers,
+// OnCircuitBreakerStateChanged is called when the circuit breaker of the client changes its state
+// (by the goroutine making the call, see types.ICircuitBreakerClient).
+type ProducerCircuitBreakerHandler interface {
+	OnCircuitBreakerStateChanged(change types.CircuitBreakerStateChange)
+}
@@ -0,0 +1,235 @@
+package ministreamproducer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nbigot/ministream-client-go/client/types"
+)
+
+// RecordValidator checks a record before it is enqueued into the producer.
+// It returns the list of failing fields, or nil if the record is valid.
+type RecordValidator interface {
+	Validate(record interface{}) []*types.ValidationError
+}
+
+// RecordValidatorFunc adapts an ordinary function into a RecordValidator.
+type RecordValidatorFunc func(record interface{}) []*types.ValidationError
+
+func (f RecordValidatorFunc) Validate(record interface{}) []*types.ValidationError {
+	return f(record)
+}
+
+// StructTagValidator validates struct records using their `validate` tags
+// (same syntax as the server side, only a subset of the rules is supported):
+//
+//	required, len=N, min=N, max=N, gt=N, gte=N, lt=N, lte=N, oneof=a b c
+//
+// Numbers are compared by value, strings by length (in runes), slices and maps by length.
+// omitempty skips the rules which follow it when the value is zero.
+// Nested structs are validated recursively, field names are joined with a dot,
+// a pointer which refers back to a struct being validated is not followed again.
+// Records which are not structs (or pointers to structs) are considered valid.
+type StructTagValidator struct {
+	TagName string
+}
+
+func NewStructTagValidator() *StructTagValidator {
+	return &StructTagValidator{TagName: "validate"}
+}
+
+func (v *StructTagValidator) Validate(record interface{}) []*types.ValidationError {
+	// the pointers followed to reach the struct being validated (cycle detection)
+	visiting := make(map[uintptr]bool)
+	value := reflect.ValueOf(record)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		if value.Kind() == reflect.Ptr {
+			visiting[value.Pointer()] = true
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return v.validateStruct(value, "", visiting)
+}
+
+func (v *StructTagValidator) validateStruct(value reflect.Value, prefix string, visiting map[uintptr]bool) []*types.ValidationError {
+	var errors []*types.ValidationError
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fieldName := prefix + jsonFieldName(field)
+		fieldValue := value.Field(i)
+		tag := field.Tag.Get(v.TagName)
+		if tag == "-" {
+			continue
+		}
+
+		if tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if strings.TrimSpace(rule) == "omitempty" && isZero(fieldValue) {
+					// the remaining rules don't apply on an empty value
+					break
+				}
+				if err := checkRule(fieldName, fieldValue, rule); err != nil {
+					errors = append(errors, err)
+					// report only the first failing rule of a field
+					break
+				}
+			}
+		}
+
+		// validate nested structs
+		nested := fieldValue
+		var followed []uintptr
+		for nested.Kind() == reflect.Ptr && !nested.IsNil() && !visiting[nested.Pointer()] {
+			visiting[nested.Pointer()] = true
+			followed = append(followed, nested.Pointer())
+			nested = nested.Elem()
+		}
+		if nested.Kind() == reflect.Struct && nested.Type().PkgPath() != "time" {
+			errors = append(errors, v.validateStruct(nested, fieldName+".", visiting)...)
+		}
+		for _, ptr := range followed {
+			delete(visiting, ptr)
+		}
+	}
+
+	return errors
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+func checkRule(fieldName string, value reflect.Value, rule string) *types.ValidationError {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || rule == "omitempty" {
+		return nil
+	}
+
+	name, param, _ := strings.Cut(rule, "=")
+	fail := &types.ValidationError{FailedField: fieldName, Tag: rule, Value: formatValue(value)}
+
+	if name == "required" {
+		if isZero(value) {
+			return fail
+		}
+		return nil
+	}
+
+	// the other rules apply on the dereferenced value, nil pointers are skipped
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch name {
+	case "oneof":
+		current := fmt.Sprintf("%v", value.Interface())
+		for _, allowed := range strings.Fields(param) {
+			if current == allowed {
+				return nil
+			}
+		}
+		return fail
+	case "len", "min", "max", "gt", "gte", "lt", "lte":
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return &types.ValidationError{FailedField: fieldName, Tag: rule, Value: "invalid rule parameter"}
+		}
+		measure, ok := measureOf(value)
+		if !ok {
+			// the rule can't be applied on this kind of value
+			return nil
+		}
+		if !compareMeasure(name, measure, limit) {
+			return fail
+		}
+		return nil
+	default:
+		// unknown rules are left to the server side validation
+		return nil
+	}
+}
+
+func compareMeasure(rule string, measure float64, limit float64) bool {
+	switch rule {
+	case "len":
+		return measure == limit
+	case "min", "gte":
+		return measure >= limit
+	case "max", "lte":
+		return measure <= limit
+	case "gt":
+		return measure > limit
+	case "lt":
+		return measure < limit
+	default:
+		return true
+	}
+}
+
+func measureOf(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func isZero(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	case reflect.Slice, reflect.Map:
+		return value.IsNil() || value.Len() == 0
+	case reflect.Invalid:
+		return true
+	default:
+		return value.IsZero()
+	}
+}
+
+func formatValue(value reflect.Value) string {
+	if !value.IsValid() || !value.CanInterface() {
+		return ""
+	}
+	if value.Kind() == reflect.String {
+		return value.String()
+	}
+	data, err := json.Marshal(value.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", value.Interface())
+	}
+	return string(data)
+}
@@ -0,0 +1,127 @@
+package ministreamproducer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nbigot/ministream-client-go/client/types"
+)
+
+type validatedRecord struct {
+	Name     string   `json:"name" validate:"required,max=8"`
+	Level    string   `json:"level" validate:"oneof=debug info error"`
+	Priority int      `json:"priority" validate:"gte=0,lte=10"`
+	Tags     []string `json:"tags" validate:"max=2"`
+	Origin   *struct {
+		Host string `json:"host" validate:"required"`
+	} `json:"origin"`
+	Comment string `json:"comment" validate:"omitempty,min=3"`
+}
+
+type linkedRecord struct {
+	Name string        `json:"name" validate:"required"`
+	Next *linkedRecord `json:"next"`
+}
+
+func TestStructTagValidator(t *testing.T) {
+	validator := NewStructTagValidator()
+	tests := []struct {
+		name           string
+		record         interface{}
+		expectedFields []string
+	}{
+		{
+			name:           "valid record",
+			record:         &validatedRecord{Name: "api", Level: "info", Priority: 3},
+			expectedFields: nil,
+		},
+		{
+			name:           "missing required field",
+			record:         validatedRecord{Level: "info"},
+			expectedFields: []string{"name"},
+		},
+		{
+			name:           "several invalid fields",
+			record:         &validatedRecord{Name: "a very long name", Level: "warn", Priority: 11, Tags: []string{"a", "b", "c"}},
+			expectedFields: []string{"name", "level", "priority", "tags"},
+		},
+		{
+			name: "nested struct",
+			record: &validatedRecord{Name: "api", Level: "error", Origin: &struct {
+				Host string `json:"host" validate:"required"`
+			}{}},
+			expectedFields: []string{"origin.host"},
+		},
+		{
+			name:           "omitempty skips the other rules of an empty value",
+			record:         &validatedRecord{Name: "api", Level: "info", Comment: ""},
+			expectedFields: nil,
+		},
+		{
+			name:           "omitempty applies the other rules of a value",
+			record:         &validatedRecord{Name: "api", Level: "info", Comment: "ok"},
+			expectedFields: []string{"comment"},
+		},
+		{
+			name: "self-referential pointers",
+			record: func() *linkedRecord {
+				first := &linkedRecord{Name: "first"}
+				first.Next = &linkedRecord{Next: first}
+				return first
+			}(),
+			expectedFields: []string{"next.name"},
+		},
+		{
+			name:           "not a struct",
+			record:         "hello world",
+			expectedFields: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validator.Validate(tt.record)
+			if len(got) != len(tt.expectedFields) {
+				t.Fatalf("Validate() returned %d errors, want %d (%v)", len(got), len(tt.expectedFields), got)
+			}
+			for i, field := range tt.expectedFields {
+				if got[i].FailedField != field {
+					t.Errorf("Validate()[%d].FailedField = %v, want %v", i, got[i].FailedField, field)
+				}
+			}
+		})
+	}
+}
+
+func TestEnqueueRecordsRejectsInvalidRecords(t *testing.T) {
+	ctx := context.Background()
+	handler := NewMockProducerEventHandler(ctx, 0, 1)
+	producer := NewStreamProducer(ctx, nil, 0, NewMockProducerClient(), uuid.New(), handler)
+	handler.Init(producer)
+	producer.SetRecordValidator(NewStructTagValidator())
+	producer.State = types.ProducerStateRunning
+
+	records := []interface{}{
+		&validatedRecord{Name: "first", Level: "info"},
+		&validatedRecord{Name: "second", Level: "unknown"},
+	}
+	cpt, err := producer.EnqueueRecords(records)
+	if cpt != 0 {
+		t.Errorf("EnqueueRecords() = %v, want %v", cpt, 0)
+	}
+
+	var validationError *ProducerValidationError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("EnqueueRecords() error = %v, want a ProducerValidationError", err)
+	}
+	if validationError.RecordIndex != 1 {
+		t.Errorf("RecordIndex = %v, want %v", validationError.RecordIndex, 1)
+	}
+	if len(validationError.ValidationErrors) != 1 || validationError.ValidationErrors[0].FailedField != "level" {
+		t.Errorf("ValidationErrors = %v, want a single error on field level", validationError.ValidationErrors)
+	}
+	if !producer.RecordsQueue.IsEmpty() {
+		t.Errorf("RecordsQueue.Size() = %v, want %v", producer.RecordsQueue.Size(), 0)
+	}
+}